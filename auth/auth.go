@@ -0,0 +1,151 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"femboyz/db"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+// keyPrefix marks our keys so they are recognizable in configs and secret scanners
+const keyPrefix = "fbz_"
+
+// prefixLen is how much of a key is stored in clear to tell keys apart
+const prefixLen = len(keyPrefix) + 8
+
+type ctxKey struct{}
+
+// resolvedKey holds the *resolution Identify attached to a request
+type resolvedKey struct{}
+
+type resolution struct {
+	id  *Identity
+	err error
+}
+
+// Identity is who an authenticated request acts as
+type Identity struct {
+	KeyID  int64
+	Issuer string
+	Admin  bool
+}
+
+// HashKey returns the stored form of a key
+func HashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// NewKey creates and stores an api key for issuer. The plain key is only ever available here.
+func NewKey(keys db.KeyStore, issuer string, admin bool) (string, *db.APIKey, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", nil, err
+	}
+	key := keyPrefix + base64.RawURLEncoding.EncodeToString(b)
+	k := &db.APIKey{
+		KeyHash: HashKey(key),
+		Prefix:  key[:prefixLen],
+		Issuer:  issuer,
+		Admin:   admin,
+	}
+	err = keys.InsertAPIKey(k)
+	if err != nil {
+		return "", nil, err
+	}
+	return key, k, nil
+}
+
+// bearerToken extracts the token of an "Authorization: Bearer <token>" header
+func bearerToken(r *http.Request) string {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
+
+// Resolve looks up the identity behind the request's bearer key, or returns what Identify found for it.
+// Returns nil when there is no key or it is unknown or revoked.
+func Resolve(keys db.KeyStore, r *http.Request) (*Identity, error) {
+	if res, ok := r.Context().Value(resolvedKey{}).(*resolution); ok {
+		return res.id, res.err
+	}
+	return lookup(keys, r)
+}
+
+func lookup(keys db.KeyStore, r *http.Request) (*Identity, error) {
+	token := bearerToken(r)
+	if token == "" {
+		return nil, nil
+	}
+	k, err := keys.GetAPIKeyByHash(HashKey(token))
+	if err != nil {
+		return nil, err
+	}
+	if k == nil || k.Revoked {
+		return nil, nil
+	}
+	return &Identity{KeyID: k.ID, Issuer: k.Issuer, Admin: k.Admin}, nil
+}
+
+// Identify resolves the request's bearer key once, up front, so the limiters and Require after it
+// don't hash and look it up again. The identity is only in FromContext behind Require.
+func Identify(keys db.KeyStore, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, err := lookup(keys, r)
+		ctx := context.WithValue(r.Context(), resolvedKey{}, &resolution{id: id, err: err})
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// FromContext returns the identity Require attached to the request, nil for anonymous requests.
+func FromContext(ctx context.Context) *Identity {
+	id, _ := ctx.Value(ctxKey{}).(*Identity)
+	return id
+}
+
+// WithIdentity attaches an identity to ctx.
+func WithIdentity(ctx context.Context, id *Identity) context.Context {
+	return context.WithValue(ctx, ctxKey{}, id)
+}
+
+// Require only lets requests with a valid api key through, with their identity in the context.
+func Require(keys db.KeyStore, next http.Handler) http.Handler {
+	return require(keys, next, false)
+}
+
+// RequireAdmin is Require for keys created as admin keys.
+func RequireAdmin(keys db.KeyStore, next http.Handler) http.Handler {
+	return require(keys, next, true)
+}
+
+func require(keys db.KeyStore, next http.Handler, admin bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		loclog := "[auth.Require]"
+		id, err := Resolve(keys, r)
+		if err != nil {
+			slog.Error(loclog, "error", "failed to resolve api key", "path", r.URL.Path, "error", err.Error())
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if id == nil {
+			slog.Warn(loclog, "warning", "request without valid api key", "path", r.URL.Path)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="api"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if admin && !id.Admin {
+			slog.Warn(loclog, "warning", "admin request with non admin key", "path", r.URL.Path, "issuer", id.Issuer)
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(WithIdentity(r.Context(), id)))
+	})
+}
@@ -0,0 +1,130 @@
+package auth
+
+import (
+	"femboyz/db"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequire(t *testing.T) {
+	t.Parallel()
+	keys := db.NewMemory()
+
+	key, k, err := NewKey(keys, "ci", false)
+	if err != nil {
+		t.Fatalf("Failed to create key: %v", err)
+	}
+
+	var issuer string
+	h := Require(keys, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		issuer = FromContext(r.Context()).Issuer
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	cases := []struct {
+		name   string
+		header string
+		status int
+	}{
+		{"no header", "", http.StatusUnauthorized},
+		{"wrong scheme", "Basic " + key, http.StatusUnauthorized},
+		{"unknown key", "Bearer fbz_unknown", http.StatusUnauthorized},
+		{"valid key", "Bearer " + key, http.StatusOK},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest("POST", "/api/v1/send", nil)
+		if c.header != "" {
+			req.Header.Set("Authorization", c.header)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != c.status {
+			t.Errorf("%s: expected status %d, got %d", c.name, c.status, w.Code)
+		}
+	}
+	if issuer != "ci" {
+		t.Errorf("Expected issuer ci, got %q", issuer)
+	}
+
+	// revoked keys stop working
+	_, err = keys.RevokeAPIKeys(k.Prefix)
+	if err != nil {
+		t.Fatalf("Failed to revoke key: %v", err)
+	}
+	req := httptest.NewRequest("POST", "/api/v1/send", nil)
+	req.Header.Set("Authorization", "Bearer "+key)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected revoked key to be rejected, got %d", w.Code)
+	}
+}
+
+func TestRequireAdmin(t *testing.T) {
+	t.Parallel()
+	keys := db.NewMemory()
+
+	userKey, _, err := NewKey(keys, "ci", false)
+	if err != nil {
+		t.Fatalf("Failed to create key: %v", err)
+	}
+	adminKey, _, err := NewKey(keys, "ops", true)
+	if err != nil {
+		t.Fatalf("Failed to create key: %v", err)
+	}
+
+	h := RequireAdmin(keys, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	for key, status := range map[string]int{userKey: http.StatusForbidden, adminKey: http.StatusOK} {
+		req := httptest.NewRequest("GET", "/api/v1/admin/files", nil)
+		req.Header.Set("Authorization", "Bearer "+key)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != status {
+			t.Errorf("Expected status %d, got %d", status, w.Code)
+		}
+	}
+}
+
+// countingKeys counts the key lookups that reach the store
+type countingKeys struct {
+	db.KeyStore
+	lookups int
+}
+
+func (c *countingKeys) GetAPIKeyByHash(hash string) (*db.APIKey, error) {
+	c.lookups++
+	return c.KeyStore.GetAPIKeyByHash(hash)
+}
+
+func TestIdentify(t *testing.T) {
+	t.Parallel()
+	keys := &countingKeys{KeyStore: db.NewMemory()}
+	key, _, err := NewKey(keys, "ci", false)
+	if err != nil {
+		t.Fatalf("Failed to create key: %v", err)
+	}
+
+	var issuer string
+	h := Identify(keys, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the limiters resolve the key on their own before Require does
+		if id, err := Resolve(keys, r); err != nil || id == nil {
+			t.Errorf("Expected the key to be resolved, got %v, %v", id, err)
+		}
+		Require(keys, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			issuer = FromContext(r.Context()).Issuer
+		})).ServeHTTP(w, r)
+	}))
+
+	req := httptest.NewRequest("POST", "/api/v1/send", nil)
+	req.Header.Set("Authorization", "Bearer "+key)
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	if issuer != "ci" {
+		t.Errorf("Expected issuer ci, got %q", issuer)
+	}
+	if keys.lookups != 1 {
+		t.Errorf("Expected the key to be looked up once, got %d", keys.lookups)
+	}
+}
@@ -0,0 +1,60 @@
+package blobstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"time"
+)
+
+// ErrNotExist is returned when a key has no blob behind it.
+var ErrNotExist = errors.New("blob does not exist")
+
+// Info describes a stored blob.
+type Info struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
+
+// BlobStore keeps file contents by key. Keys are slash separated relative paths
+// (see fs.ValidPath), every implementation must accept the same set of keys.
+type BlobStore interface {
+	// Put stores r under key, replacing any previous blob. size is -1 when unknown.
+	// A blob only becomes visible to Get once Put has returned without error.
+	Put(ctx context.Context, key string, r io.Reader, size int64) error
+	// Get opens the blob for reading. The reader supports seeking so it can serve ranges.
+	Get(ctx context.Context, key string) (io.ReadSeekCloser, error)
+	Stat(ctx context.Context, key string) (Info, error)
+	// Move renames src to dst, replacing dst if it exists.
+	Move(ctx context.Context, src, dst string) error
+	// Delete removes the blob, deleting a missing key is not an error.
+	Delete(ctx context.Context, key string) error
+	// List calls fn for every blob whose key starts with prefix, stopping at the first error fn returns.
+	List(ctx context.Context, prefix string, fn func(Info) error) error
+}
+
+func validKey(key string) error {
+	if key == "" || !fs.ValidPath(key) || key == "." {
+		return fmt.Errorf("invalid blob key %q", key)
+	}
+	return nil
+}
+
+// New builds the store of backend, "local" (with the files under path) or "s3".
+func New(backend, path string, s3 S3Options) (BlobStore, error) {
+	loclog := "[blobstore.New]"
+	switch backend {
+	case "local":
+		slog.Info(loclog, "info", "using local blob store", "path", path)
+		return NewLocal(path)
+	case "s3":
+		slog.Info(loclog, "info", "using s3 blob store", "endpoint", s3.Endpoint, "bucket", s3.Bucket)
+		return NewS3(s3)
+	default:
+		return nil, fmt.Errorf("unknown blob backend %q", backend)
+	}
+}
@@ -0,0 +1,139 @@
+package blobstore
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/johannesboyne/gofakes3"
+	"github.com/johannesboyne/gofakes3/backend/s3mem"
+)
+
+// testStore runs the same checks against every implementation
+func testStore(t *testing.T, bs BlobStore) {
+	ctx := context.Background()
+
+	_, err := bs.Get(ctx, "missing")
+	if !errors.Is(err, ErrNotExist) {
+		t.Fatalf("expected ErrNotExist for missing key, got %v", err)
+	}
+
+	err = bs.Put(ctx, "a/one", strings.NewReader("hello world"), -1)
+	if err != nil {
+		t.Fatalf("failed to put blob: %v", err)
+	}
+	err = bs.Put(ctx, "b/two", strings.NewReader("second"), 6)
+	if err != nil {
+		t.Fatalf("failed to put blob: %v", err)
+	}
+
+	info, err := bs.Stat(ctx, "a/one")
+	if err != nil {
+		t.Fatalf("failed to stat blob: %v", err)
+	}
+	if info.Size != 11 {
+		t.Errorf("expected size 11, got %d", info.Size)
+	}
+
+	rc, err := bs.Get(ctx, "a/one")
+	if err != nil {
+		t.Fatalf("failed to get blob: %v", err)
+	}
+	_, err = rc.Seek(6, io.SeekStart)
+	if err != nil {
+		t.Fatalf("failed to seek blob: %v", err)
+	}
+	data, err := io.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		t.Fatalf("failed to read blob: %v", err)
+	}
+	if string(data) != "world" {
+		t.Errorf("expected %q after seek, got %q", "world", data)
+	}
+
+	var keys []string
+	err = bs.List(ctx, "a/", func(i Info) error {
+		keys = append(keys, i.Key)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed to list blobs: %v", err)
+	}
+	if len(keys) != 1 || keys[0] != "a/one" {
+		t.Errorf("expected [a/one], got %v", keys)
+	}
+
+	err = bs.Move(ctx, "b/two", "a/one")
+	if err != nil {
+		t.Fatalf("failed to move blob: %v", err)
+	}
+	_, err = bs.Stat(ctx, "b/two")
+	if !errors.Is(err, ErrNotExist) {
+		t.Errorf("expected ErrNotExist for moved source, got %v", err)
+	}
+	info, err = bs.Stat(ctx, "a/one")
+	if err != nil {
+		t.Fatalf("failed to stat moved blob: %v", err)
+	}
+	if info.Size != 6 {
+		t.Errorf("expected moved blob to replace destination with size 6, got %d", info.Size)
+	}
+
+	err = bs.Delete(ctx, "a/one")
+	if err != nil {
+		t.Fatalf("failed to delete blob: %v", err)
+	}
+	_, err = bs.Stat(ctx, "a/one")
+	if !errors.Is(err, ErrNotExist) {
+		t.Errorf("expected ErrNotExist after delete, got %v", err)
+	}
+	err = bs.Delete(ctx, "a/one")
+	if err != nil {
+		t.Errorf("expected deleting a missing blob to succeed, got %v", err)
+	}
+
+	err = bs.Put(ctx, "../escape", strings.NewReader("x"), 1)
+	if err == nil {
+		t.Errorf("expected invalid key to be rejected")
+	}
+}
+
+func TestLocal(t *testing.T) {
+	bs, err := NewLocal(t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to create local store: %v", err)
+	}
+	testStore(t, bs)
+}
+
+func TestS3(t *testing.T) {
+	// in-process S3 stand-in, served over TLS because minio-go
+	// uses streaming signatures on plain http which the stand-in doesn't speak
+	backend := s3mem.New()
+	faker := gofakes3.New(backend)
+	ts := httptest.NewTLSServer(faker.Server())
+	defer ts.Close()
+
+	err := backend.CreateBucket("blobs")
+	if err != nil {
+		t.Fatalf("failed to create bucket: %v", err)
+	}
+
+	bs, err := NewS3(S3Options{
+		Endpoint:  strings.TrimPrefix(ts.URL, "https://"),
+		Bucket:    "blobs",
+		Region:    "us-east-1",
+		AccessKey: "test",
+		SecretKey: "test",
+		UseSSL:    true,
+		Transport: ts.Client().Transport,
+	})
+	if err != nil {
+		t.Fatalf("failed to create s3 store: %v", err)
+	}
+	testStore(t, bs)
+}
@@ -0,0 +1,152 @@
+package blobstore
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+type S3Options struct {
+	// Endpoint is host[:port] without a scheme, e.g. "s3.amazonaws.com" or "localhost:9000"
+	Endpoint  string
+	Bucket    string
+	Region    string
+	AccessKey string
+	SecretKey string
+	UseSSL    bool
+	// Transport overrides the http transport, nil uses the default
+	Transport http.RoundTripper
+}
+
+// S3 stores blobs as objects in a bucket of any S3 compatible service.
+type S3 struct {
+	client *minio.Client
+	bucket string
+}
+
+func NewS3(o S3Options) (*S3, error) {
+	if o.Endpoint == "" || o.Bucket == "" {
+		return nil, errors.New("s3 blob store needs an endpoint and a bucket")
+	}
+	client, err := minio.New(o.Endpoint, &minio.Options{
+		Creds:     credentials.NewStaticV4(o.AccessKey, o.SecretKey, ""),
+		Secure:    o.UseSSL,
+		Region:    o.Region,
+		Transport: o.Transport,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &S3{client: client, bucket: o.Bucket}, nil
+}
+
+func isNotFound(err error) bool {
+	code := minio.ToErrorResponse(err).Code
+	return code == minio.NoSuchKey || code == "NotFound"
+}
+
+// unknownSizePartSize is the part size of uploads of unknown size. minio-go would otherwise size the parts
+// for the largest object S3 allows and buffer about 512MiB per upload. It caps such blobs at 10000 parts, 160GiB.
+const unknownSizePartSize = 16 << 20
+
+func (s *S3) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	if err := validKey(key); err != nil {
+		return err
+	}
+	opts := minio.PutObjectOptions{ContentType: "application/octet-stream"}
+	if size < 0 {
+		opts.PartSize = unknownSizePartSize
+	}
+	_, err := s.client.PutObject(ctx, s.bucket, key, r, size, opts)
+	return err
+}
+
+func (s *S3) Get(ctx context.Context, key string) (io.ReadSeekCloser, error) {
+	if err := validKey(key); err != nil {
+		return nil, err
+	}
+	obj, err := s.client.GetObject(ctx, s.bucket, key, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+	// GetObject is lazy, stat it so a missing key fails here and not on the first read
+	if _, err = obj.Stat(); err != nil {
+		obj.Close()
+		if isNotFound(err) {
+			return nil, ErrNotExist
+		}
+		return nil, err
+	}
+	return obj, nil
+}
+
+func (s *S3) Stat(ctx context.Context, key string) (Info, error) {
+	if err := validKey(key); err != nil {
+		return Info{}, err
+	}
+	oi, err := s.client.StatObject(ctx, s.bucket, key, minio.StatObjectOptions{})
+	if err != nil {
+		if isNotFound(err) {
+			return Info{}, ErrNotExist
+		}
+		return Info{}, err
+	}
+	return Info{Key: key, Size: oi.Size, ModTime: oi.LastModified}, nil
+}
+
+// maxCopySize is the largest object S3 copies in a single request
+const maxCopySize = 5 << 30
+
+func (s *S3) Move(ctx context.Context, src, dst string) error {
+	if err := validKey(src); err != nil {
+		return err
+	}
+	if err := validKey(dst); err != nil {
+		return err
+	}
+	info, err := s.Stat(ctx, src)
+	if err != nil {
+		return err
+	}
+	// S3 has no rename, copy server side and drop the source
+	srcOpts := minio.CopySrcOptions{Bucket: s.bucket, Object: src}
+	dstOpts := minio.CopyDestOptions{Bucket: s.bucket, Object: dst}
+	if info.Size > maxCopySize {
+		_, err = s.client.ComposeObject(ctx, dstOpts, srcOpts)
+	} else {
+		_, err = s.client.CopyObject(ctx, dstOpts, srcOpts)
+	}
+	if err != nil {
+		return err
+	}
+	return s.Delete(ctx, src)
+}
+
+func (s *S3) Delete(ctx context.Context, key string) error {
+	if err := validKey(key); err != nil {
+		return err
+	}
+	err := s.client.RemoveObject(ctx, s.bucket, key, minio.RemoveObjectOptions{})
+	if isNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+func (s *S3) List(ctx context.Context, prefix string, fn func(Info) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	for oi := range s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{Prefix: prefix, Recursive: true}) {
+		if oi.Err != nil {
+			return oi.Err
+		}
+		if err := fn(Info{Key: oi.Key, Size: oi.Size, ModTime: oi.LastModified}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,176 @@
+// Package clientip finds the address of the client behind a request, trusting forwarding headers
+// only as far as they were written by known proxies.
+package clientip
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+type ctxKey struct{}
+
+// The forwarding headers a Resolver can be told to believe, as they are named in the configuration
+const (
+	Forwarded     = "forwarded"
+	XForwardedFor = "x-forwarded-for"
+	XRealIP       = "x-real-ip"
+)
+
+// privateRanges are what "private" stands for in ParseTrusted: loopback, RFC 1918 and unique local addresses
+var privateRanges = []string{"127.0.0.0/8", "::1/128", "10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "fc00::/7"}
+
+// ParseTrusted reads a comma separated list of CIDRs and addresses, "private" adds the private ranges.
+func ParseTrusted(s string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for item := range strings.SplitSeq(s, ",") {
+		item = strings.TrimSpace(item)
+		switch {
+		case item == "":
+		case item == "private":
+			for _, r := range privateRanges {
+				prefixes = append(prefixes, netip.MustParsePrefix(r))
+			}
+		case strings.Contains(item, "/"):
+			p, err := netip.ParsePrefix(item)
+			if err != nil {
+				return nil, fmt.Errorf("trusted proxy %q: %w", item, err)
+			}
+			prefixes = append(prefixes, p.Masked())
+		default:
+			a, err := netip.ParseAddr(item)
+			if err != nil {
+				return nil, fmt.Errorf("trusted proxy %q: %w", item, err)
+			}
+			a = a.Unmap()
+			prefixes = append(prefixes, netip.PrefixFrom(a, a.BitLen()))
+		}
+	}
+	return prefixes, nil
+}
+
+// Resolver tells the client address of requests that came through the trusted proxies.
+// The zero Resolver trusts no proxy and always uses the connection's address.
+type Resolver struct {
+	trusted []netip.Prefix
+	// header is the one forwarding header the proxies write, Forwarded, XForwardedFor or XRealIP
+	header string
+}
+
+// New trusts the header, one of Forwarded, XForwardedFor and XRealIP, of requests from the trusted proxies.
+// Only that header is read: proxies pass the others on as the client sent them.
+func New(trusted []netip.Prefix, header string) *Resolver {
+	return &Resolver{trusted: trusted, header: header}
+}
+
+func (res *Resolver) isTrusted(a netip.Addr) bool {
+	for _, p := range res.trusted {
+		if p.Contains(a) {
+			return true
+		}
+	}
+	return false
+}
+
+// Resolve returns the client address without port. While the connection comes from a trusted proxy,
+// the forwarding chain of the trusted header is walked from the nearest hop
+// back and the first address that is not a trusted proxy is the client. A malformed hop ends the walk
+// at the last trusted one, so a client can't choose its address by sending forwarding headers itself.
+func (res *Resolver) Resolve(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	remote, err := netip.ParseAddr(host)
+	if err != nil {
+		return host
+	}
+	client := remote.Unmap()
+	if !res.isTrusted(client) {
+		return client.String()
+	}
+
+	chain := forwardedChain(r.Header, res.header)
+	for i := len(chain) - 1; i >= 0; i-- {
+		hop, err := parseHop(chain[i])
+		if err != nil {
+			break
+		}
+		client = hop
+		if !res.isTrusted(hop) {
+			break
+		}
+	}
+	return client.String()
+}
+
+// forwardedChain returns the forwarded-for addresses of the given forwarding header, client first
+func forwardedChain(h http.Header, header string) []string {
+	var chain []string
+	switch header {
+	case Forwarded:
+		for _, v := range h.Values("Forwarded") {
+			for element := range strings.SplitSeq(v, ",") {
+				chain = append(chain, forwardedFor(element))
+			}
+		}
+	case XForwardedFor:
+		for _, v := range h.Values("X-Forwarded-For") {
+			for hop := range strings.SplitSeq(v, ",") {
+				chain = append(chain, strings.TrimSpace(hop))
+			}
+		}
+	case XRealIP:
+		if v := h.Get("X-Real-IP"); v != "" {
+			chain = append(chain, strings.TrimSpace(v))
+		}
+	}
+	return chain
+}
+
+// forwardedFor returns the for= value of one Forwarded element, empty if it has none
+func forwardedFor(element string) string {
+	for pair := range strings.SplitSeq(element, ";") {
+		key, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if ok && strings.EqualFold(key, "for") {
+			return strings.Trim(value, `"`)
+		}
+	}
+	return ""
+}
+
+// parseHop reads one forwarded address: "ip", "ip:port", "[ipv6]" or "[ipv6]:port".
+// "unknown" and obfuscated identifiers are errors.
+func parseHop(hop string) (netip.Addr, error) {
+	if ap, err := netip.ParseAddrPort(hop); err == nil {
+		return ap.Addr().Unmap(), nil
+	}
+	a, err := netip.ParseAddr(strings.TrimSuffix(strings.TrimPrefix(hop, "["), "]"))
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	return a.Unmap(), nil
+}
+
+// Middleware resolves the client address once and makes it available to FromRequest.
+func (res *Resolver) Middleware(next http.Handler) http.Handler {
+	loclog := "[clientip.Middleware]"
+	slog.Info(loclog, "info", "client ip resolver initialized", "trusted_proxies", len(res.trusted), "header", res.header)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), ctxKey{}, res.Resolve(r))
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// FromRequest returns the client address Middleware resolved. Requests that did not pass through it
+// get the connection's address, as if no proxy were trusted.
+func FromRequest(r *http.Request) string {
+	if ip, ok := r.Context().Value(ctxKey{}).(string); ok {
+		return ip
+	}
+	return (&Resolver{}).Resolve(r)
+}
@@ -0,0 +1,75 @@
+package clientip
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestResolve(t *testing.T) {
+	trusted, err := ParseTrusted("10.0.0.0/8, 192.168.1.1")
+	if err != nil {
+		t.Fatalf("Failed to parse trusted proxies: %v", err)
+	}
+	tests := []struct {
+		name    string
+		trusted string
+		remote  string
+		header  map[string]string
+		want    string
+	}{
+		{"direct", XForwardedFor, "203.0.113.7:1234", nil, "203.0.113.7"},
+		{"spoofed by an untrusted client", XForwardedFor, "203.0.113.7:1234", map[string]string{"X-Forwarded-For": "1.2.3.4"}, "203.0.113.7"},
+		{"through a proxy", XForwardedFor, "10.0.0.2:1234", map[string]string{"X-Forwarded-For": "203.0.113.7"}, "203.0.113.7"},
+		{"spoof through a proxy", XForwardedFor, "10.0.0.2:1234", map[string]string{"X-Forwarded-For": "1.2.3.4, 203.0.113.7"}, "203.0.113.7"},
+		{"proxy chain", XForwardedFor, "10.0.0.2:1234", map[string]string{"X-Forwarded-For": "203.0.113.7, 192.168.1.1"}, "203.0.113.7"},
+		{"malformed hop", XForwardedFor, "10.0.0.2:1234", map[string]string{"X-Forwarded-For": "nonsense, 10.0.0.3"}, "10.0.0.3"},
+		// an x-forwarded-for proxy passes on the Forwarded header the client made up
+		{"forwarded spoofed through a proxy", XForwardedFor, "10.0.0.2:1234", map[string]string{"Forwarded": "for=1.2.3.4", "X-Forwarded-For": "203.0.113.7"}, "203.0.113.7"},
+		{"real ip spoofed through a proxy", XForwardedFor, "10.0.0.2:1234", map[string]string{"X-Real-IP": "1.2.3.4"}, "10.0.0.2"},
+		{"forwarded", Forwarded, "10.0.0.2:1234", map[string]string{"Forwarded": `for=1.2.3.4, for="[2001:db8::17]:4711";proto=https`}, "2001:db8::17"},
+		{"forwarded unknown", Forwarded, "10.0.0.2:1234", map[string]string{"Forwarded": "for=unknown"}, "10.0.0.2"},
+		{"x-forwarded-for spoofed through a forwarded proxy", Forwarded, "10.0.0.2:1234", map[string]string{"Forwarded": "for=203.0.113.7", "X-Forwarded-For": "1.2.3.4"}, "203.0.113.7"},
+		{"real ip", XRealIP, "10.0.0.2:1234", map[string]string{"X-Real-IP": "203.0.113.7"}, "203.0.113.7"},
+		{"mapped v4", XForwardedFor, "[::ffff:203.0.113.7]:1234", nil, "203.0.113.7"},
+		{"all trusted", XForwardedFor, "10.0.0.2:1234", map[string]string{"X-Forwarded-For": "10.0.0.9"}, "10.0.0.9"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = tt.remote
+		for k, v := range tt.header {
+			req.Header.Set(k, v)
+		}
+		if got := New(trusted, tt.trusted).Resolve(req); got != tt.want {
+			t.Errorf("%s: expected %s, got %s", tt.name, tt.want, got)
+		}
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	trusted, _ := ParseTrusted("private")
+	var got string
+	handler := New(trusted, XForwardedFor).Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = FromRequest(r)
+	}))
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "127.0.0.1:1234"
+	req.Header.Set("X-Forwarded-For", "203.0.113.7")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if got != "203.0.113.7" {
+		t.Errorf("Expected the forwarded client, got %s", got)
+	}
+
+	// without the middleware nothing is trusted
+	if ip := FromRequest(req); ip != "127.0.0.1" {
+		t.Errorf("Expected the connection's address, got %s", ip)
+	}
+}
+
+func TestParseTrusted(t *testing.T) {
+	for _, s := range []string{"10.0.0.0/33", "proxy.local", "10.0.0.1/8/8"} {
+		if _, err := ParseTrusted(s); err == nil {
+			t.Errorf("Expected %q to be rejected", s)
+		}
+	}
+}
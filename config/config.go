@@ -0,0 +1,383 @@
+package config
+
+import (
+	"errors"
+	"femboyz/env"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+// Config is the server configuration, see settings for what each field is set from.
+type Config struct {
+	Dev            bool
+	DevHost        string
+	DevPort        string
+	Host           string
+	Port           string
+	TLSCertPath    string
+	TLSKeyPath     string
+	AllowedOrigins []string
+	AllowedMethods []string
+	// TrustedProxies are cidrs, addresses and "private", as clientip.ParseTrusted reads them
+	TrustedProxies []string
+	// TrustedProxyHeader is one of the header names of clientip: forwarded, x-forwarded-for or x-real-ip
+	TrustedProxyHeader string
+
+	ReadHeaderTimeout time.Duration
+	ReadTimeout       time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	TransferTimeout   time.Duration
+	ShutdownTimeout   time.Duration
+
+	DBPath           string
+	DBDSN            string
+	HealthCheckToken string
+
+	RateLimit       float64
+	RateBurst       int
+	RatePolicies    string
+	RateIPv4Prefix  int
+	RateIPv6Prefix  int
+	RateMaxVisitors int
+	RedisURL        string
+
+	// byte rates as ratelimiter.ParseByteRate reads them
+	BandwidthLimit         string
+	BandwidthPerIP         string
+	BandwidthPerKey        string
+	MaxConcurrentDownloads int
+
+	BanMaxRefused  int
+	BanMaxNotFound int
+	BanWindow      time.Duration
+	BanDuration    time.Duration
+	BanMaxDuration time.Duration
+
+	BlobBackend string
+	BlobPath    string
+	S3Endpoint  string
+	S3Bucket    string
+	S3Region    string
+	S3AccessKey string
+	S3SecretKey string
+	S3UseSSL    bool
+
+	CounterFlushInterval time.Duration
+	ReaperInterval       time.Duration
+	UploadTTL            time.Duration
+
+	// sources tells where each setting, by key, was taken from
+	sources map[string]source
+}
+
+// source is where a value was taken from, the name is the setting's name there
+type source struct {
+	from, name string
+}
+
+func (s source) String() string {
+	if s.from == "default" {
+		return "default"
+	}
+	return s.name + " from " + s.from
+}
+
+// Loader reads the configuration from, lowest precedence first, the defaults, the toml file named by
+// -config or CONFIG_FILE, the environment (including .env) and the command line flags.
+// Secret settings can also be read from a file named at any of those levels by the setting's name
+// with a _FILE suffix (_file in the toml file, -file for flags), e.g. HC_TOKEN_FILE=/run/secrets/hc_token.
+// An empty environment variable counts as unset, as for env.EnvKey.Get: env files and container
+// definitions leave out values that way. A flag set to nothing, e.g. -trusted-proxies=, clears a value.
+type Loader struct {
+	file   string
+	flags  map[string]string
+	checks []check
+}
+
+// check validates a setting in a way only the package it is for knows, see Loader.Check
+type check struct {
+	key   string
+	check func(c *Config) error
+}
+
+// NewLoader defines -config and a flag per setting on fs, named like the file key with - for _.
+func NewLoader(fs *flag.FlagSet) *Loader {
+	l := &Loader{flags: make(map[string]string)}
+	fs.StringVar(&l.file, "config", "", "read settings from this toml file (env "+string(env.ConfigFile)+")")
+	for _, s := range settings {
+		usage := fmt.Sprintf("%s (env %s, default %q)", s.usage, s.env, s.def)
+		if s.isBool {
+			fs.BoolFunc(s.flag(), usage, l.record("-"+s.flag()))
+		} else {
+			fs.Func(s.flag(), usage, l.record("-"+s.flag()))
+		}
+		if s.secret {
+			fs.Func(s.flag()+"-file", fmt.Sprintf("read %s from this file (env %s_FILE)", s.key, s.env), l.record("-"+s.flag()+"-file"))
+		}
+	}
+	return l
+}
+
+// Check has Load validate the setting at key with fn once every setting is read, so the packages
+// settings are for can check them without config depending on those packages.
+func (l *Loader) Check(key string, fn func(c *Config) error) {
+	l.checks = append(l.checks, check{key, fn})
+}
+
+func (l *Loader) record(name string) func(string) error {
+	return func(v string) error {
+		l.flags[name] = v
+		return nil
+	}
+}
+
+// level is one of the places settings are read from, get returns the value set under name
+type level struct {
+	from string
+	get  func(name string) (string, bool)
+	// name is the name of s, or of the file holding its value, at this level
+	name func(s setting, file bool) string
+}
+
+// suffix returns s for the name of the file holding a value, nothing for the value's own name
+func suffix(file bool, s string) string {
+	if file {
+		return s
+	}
+	return ""
+}
+
+// lookup returns the value of s from the highest level it is set at
+func lookup(s setting, levels []level) (string, source, error) {
+	v, src := s.def, source{from: "default", name: s.key}
+	for _, lv := range levels {
+		name := lv.name(s, false)
+		direct, ok := lv.get(name)
+		if ok {
+			v, src = direct, source{lv.from, name}
+		}
+		if !s.secret {
+			continue
+		}
+		fileName := lv.name(s, true)
+		path, fromFile := lv.get(fileName)
+		if !fromFile {
+			continue
+		}
+		if ok {
+			return "", source{lv.from, fileName}, fmt.Errorf("%s (%s): %s is set too, set only one of them", fileName, lv.from, name)
+		}
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return "", source{lv.from, fileName}, fmt.Errorf("%s=%q (%s): %w", fileName, path, lv.from, err)
+		}
+		// files written by hand or by echo end with a newline that is no part of the secret
+		v, src = strings.TrimRight(string(b), "\r\n"), source{lv.from, fileName}
+	}
+	return v, src, nil
+}
+
+// Load builds the configuration, the error lists every invalid setting by the name it was given under.
+func (l *Loader) Load() (*Config, error) {
+	loclog := "[config.Load]"
+	c := &Config{sources: make(map[string]source)}
+
+	path, fileSource := l.file, source{"flag", "-config"}
+	if path == "" {
+		path, fileSource = env.ConfigFile.Get(), source{"env", string(env.ConfigFile)}
+	}
+	file, err := readFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("%s=%q: %w", fileSource.name, path, err)
+	}
+
+	levels := []level{
+		{
+			from: "file " + path,
+			get: func(name string) (string, bool) {
+				v, ok := file[name]
+				return v, ok
+			},
+			name: func(s setting, f bool) string { return s.key + suffix(f, "_file") },
+		},
+		{
+			from: "env",
+			get: func(name string) (string, bool) {
+				v := os.Getenv(name)
+				return v, v != ""
+			},
+			name: func(s setting, f bool) string { return string(s.env) + suffix(f, "_FILE") },
+		},
+		{
+			from: "flag",
+			get: func(name string) (string, bool) {
+				v, ok := l.flags[name]
+				return v, ok
+			},
+			name: func(s setting, f bool) string { return "-" + s.flag() + suffix(f, "-file") },
+		},
+	}
+
+	var errs []error
+	for _, s := range settings {
+		v, src, err := lookup(s, levels)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		c.sources[s.key] = src
+		if err := s.set(c, v); err != nil {
+			shown := v
+			if s.secret {
+				shown = redacted
+			}
+			errs = append(errs, fmt.Errorf("%s=%q (%s): %w", src.name, shown, src.from, err))
+		}
+	}
+	if len(errs) == 0 {
+		errs = c.validate()
+		for _, ch := range l.checks {
+			if err := ch.check(c); err != nil {
+				errs = append(errs, c.errorf(ch.key, "%v", err))
+			}
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+
+	for _, s := range settings {
+		slog.Info(loclog, "info", "setting", "key", s.key, "value", s.show(c), "source", c.sources[s.key].String())
+	}
+	return c, nil
+}
+
+// readFile returns the settings of a toml file as strings, as if they were set in the environment.
+// No path means no file.
+func readFile(path string) (map[string]string, error) {
+	values := make(map[string]string)
+	if path == "" {
+		return values, nil
+	}
+	var raw map[string]any
+	if _, err := toml.DecodeFile(path, &raw); err != nil {
+		return nil, err
+	}
+	known := make(map[string]bool, len(settings))
+	for _, s := range settings {
+		known[s.key] = true
+		if s.secret {
+			known[s.key+"_file"] = true
+		}
+	}
+	var errs []error
+	for key, v := range raw {
+		if !known[key] {
+			errs = append(errs, fmt.Errorf("unknown setting %q", key))
+			continue
+		}
+		switch v := v.(type) {
+		case []any:
+			items := make([]string, len(v))
+			for i, item := range v {
+				items[i] = fmt.Sprint(item)
+			}
+			values[key] = strings.Join(items, ",")
+		case map[string]any:
+			errs = append(errs, fmt.Errorf("setting %q is a table", key))
+		default:
+			values[key] = fmt.Sprint(v)
+		}
+	}
+	return values, errors.Join(errs...)
+}
+
+// errorf describes a problem with the setting at key, by the name it was given under
+func (c *Config) errorf(key, format string, args ...any) error {
+	src := c.sources[key]
+	return fmt.Errorf("%s (%s): %s", src.name, src.from, fmt.Sprintf(format, args...))
+}
+
+// validate checks the settings that only make sense together
+func (c *Config) validate() []error {
+	var errs []error
+	if !c.Dev && (c.TLSCertPath == "" || c.TLSKeyPath == "") {
+		errs = append(errs, c.errorf("tls_cert_path", "both tls_cert_path and tls_key_path are required unless dev is set"))
+	}
+	if c.BlobBackend == "s3" && c.S3Bucket == "" {
+		errs = append(errs, c.errorf("s3_bucket", "required when blob_backend is s3"))
+	}
+	if c.BanDuration > c.BanMaxDuration {
+		errs = append(errs, c.errorf("ban_duration", "longer than ban_max_duration (%s)", c.BanMaxDuration))
+	}
+	return errs
+}
+
+// Print writes the configuration as a toml file, with where each value came from.
+// Secrets are redacted, see setting.show.
+func (c *Config) Print(w io.Writer) {
+	for _, s := range settings {
+		fmt.Fprintf(w, "%s = %s # %s\n", s.key, tomlValue(s.show(c)), c.sources[s.key])
+	}
+}
+
+// Change is a setting that differs between two configurations, values are shown as Print writes them.
+// Live changes take effect on reload, the others once the server is restarted.
+type Change struct {
+	Key  string `json:"key"`
+	Old  string `json:"old"`
+	New  string `json:"new"`
+	Live bool   `json:"live"`
+}
+
+// Diff lists the settings that differ from old to new, in the order of settings
+func Diff(old, new *Config) []Change {
+	var changes []Change
+	for _, s := range settings {
+		if reflect.DeepEqual(s.get(old), s.get(new)) {
+			continue
+		}
+		changes = append(changes, Change{Key: s.key, Old: tomlValue(s.show(old)), New: tomlValue(s.show(new)), Live: s.live})
+	}
+	return changes
+}
+
+func tomlValue(v any) string {
+	switch v := v.(type) {
+	case string:
+		return strconv.Quote(v)
+	case time.Duration:
+		return strconv.Quote(v.String())
+	case []string:
+		items := make([]string, len(v))
+		for i, item := range v {
+			items[i] = strconv.Quote(item)
+		}
+		return "[" + strings.Join(items, ", ") + "]"
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// MustLoad loads the configuration, exiting with every invalid setting listed when that fails.
+func MustLoad(l *Loader) *Config {
+	loclog := "[config.MustLoad]"
+	c, err := l.Load()
+	if err != nil {
+		for _, line := range strings.Split(err.Error(), "\n") {
+			slog.Error(loclog, "FATAL", "invalid configuration", "error", line)
+		}
+		os.Exit(1)
+	}
+	return c
+}
@@ -0,0 +1,213 @@
+package config
+
+import (
+	"errors"
+	"femboyz/env"
+	"fmt"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// setting is one configuration value, key is its name in the file
+type setting struct {
+	key    string
+	env    env.EnvKey
+	def    string
+	usage  string
+	isBool bool
+	// secret settings are never logged or printed, and can be read from a file (see Loader)
+	secret bool
+	// live settings take effect on reload, the others need a restart (see Diff)
+	live bool
+	// set parses v into its field of c
+	set func(c *Config, v string) error
+	// get returns the field of c
+	get func(c *Config) any
+}
+
+// redacted stands in for the value of a secret setting
+const redacted = "<redacted>"
+
+// show returns the field of c for logging and printing, secrets redacted when set
+func (s setting) show(c *Config) any {
+	v := s.get(c)
+	if s.secret && v != "" {
+		return redacted
+	}
+	return v
+}
+
+// secret marks s as a secret setting
+func secret(s setting) setting {
+	s.secret = true
+	return s
+}
+
+// live marks s as taking effect on reload
+func live(s setting) setting {
+	s.live = true
+	return s
+}
+
+// flag is the name of the setting's command line flag
+func (s setting) flag() string {
+	return strings.ReplaceAll(s.key, "_", "-")
+}
+
+func field[T any](key string, envKey env.EnvKey, def, usage string, f func(*Config) *T, parse func(string) (T, error)) setting {
+	_, isBool := any(new(T)).(*bool)
+	return setting{
+		key:    key,
+		env:    envKey,
+		def:    def,
+		usage:  usage,
+		isBool: isBool,
+		set: func(c *Config, v string) error {
+			x, err := parse(v)
+			if err != nil {
+				return err
+			}
+			*f(c) = x
+			return nil
+		},
+		get: func(c *Config) any { return *f(c) },
+	}
+}
+
+var settings = []setting{
+	field("dev", env.DevMode, "false", "serve plain http on dev_host:dev_port instead of https", func(c *Config) *bool { return &c.Dev }, strconv.ParseBool),
+	field("dev_host", env.DevHost, "", "address to listen on in dev mode", func(c *Config) *string { return &c.DevHost }, parseString),
+	field("dev_port", env.DevPort, "8080", "port to listen on in dev mode", func(c *Config) *string { return &c.DevPort }, parsePort),
+	field("host", env.Host, "", "address to listen on", func(c *Config) *string { return &c.Host }, parseString),
+	field("port", env.Port, "443", "port to listen on", func(c *Config) *string { return &c.Port }, parsePort),
+	live(field("tls_cert_path", env.TLSCertPath, "", "tls certificate file", func(c *Config) *string { return &c.TLSCertPath }, parseString)),
+	live(field("tls_key_path", env.TLSKeyPath, "", "tls key file", func(c *Config) *string { return &c.TLSKeyPath }, parseString)),
+	live(field("allowed_origins", env.AllowedOrigins, "", "cors origins, comma separated", func(c *Config) *[]string { return &c.AllowedOrigins }, parseList)),
+	live(field("allowed_methods", env.AllowedMethods, "", "cors methods, comma separated", func(c *Config) *[]string { return &c.AllowedMethods }, parseList)),
+	field("trusted_proxies", env.TrustedProxies, "", `proxies whose forwarding headers are believed, comma separated cidrs, addresses or "private"`, func(c *Config) *[]string { return &c.TrustedProxies }, parseList),
+	field("trusted_proxy_header", env.TrustedProxyHeader, "x-forwarded-for", "the forwarding header the trusted proxies write, the others are ignored", func(c *Config) *string { return &c.TrustedProxyHeader }, parseOneOf("forwarded", "x-forwarded-for", "x-real-ip")),
+	field("read_header_timeout", env.ReadHeaderTimeout, "10s", "how long a client may take to send the request headers", func(c *Config) *time.Duration { return &c.ReadHeaderTimeout }, parseDuration),
+	field("read_timeout", env.ReadTimeout, "1m", "how long a client may take to send a request, uploads excepted", func(c *Config) *time.Duration { return &c.ReadTimeout }, parseDuration),
+	field("write_timeout", env.WriteTimeout, "1m", "how long writing a response may take, downloads excepted", func(c *Config) *time.Duration { return &c.WriteTimeout }, parseDuration),
+	field("idle_timeout", env.IdleTimeout, "2m", "how long an idle keep-alive connection is kept open", func(c *Config) *time.Duration { return &c.IdleTimeout }, parseDuration),
+	field("transfer_timeout", env.TransferTimeout, "6h", "how long an upload or download may take", func(c *Config) *time.Duration { return &c.TransferTimeout }, parseDuration),
+	field("shutdown_timeout", env.ShutdownTimeout, "30s", "how long running requests are given to finish on shutdown", func(c *Config) *time.Duration { return &c.ShutdownTimeout }, parseDuration),
+
+	field("db_path", env.DBPath, "main.db", "sqlite database file", func(c *Config) *string { return &c.DBPath }, parseString),
+	secret(field("db_dsn", env.DBDSN, "", "postgres connection string, used instead of db_path when set", func(c *Config) *string { return &c.DBDSN }, parseString)),
+	secret(live(field("health_check_token", env.HealthCheckToken, "", "Authorization header value /health requires", func(c *Config) *string { return &c.HealthCheckToken }, parseString))),
+
+	live(field("rate_limit", env.RateLimit, "5", "requests per second per client", func(c *Config) *float64 { return &c.RateLimit }, parseRate)),
+	live(field("rate_burst", env.RateBurst, "10", "requests a client may make at once", func(c *Config) *int { return &c.RateBurst }, parseInt(1, 1<<20))),
+	live(field("rate_policies", env.RatePolicies, "", "rate limits per route and api key (see ratelimiter.ParseRules)", func(c *Config) *string { return &c.RatePolicies }, parseString)),
+	live(field("rate_ipv4_prefix", env.RateIPv4Prefix, "32", "IPv4 prefix length anonymous clients are limited by", func(c *Config) *int { return &c.RateIPv4Prefix }, parseInt(1, 32))),
+	live(field("rate_ipv6_prefix", env.RateIPv6Prefix, "64", "IPv6 prefix length anonymous clients are limited by", func(c *Config) *int { return &c.RateIPv6Prefix }, parseInt(1, 128))),
+	field("rate_max_visitors", env.RateMaxVisitors, "100000", "rate limit buckets kept in memory", func(c *Config) *int { return &c.RateMaxVisitors }, parseInt(1, 1<<30)),
+	secret(field("redis_url", env.RedisURL, "", "redis to keep rate limits in, shared by every instance using it", func(c *Config) *string { return &c.RedisURL }, parseRedisURL)),
+
+	live(field("bandwidth_limit", env.BandwidthLimit, "", `download bytes per second shared by everyone, e.g. "10M", empty for unlimited`, func(c *Config) *string { return &c.BandwidthLimit }, parseString)),
+	live(field("bandwidth_per_ip", env.BandwidthPerIP, "", "download bytes per second per anonymous client", func(c *Config) *string { return &c.BandwidthPerIP }, parseString)),
+	live(field("bandwidth_per_key", env.BandwidthPerKey, "", "download bytes per second per api key", func(c *Config) *string { return &c.BandwidthPerKey }, parseString)),
+	live(field("max_concurrent_downloads", env.MaxConcurrentDownloads, "0", "downloads one client may run at once, 0 for unlimited", func(c *Config) *int { return &c.MaxConcurrentDownloads }, parseInt(0, 1<<20))),
+
+	live(field("ban_max_refused", env.BanMaxRefused, "20", "429 answers within ban_window that get a client banned, 0 to never ban for them", func(c *Config) *int { return &c.BanMaxRefused }, parseInt(0, 1<<30))),
+	live(field("ban_max_not_found", env.BanMaxNotFound, "30", "404 answers within ban_window that get a client banned, 0 to never ban for them", func(c *Config) *int { return &c.BanMaxNotFound }, parseInt(0, 1<<30))),
+	live(field("ban_window", env.BanWindow, "10m", "how long offences are counted", func(c *Config) *time.Duration { return &c.BanWindow }, parseDuration)),
+	live(field("ban_duration", env.BanDuration, "15m", "first ban of a client, doubled for every further one", func(c *Config) *time.Duration { return &c.BanDuration }, parseDuration)),
+	live(field("ban_max_duration", env.BanMaxDuration, "24h", "longest automatic ban", func(c *Config) *time.Duration { return &c.BanMaxDuration }, parseDuration)),
+
+	field("blob_backend", env.BlobBackend, "local", `where file contents are kept, "local" or "s3"`, func(c *Config) *string { return &c.BlobBackend }, parseOneOf("local", "s3")),
+	field("blob_path", env.BlobPath, "files", "directory of the local blob store", func(c *Config) *string { return &c.BlobPath }, parseString),
+	field("s3_endpoint", env.S3Endpoint, "", "s3 endpoint, host[:port]", func(c *Config) *string { return &c.S3Endpoint }, parseString),
+	field("s3_bucket", env.S3Bucket, "", "s3 bucket", func(c *Config) *string { return &c.S3Bucket }, parseString),
+	field("s3_region", env.S3Region, "", "s3 region", func(c *Config) *string { return &c.S3Region }, parseString),
+	field("s3_access_key", env.S3AccessKey, "", "s3 access key", func(c *Config) *string { return &c.S3AccessKey }, parseString),
+	secret(field("s3_secret_key", env.S3SecretKey, "", "s3 secret key", func(c *Config) *string { return &c.S3SecretKey }, parseString)),
+	field("s3_use_ssl", env.S3UseSSL, "true", "talk to s3 over https", func(c *Config) *bool { return &c.S3UseSSL }, strconv.ParseBool),
+
+	field("counter_flush_interval", env.CounterFlushInterval, "10s", "how often view and download counts are written", func(c *Config) *time.Duration { return &c.CounterFlushInterval }, parseDuration),
+	field("reaper_interval", env.ReaperInterval, "1m", "how often expired files and posts are deleted", func(c *Config) *time.Duration { return &c.ReaperInterval }, parseDuration),
+	field("upload_ttl", env.UploadTTL, "24h", "how long an unfinished resumable upload is kept after its last chunk", func(c *Config) *time.Duration { return &c.UploadTTL }, parseDuration),
+}
+
+func parseString(v string) (string, error) {
+	return v, nil
+}
+
+// parseList splits a comma separated list, dropping empty items
+func parseList(v string) ([]string, error) {
+	var items []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items, nil
+}
+
+func parseInt(min, max int) func(string) (int, error) {
+	return func(v string) (int, error) {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return 0, errors.New("not a whole number")
+		}
+		if n < min || n > max {
+			return 0, fmt.Errorf("must be between %d and %d", min, max)
+		}
+		return n, nil
+	}
+}
+
+func parsePort(v string) (string, error) {
+	_, err := parseInt(1, 65535)(v)
+	return v, err
+}
+
+func parseRate(v string) (float64, error) {
+	r, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return 0, errors.New("not a number")
+	}
+	if r <= 0 {
+		return 0, errors.New("must be above 0")
+	}
+	return r, nil
+}
+
+func parseDuration(v string) (time.Duration, error) {
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, errors.New(`not a duration, e.g. "90s" or "1h30m"`)
+	}
+	if d <= 0 {
+		return 0, errors.New("must be above 0")
+	}
+	return d, nil
+}
+
+func parseOneOf(values ...string) func(string) (string, error) {
+	return func(v string) (string, error) {
+		if !slices.Contains(values, v) {
+			return "", fmt.Errorf("must be one of %s", strings.Join(values, ", "))
+		}
+		return v, nil
+	}
+}
+
+// parseRedisURL checks the scheme only, the rest is up to the redis client
+func parseRedisURL(v string) (string, error) {
+	if v == "" {
+		return "", nil
+	}
+	u, err := url.Parse(v)
+	if err != nil {
+		return "", errors.New("not a url")
+	}
+	if u.Scheme != "redis" && u.Scheme != "rediss" && u.Scheme != "unix" {
+		return "", errors.New("must be a redis://, rediss:// or unix:// url")
+	}
+	return v, nil
+}
@@ -0,0 +1,189 @@
+package counters
+
+import (
+	"femboyz/db"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// maxPending is how many distinct counters are buffered before a flush is forced
+const maxPending = 1000
+
+// maxFailures is how many flushes a count that can't be written on its own is kept for before it is dropped
+const maxFailures = 5
+
+type key struct {
+	kind   string
+	itemID int64
+	day    string
+}
+
+// Counters buffers view and download counts in memory and writes them to the database in batches,
+// so popular items don't turn every request into a write.
+type Counters struct {
+	store   db.CountStore
+	mu      sync.Mutex
+	pending map[key]int64
+	// failures counts the flushes each pending count failed in while others were written
+	failures map[key]int
+	full     chan struct{}
+	stop     chan struct{}
+	done     chan struct{}
+	now      func() time.Time
+}
+
+// New returns counters writing to store. Nothing is written before Start or a Flush.
+func New(store db.CountStore) *Counters {
+	return &Counters{
+		store:    store,
+		pending:  make(map[key]int64),
+		failures: make(map[key]int),
+		full:     make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+		now:      time.Now,
+	}
+}
+
+// Start flushes the counters every interval until Stop.
+func (c *Counters) Start(interval time.Duration) {
+	loclog := "[counters.Start]"
+	go c.run(interval)
+	slog.Info(loclog, "info", "counters started", "interval", interval)
+}
+
+func (c *Counters) FileView(fileID int64)     { c.Add(db.FileViews, fileID) }
+func (c *Counters) FileDownload(fileID int64) { c.Add(db.FileDownloads, fileID) }
+func (c *Counters) PostView(postID int64)     { c.Add(db.PostViews, postID) }
+
+func (c *Counters) Add(kind string, itemID int64) {
+	if c == nil {
+		return
+	}
+	k := key{kind: kind, itemID: itemID, day: c.now().UTC().Format(time.DateOnly)}
+	c.mu.Lock()
+	c.pending[k]++
+	n := len(c.pending)
+	c.mu.Unlock()
+	if n >= maxPending {
+		select {
+		case c.full <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Reserve counts a download or view of an item with a limit straight in the store, false when the
+// limit was reached. Limits are checked by the database so they hold across requests and instances.
+func (c *Counters) Reserve(kind string, itemID int64) (bool, error) {
+	if c == nil {
+		return true, nil
+	}
+	return c.store.ReserveCount(kind, itemID, c.now().UTC().Format(time.DateOnly))
+}
+
+// Pending returns what is buffered for an item and not written yet, to add to the stored total.
+func (c *Counters) Pending(kind string, itemID int64) int64 {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var n int64
+	for k, v := range c.pending {
+		if k.kind == kind && k.itemID == itemID {
+			n += v
+		}
+	}
+	return n
+}
+
+func (k key) delta(n int64) db.CountDelta {
+	return db.CountDelta{Kind: k.kind, ItemID: k.itemID, Day: k.day, N: n}
+}
+
+// Flush writes the buffered counts. When the batch fails the counts are written one by one, the ones
+// failing while others are written are retried with the next flushes and dropped after maxFailures.
+// When none can be written they are all put back to be retried with the next flush.
+func (c *Counters) Flush() error {
+	loclog := "[counters.Flush]"
+	c.mu.Lock()
+	batch := c.pending
+	c.pending = make(map[key]int64)
+	c.mu.Unlock()
+	if len(batch) == 0 {
+		return nil
+	}
+
+	deltas := make([]db.CountDelta, 0, len(batch))
+	for k, n := range batch {
+		deltas = append(deltas, k.delta(n))
+	}
+	err := c.store.ApplyCounts(deltas)
+	if err == nil {
+		c.mu.Lock()
+		for k := range batch {
+			delete(c.failures, k)
+		}
+		c.mu.Unlock()
+		slog.Debug(loclog, "info", "counters flushed", "counters", len(batch))
+		return nil
+	}
+
+	// one bad count fails the whole batch, find it
+	failed := make(map[key]int64)
+	for k, n := range batch {
+		if c.store.ApplyCounts([]db.CountDelta{k.delta(n)}) != nil {
+			failed[k] = n
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(failed) == len(batch) {
+		slog.Error(loclog, "error", "failed to flush counters, keeping them for the next flush", "counters", len(batch), "error", err.Error())
+		for k, n := range batch {
+			c.pending[k] += n
+		}
+		return err
+	}
+	for k := range batch {
+		n, ok := failed[k]
+		if !ok {
+			delete(c.failures, k)
+			continue
+		}
+		c.failures[k]++
+		if c.failures[k] >= maxFailures {
+			slog.Error(loclog, "error", "dropping count that keeps failing", "kind", k.kind, "item_id", k.itemID, "day", k.day, "count", n)
+			delete(c.failures, k)
+			continue
+		}
+		c.pending[k] += n
+	}
+	slog.Warn(loclog, "warning", "some counters failed to flush, keeping them for the next flush", "counters", len(batch), "failed", len(failed), "error", err.Error())
+	return err
+}
+
+func (c *Counters) run(interval time.Duration) {
+	defer close(c.done)
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+		case <-c.full:
+		case <-c.stop:
+			c.Flush()
+			return
+		}
+		c.Flush()
+	}
+}
+
+// Stop flushes whatever is still buffered and stops the flushing goroutine.
+func (c *Counters) Stop() {
+	close(c.stop)
+	<-c.done
+}
@@ -0,0 +1,93 @@
+package counters
+
+import (
+	"femboyz/db"
+	"testing"
+	"time"
+)
+
+func TestFlush(t *testing.T) {
+	store := db.NewMemory()
+
+	f := &db.File{
+		PubID:  "test_pub_id",
+		Meta:   db.FileMeta{OriginalName: "test.txt"},
+		Issuer: "tester",
+	}
+	err := store.InsertFile(f)
+	if err != nil {
+		t.Fatalf("Failed to insert file: %v", err)
+	}
+
+	c := New(store)
+	day := time.Date(2026, 1, 2, 23, 59, 0, 0, time.UTC)
+	c.now = func() time.Time { return day }
+	c.Add(db.FileViews, f.ID)
+	c.Add(db.FileViews, f.ID)
+	c.Add(db.FileDownloads, f.ID)
+	// a view after midnight lands in the next day's history
+	day = day.Add(2 * time.Minute)
+	c.Add(db.FileViews, f.ID)
+
+	if n := c.Pending(db.FileViews, f.ID); n != 3 {
+		t.Errorf("Expected 3 pending views, got %d", n)
+	}
+
+	err = c.Flush()
+	if err != nil {
+		t.Fatalf("Failed to flush: %v", err)
+	}
+	if n := c.Pending(db.FileViews, f.ID); n != 0 {
+		t.Errorf("Expected no pending views after flush, got %d", n)
+	}
+
+	retrieved, err := store.GetFileByPubID(f.PubID)
+	if err != nil {
+		t.Fatalf("Failed to get file: %v", err)
+	}
+	if retrieved.RefView != 3 {
+		t.Errorf("Expected 3 views, got %d", retrieved.RefView)
+	}
+	if retrieved.RefDL != 1 {
+		t.Errorf("Expected 1 download, got %d", retrieved.RefDL)
+	}
+
+	history, err := store.GetDailyCounts(db.FileViews, f.ID, "2026-01-01")
+	if err != nil {
+		t.Fatalf("Failed to get history: %v", err)
+	}
+	if len(history) != 2 || history[0] != (db.DailyCount{Day: "2026-01-02", Count: 2}) || history[1] != (db.DailyCount{Day: "2026-01-03", Count: 1}) {
+		t.Errorf("Unexpected view history %+v", history)
+	}
+}
+
+func TestFlushBadCount(t *testing.T) {
+	store := db.NewMemory()
+	f := &db.File{PubID: "test_pub_id", Meta: db.FileMeta{OriginalName: "test.txt"}, Issuer: "tester"}
+	if err := store.InsertFile(f); err != nil {
+		t.Fatalf("Failed to insert file: %v", err)
+	}
+
+	c := New(store)
+	c.Add("bogus", f.ID)
+	for i := 0; i < maxFailures; i++ {
+		c.Add(db.FileViews, f.ID)
+		if err := c.Flush(); err == nil {
+			t.Fatalf("Expected flush %d to report the bad count", i+1)
+		}
+	}
+	// the bad count no longer blocks the others, and is dropped in the end
+	retrieved, err := store.GetFileByPubID(f.PubID)
+	if err != nil {
+		t.Fatalf("Failed to get file: %v", err)
+	}
+	if retrieved.RefView != maxFailures {
+		t.Errorf("Expected %d views, got %d", maxFailures, retrieved.RefView)
+	}
+	if n := c.Pending("bogus", f.ID); n != 0 {
+		t.Errorf("Expected the bad count to be dropped, got %d pending", n)
+	}
+	if err := c.Flush(); err != nil {
+		t.Errorf("Expected nothing left to fail, got %v", err)
+	}
+}
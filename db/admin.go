@@ -0,0 +1,174 @@
+package db
+
+import (
+	"log/slog"
+	"strings"
+)
+
+// likePattern matches q anywhere, with LIKE wildcards in q taken literally
+func likePattern(q string) string {
+	r := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+	return "%" + r.Replace(q) + "%"
+}
+
+// ListFiles returns a page of files, newest first, whose name, issuer or hash contain q (all files if q is empty),
+// and the total number of matching files.
+func (s *SQLStore) ListFiles(q string, limit, offset int) ([]*File, int64, error) {
+	loclog := "[db.ListFiles]"
+	where := ""
+	var args []any
+	if q != "" {
+		like := " " + s.d.like + ` ? ESCAPE '\'`
+		where = " WHERE " + s.d.jsonField("meta", "original_name") + like +
+			" OR issuer" + like +
+			" OR " + s.d.jsonField("meta", "hash") + like +
+			" OR pub_id = ?"
+		p := likePattern(q)
+		args = []any{p, p, p, q}
+	}
+
+	var total int64
+	err := s.db.QueryRow("SELECT COUNT(*) FROM files"+where, args...).Scan(&total)
+	if err != nil {
+		slog.Error(loclog, "SEVERE", "failed to count files", "error", err.Error(), "q", q)
+		return nil, 0, err
+	}
+
+	rows, err := s.db.Query("SELECT "+fileColumns+" FROM files"+where+" ORDER BY id DESC LIMIT ? OFFSET ?", append(args, limit, offset)...)
+	if err != nil {
+		slog.Error(loclog, "SEVERE", "failed to query files", "error", err.Error(), "q", q)
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	files := []*File{}
+	for rows.Next() {
+		f, err := scanFile(rows)
+		if err != nil {
+			slog.Error(loclog, "SEVERE", "failed to scan file", "error", err.Error())
+			return nil, 0, err
+		}
+		files = append(files, f)
+	}
+	return files, total, rows.Err()
+}
+
+// ListPosts returns a page of posts, newest first, whose title or issuer contain q (all posts if q is empty),
+// and the total number of matching posts.
+func (s *SQLStore) ListPosts(q string, limit, offset int) ([]*Post, int64, error) {
+	loclog := "[db.ListPosts]"
+	where := ""
+	var args []any
+	if q != "" {
+		like := " " + s.d.like + ` ? ESCAPE '\'`
+		where = " WHERE " + s.d.jsonField("content", "title") + like +
+			" OR issuer" + like +
+			" OR pub_id = ?"
+		p := likePattern(q)
+		args = []any{p, p, q}
+	}
+
+	var total int64
+	err := s.db.QueryRow("SELECT COUNT(*) FROM posts"+where, args...).Scan(&total)
+	if err != nil {
+		slog.Error(loclog, "SEVERE", "failed to count posts", "error", err.Error(), "q", q)
+		return nil, 0, err
+	}
+
+	rows, err := s.db.Query("SELECT "+postColumns+" FROM posts"+where+" ORDER BY id DESC LIMIT ? OFFSET ?", append(args, limit, offset)...)
+	if err != nil {
+		slog.Error(loclog, "SEVERE", "failed to query posts", "error", err.Error(), "q", q)
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	posts := []*Post{}
+	for rows.Next() {
+		p, err := scanPost(rows)
+		if err != nil {
+			slog.Error(loclog, "SEVERE", "failed to scan post", "error", err.Error())
+			return nil, 0, err
+		}
+		posts = append(posts, p)
+	}
+	return posts, total, rows.Err()
+}
+
+// updateByPubID runs "UPDATE table SET set WHERE pub_id = ?" and reports whether a row matched.
+// table and set are never user input.
+func (s *SQLStore) updateByPubID(loclog, table, set, pubID string, args ...any) (bool, error) {
+	result, err := s.db.Exec("UPDATE "+table+" SET "+set+" WHERE pub_id = ?", append(args, pubID)...)
+	if err != nil {
+		slog.Error(loclog, "SEVERE", "failed to update "+table, "error", err.Error(), "pub_id", pubID)
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		slog.Error(loclog, "SEVERE", "failed to get rows affected", "error", err.Error(), "pub_id", pubID)
+		return false, err
+	}
+	slog.Info(loclog, "info", table+" updated", "pub_id", pubID, "updated", n > 0)
+	return n > 0, nil
+}
+
+// SetFileExpiry sets when the file expires, unix seconds or 0 for never.
+func (s *SQLStore) SetFileExpiry(pubID string, expiresAt int64) (bool, error) {
+	return s.updateByPubID("[db.SetFileExpiry]", "files", "expires_at = ?", pubID, nullZero(expiresAt))
+}
+
+// SetPostExpiry sets when the post expires, unix seconds or 0 for never.
+func (s *SQLStore) SetPostExpiry(pubID string, expiresAt int64) (bool, error) {
+	return s.updateByPubID("[db.SetPostExpiry]", "posts", "expires_at = ?", pubID, nullZero(expiresAt))
+}
+
+func (s *SQLStore) SetFileDisabled(pubID string, disabled bool) (bool, error) {
+	return s.updateByPubID("[db.SetFileDisabled]", "files", "disabled = ?", pubID, boolInt(disabled))
+}
+
+func (s *SQLStore) SetPostDisabled(pubID string, disabled bool) (bool, error) {
+	return s.updateByPubID("[db.SetPostDisabled]", "posts", "disabled = ?", pubID, boolInt(disabled))
+}
+
+// RotateFilePubID moves the file to a new pub id, the old links stop working.
+func (s *SQLStore) RotateFilePubID(pubID, newPubID string) (bool, error) {
+	return s.updateByPubID("[db.RotateFilePubID]", "files", "pub_id = ?", pubID, newPubID)
+}
+
+// RotatePostPubID moves the post to a new pub id, the old links stop working.
+func (s *SQLStore) RotatePostPubID(pubID, newPubID string) (bool, error) {
+	return s.updateByPubID("[db.RotatePostPubID]", "posts", "pub_id = ?", pubID, newPubID)
+}
+
+// DeletePostByPubID removes the post and its history.
+// Returns false if no post had that pub id.
+func (s *SQLStore) DeletePostByPubID(pubID string) (bool, error) {
+	loclog := "[db.DeletePostByPubID]"
+	tx, err := s.db.Begin()
+	if err != nil {
+		slog.Error(loclog, "SEVERE", "failed to begin transaction", "error", err.Error(), "pub_id", pubID)
+		return false, err
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec("DELETE FROM daily_counts WHERE kind = ? AND item_id = (SELECT id FROM posts WHERE pub_id = ?)", PostViews, pubID)
+	if err != nil {
+		slog.Error(loclog, "SEVERE", "failed to delete post history", "error", err.Error(), "pub_id", pubID)
+		return false, err
+	}
+	result, err := tx.Exec("DELETE FROM posts WHERE pub_id = ?", pubID)
+	if err != nil {
+		slog.Error(loclog, "SEVERE", "failed to delete post", "error", err.Error(), "pub_id", pubID)
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		slog.Error(loclog, "SEVERE", "failed to get rows affected", "error", err.Error(), "pub_id", pubID)
+		return false, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		slog.Error(loclog, "SEVERE", "failed to commit transaction", "error", err.Error(), "pub_id", pubID)
+		return false, err
+	}
+	slog.Info(loclog, "info", "post deleted from posts table", "pub_id", pubID, "deleted", n > 0)
+	return n > 0, nil
+}
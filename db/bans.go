@@ -0,0 +1,121 @@
+package db
+
+import (
+	"database/sql"
+	"log/slog"
+)
+
+// Ban keeps a client address out, or with Allow set lets it past every limit
+type Ban struct {
+	Subject string
+	Allow   bool
+	Reason  string
+	// Strikes is how many times the subject was banned automatically, each ban lasts twice the last
+	Strikes int64
+	// ExpiresAt is unix seconds, 0 for never
+	ExpiresAt    int64
+	CreationDate string
+}
+
+// Active reports whether the ban or allow entry still applies at now (unix seconds)
+func (b *Ban) Active(now int64) bool {
+	return b.ExpiresAt == 0 || now < b.ExpiresAt
+}
+
+// PutBan stores b, replacing the entry for the same subject
+func (s *SQLStore) PutBan(b *Ban) error {
+	loclog := "[db.PutBan]"
+	_, err := s.db.Exec(`INSERT INTO bans (subject, allow, reason, strikes, expires_at) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT(subject) DO UPDATE SET allow = excluded.allow, reason = excluded.reason,
+			strikes = excluded.strikes, expires_at = excluded.expires_at`,
+		b.Subject, boolInt(b.Allow), b.Reason, b.Strikes, nullZero(b.ExpiresAt))
+	if err != nil {
+		slog.Error(loclog, "SEVERE", "failed to put ban", "error", err.Error(), "subject", b.Subject)
+		return err
+	}
+	slog.Info(loclog, "info", "ban stored", "subject", b.Subject, "allow", b.Allow, "strikes", b.Strikes, "expires_at", b.ExpiresAt)
+	return nil
+}
+
+const banColumns = "subject, allow, reason, strikes, expires_at, creation_date"
+
+func scanBan(row scanner) (*Ban, error) {
+	var b Ban
+	var expiresAt sql.NullInt64
+	err := row.Scan(&b.Subject, &b.Allow, &b.Reason, &b.Strikes, &expiresAt, &b.CreationDate)
+	if err != nil {
+		return nil, err
+	}
+	b.ExpiresAt = expiresAt.Int64
+	return &b, nil
+}
+
+func (s *SQLStore) GetBan(subject string) (*Ban, error) {
+	loclog := "[db.GetBan]"
+	b, err := scanBan(s.db.QueryRow("SELECT "+banColumns+" FROM bans WHERE subject = ?", subject))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		slog.Error(loclog, "SEVERE", "failed to scan ban", "error", err.Error(), "subject", subject)
+		return nil, err
+	}
+	return b, nil
+}
+
+// ListBans returns every ban and allow entry, expired ones included, by subject
+func (s *SQLStore) ListBans() ([]*Ban, error) {
+	return s.listBans("[db.ListBans]", "")
+}
+
+// ListActiveBans returns the entries still applying at now (unix seconds), by subject
+func (s *SQLStore) ListActiveBans(now int64) ([]*Ban, error) {
+	return s.listBans("[db.ListActiveBans]", "WHERE expires_at IS NULL OR expires_at > ?", now)
+}
+
+func (s *SQLStore) listBans(loclog, where string, args ...any) ([]*Ban, error) {
+	rows, err := s.db.Query("SELECT "+banColumns+" FROM bans "+where+" ORDER BY subject", args...)
+	if err != nil {
+		slog.Error(loclog, "SEVERE", "failed to query bans", "error", err.Error())
+		return nil, err
+	}
+	defer rows.Close()
+
+	bans := []*Ban{}
+	for rows.Next() {
+		b, err := scanBan(rows)
+		if err != nil {
+			slog.Error(loclog, "SEVERE", "failed to scan ban", "error", err.Error())
+			return nil, err
+		}
+		bans = append(bans, b)
+	}
+	return bans, rows.Err()
+}
+
+func (s *SQLStore) DeleteBan(subject string) (bool, error) {
+	loclog := "[db.DeleteBan]"
+	result, err := s.db.Exec("DELETE FROM bans WHERE subject = ?", subject)
+	if err != nil {
+		slog.Error(loclog, "SEVERE", "failed to delete ban", "error", err.Error(), "subject", subject)
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		slog.Error(loclog, "SEVERE", "failed to get rows affected", "error", err.Error(), "subject", subject)
+		return false, err
+	}
+	slog.Info(loclog, "info", "ban deleted", "subject", subject, "deleted", n > 0)
+	return n > 0, nil
+}
+
+// DeleteBansExpiredBefore forgets the entries that expired before before (unix seconds) and returns how many
+func (s *SQLStore) DeleteBansExpiredBefore(before int64) (int64, error) {
+	loclog := "[db.DeleteBansExpiredBefore]"
+	result, err := s.db.Exec("DELETE FROM bans WHERE expires_at IS NOT NULL AND expires_at < ?", before)
+	if err != nil {
+		slog.Error(loclog, "SEVERE", "failed to delete expired bans", "error", err.Error())
+		return 0, err
+	}
+	return result.RowsAffected()
+}
@@ -3,66 +3,93 @@ package db
 import (
 	"database/sql"
 	"encoding/json"
-	"femboyz/env"
+	"errors"
 	"log/slog"
 	"os"
-
-	_ "github.com/mattn/go-sqlite3"
+	"strconv"
+	"strings"
+	"time"
 )
 
-const (
-	// files table (id, pub_id (unique), meta (json), creation_date (timestamp), issuer, ref_view (integer), ref_dl (integer))
-	filesStmt = `CREATE TABLE IF NOT EXISTS files (
-				id 				INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT, 
-				pub_id 			TEXT NOT NULL UNIQUE, 
-				meta 			TEXT NOT NULL, 
-				creation_date 	TEXT DEFAULT (strftime('%s', 'now')),
-				issuer 			TEXT NOT NULL, 
-				ref_view 		INTEGER DEFAULT 0, 
-				ref_dl 			INTEGER DEFAULT 0
-				);`
-	// posts table (id, pub_id (unique), content (json), creation_date (timestamp), issuer, ref_view (integer))
-	postsStmt = `CREATE TABLE IF NOT EXISTS posts (
-				id 				INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT, 
-				pub_id 			TEXT NOT NULL UNIQUE, 
-				content 		TEXT NOT NULL, 
-				creation_date 	TEXT DEFAULT (strftime('%s', 'now')), 
-				issuer 			TEXT NOT NULL, 
-				ref_view 		INTEGER DEFAULT 0
-				);`
-)
+// SQLStore is the Store kept in a sql database, sqlite or postgres
+type SQLStore struct {
+	db *conn
+	d  *dialect
+}
 
-var db *sql.DB
+func openSQL(d *dialect, dsn string) (*SQLStore, error) {
+	_db, err := sql.Open(d.driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	return &SQLStore{db: &conn{DB: _db, d: d}, d: d}, nil
+}
 
-func openDB() *sql.DB {
+// sqliteBusyTimeout is how many milliseconds a write waits for another connection to finish
+// its own, instead of failing with SQLITE_BUSY
+const sqliteBusyTimeout = 5000
+
+// sqliteParam adds a driver parameter to a sqlite path, which may be a file: uri
+// or already carry parameters of its own
+func sqliteParam(path, param string) string {
+	if strings.Contains(path, "?") {
+		return path + "&" + param
+	}
+	return path + "?" + param
+}
+
+// OpenSQLite opens the sqlite database at path, Migrate has to run before it is used.
+func OpenSQLite(path string) (*SQLStore, error) {
+	return openSQL(sqliteDialect, sqliteDSN(path))
+}
+
+// OpenPostgres connects to the postgres database at dsn, Migrate has to run before it is used.
+func OpenPostgres(dsn string) (*SQLStore, error) {
+	return openSQL(postgresDialect, dsn)
+}
+
+func (s *SQLStore) Close() error {
+	return s.db.Close()
+}
+
+// openDB opens postgres when dsn is set and the sqlite file at path otherwise
+func openDB(dsn, path string) *SQLStore {
 	loclog := "[db.openDB]"
-	path := env.DBPath.Get()
-	slog.Info(loclog, "pathdatabase", path)
-	_db, err := sql.Open("sqlite3", path)
+	var s *SQLStore
+	var err error
+	if dsn != "" {
+		slog.Info(loclog, "info", "using postgres")
+		s, err = OpenPostgres(dsn)
+	} else {
+		slog.Info(loclog, "pathdatabase", path)
+		s, err = OpenSQLite(path)
+	}
 	if err != nil {
 		slog.Error(loclog, "FATAL", "failed to open database", "error", err.Error())
 		os.Exit(1)
 	}
-	return _db
+	return s
 }
 
-func InitDB() {
+// InitDB opens the database (see openDB) and brings its schema up to date, exiting when that fails.
+func InitDB(dsn, path string) *SQLStore {
 	loclog := "[db.InitDB]"
-	db = openDB()
+	s := openDB(dsn, path)
 
-	_, err := db.Exec(filesStmt)
-	if err != nil {
-		slog.Error(loclog, "FATAL", "failed to create table 'files'", "error", err.Error())
-		os.Exit(1)
-	}
-	slog.Info(loclog, "info", "table 'files' executed")
-	_, err = db.Exec(postsStmt)
+	applied, err := s.Migrate(false)
 	if err != nil {
-		slog.Error(loclog, "FATAL", "failed to create table 'posts'", "error", err.Error())
+		slog.Error(loclog, "FATAL", "failed to migrate database", "error", err.Error())
 		os.Exit(1)
 	}
-	slog.Info(loclog, "info", "table 'posts' executed")
-	slog.Info(loclog, "info", "database initialized")
+	slog.Info(loclog, "info", "database initialized", "version", LatestVersion(), "applied", len(applied))
+	return s
+}
+
+// DryRunMigrations opens the database and returns the migrations InitDB would apply, without applying them.
+func DryRunMigrations(dsn, path string) ([]string, error) {
+	s := openDB(dsn, path)
+	defer s.Close()
+	return s.Migrate(true)
 }
 
 type FileMeta struct {
@@ -81,46 +108,106 @@ type File struct {
 	Issuer       string
 	RefView      int
 	RefDL        int
+	// ExpiresAt is unix seconds, 0 for never
+	ExpiresAt int64
+	// MaxDL is the number of downloads after which the file is gone, 0 for unlimited
+	MaxDL int64
+	// Disabled files are kept but not served
+	Disabled bool
+}
+
+// CreatedAt parses CreationDate, which sqlite stores as unix seconds.
+// The zero time is returned if the value can't be parsed.
+func (f *File) CreatedAt() time.Time {
+	return parseUnix(f.CreationDate)
+}
+
+// Post formats
+const (
+	PostPlain    = "plain"
+	PostMarkdown = "markdown"
+	PostCode     = "code"
+)
+
+// PostContent is stored as json in the content column
+type PostContent struct {
+	Title  string `json:"title"`
+	Body   string `json:"body"`
+	Format string `json:"format"`
+	// Language is the syntax highlighting language for code posts
+	Language string `json:"language,omitempty"`
 }
 
 type Post struct {
 	ID           int64
 	PubID        string
-	Content      string
+	Content      PostContent
 	CreationDate string
 	Issuer       string
 	RefView      int
+	// ExpiresAt is unix seconds, 0 for never
+	ExpiresAt int64
+	// MaxViews is the number of views after which the post is gone, 0 for unlimited
+	MaxViews int64
+	// Disabled posts are kept but not served
+	Disabled bool
+}
+
+// CreatedAt parses CreationDate, see File.CreatedAt.
+func (p *Post) CreatedAt() time.Time {
+	return parseUnix(p.CreationDate)
+}
+
+func parseUnix(s string) time.Time {
+	sec, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+	return time.Unix(sec, 0)
 }
 
-func InsertFile(f *File) error {
+const insertFileStmt = "INSERT INTO files (pub_id, meta, issuer, expires_at, max_dl) VALUES (?, ?, ?, ?, ?) RETURNING id"
+
+func (s *SQLStore) InsertFile(f *File) error {
 	loclog := "[db.InsertFile]"
 	jsonMeta, err := json.Marshal(f.Meta)
 	if err != nil {
 		slog.Error(loclog, "SEVERE", "failed to marshal file meta", "error", err.Error(), "pub_id", f.PubID, "meta", f.Meta, "issuer", f.Issuer)
 		return err
 	}
-	result, err := db.Exec("INSERT INTO files (pub_id, meta, issuer) VALUES (?, ?, ?)", f.PubID, jsonMeta, f.Issuer)
+	err = s.db.QueryRow(insertFileStmt,
+		f.PubID, string(jsonMeta), f.Issuer, nullZero(f.ExpiresAt), nullZero(f.MaxDL)).Scan(&f.ID)
 	if err != nil {
 		slog.Error(loclog, "SEVERE", "failed to insert file in files table", "error", err.Error(), "pub_id", f.PubID, "meta", f.Meta, "issuer", f.Issuer)
 		return err
 	}
-	id, err := result.LastInsertId()
-	if err != nil {
-		slog.Error(loclog, "SEVERE", "failed to get last insert id", "error", err.Error(), "pub_id", f.PubID, "meta", f.Meta, "issuer", f.Issuer)
-		return err
-	}
-	f.ID = id
 	slog.Info(loclog, "info", "file inserted in files table", "pubID", f.PubID)
 	return nil
 }
 
-func GetFileByPubID(pubID string) (*File, error) {
-	loclog := "[db.GetFileByPubID]"
-	row := db.QueryRow("SELECT id, pub_id, meta, creation_date, issuer, ref_view, ref_dl FROM files WHERE pub_id = ?", pubID)
+const fileColumns = "id, pub_id, meta, creation_date, issuer, ref_view, ref_dl, expires_at, max_dl, disabled"
+
+type scanner interface {
+	Scan(dest ...any) error
+}
 
+func scanFile(row scanner) (*File, error) {
 	var f File
 	var jsonMeta []byte
-	err := row.Scan(&f.ID, &f.PubID, &jsonMeta, &f.CreationDate, &f.Issuer, &f.RefView, &f.RefDL)
+	var expiresAt, maxDL sql.NullInt64
+	err := row.Scan(&f.ID, &f.PubID, &jsonMeta, &f.CreationDate, &f.Issuer, &f.RefView, &f.RefDL, &expiresAt, &maxDL, &f.Disabled)
+	if err != nil {
+		return nil, err
+	}
+	f.ExpiresAt = expiresAt.Int64
+	f.MaxDL = maxDL.Int64
+	json.Unmarshal(jsonMeta, &f.Meta)
+	return &f, nil
+}
+
+func (s *SQLStore) GetFileByPubID(pubID string) (*File, error) {
+	loclog := "[db.GetFileByPubID]"
+	f, err := scanFile(s.db.QueryRow("SELECT "+fileColumns+" FROM files WHERE pub_id = ?", pubID))
 	if err != nil {
 		if err == sql.ErrNoRows {
 			slog.Debug(loclog, "info", "file not found", "pub_id", pubID)
@@ -129,17 +216,54 @@ func GetFileByPubID(pubID string) (*File, error) {
 		slog.Error(loclog, "SEVERE", "failed to scan file", "error", err.Error(), "pub_id", pubID)
 		return nil, err
 	}
-	json.Unmarshal(jsonMeta, &f.Meta)
-	return &f, nil
+	return f, nil
 }
 
-func GetFileByID(id int64) (*File, error) {
-	loclog := "[db.GetFileByID]"
-	row := db.QueryRow("SELECT id, pub_id, meta, creation_date, issuer, ref_view, ref_dl FROM files WHERE id = ?", id)
+// DeleteFileByPubID removes the files row and, in the same transaction, releases the blob with the
+// given hash as ReleaseBlob does, calling remove once it is unreferenced. The blob is released only
+// when the row was there, and nothing is deleted when the release fails. An empty hash leaves the blob alone.
+// Returns false if no file had that pub id.
+func (s *SQLStore) DeleteFileByPubID(pubID, hash string, remove func() error) (bool, error) {
+	loclog := "[db.DeleteFileByPubID]"
+	tx, err := s.db.Begin()
+	if err != nil {
+		slog.Error(loclog, "SEVERE", "failed to begin transaction", "error", err.Error(), "pub_id", pubID)
+		return false, err
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec("DELETE FROM daily_counts WHERE kind IN (?, ?) AND item_id = (SELECT id FROM files WHERE pub_id = ?)", FileViews, FileDownloads, pubID)
+	if err != nil {
+		slog.Error(loclog, "SEVERE", "failed to delete file history", "error", err.Error(), "pub_id", pubID)
+		return false, err
+	}
+	result, err := tx.Exec("DELETE FROM files WHERE pub_id = ?", pubID)
+	if err != nil {
+		slog.Error(loclog, "SEVERE", "failed to delete file", "error", err.Error(), "pub_id", pubID)
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		slog.Error(loclog, "SEVERE", "failed to get rows affected", "error", err.Error(), "pub_id", pubID)
+		return false, err
+	}
+	if n > 0 && hash != "" {
+		_, err = releaseBlob(loclog, tx, hash, remove)
+		if err != nil {
+			return false, err
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		slog.Error(loclog, "SEVERE", "failed to commit transaction", "error", err.Error(), "pub_id", pubID)
+		return false, err
+	}
+	slog.Info(loclog, "info", "file deleted from files table", "pub_id", pubID, "deleted", n > 0)
+	return n > 0, nil
+}
 
-	var f File
-	var jsonMeta []byte
-	err := row.Scan(&f.ID, &f.PubID, &jsonMeta, &f.CreationDate, &f.Issuer, &f.RefView, &f.RefDL)
+func (s *SQLStore) GetFileByID(id int64) (*File, error) {
+	loclog := "[db.GetFileByID]"
+	f, err := scanFile(s.db.QueryRow("SELECT "+fileColumns+" FROM files WHERE id = ?", id))
 	if err != nil {
 		if err == sql.ErrNoRows {
 			slog.Debug(loclog, "info", "file not found", "id", id)
@@ -148,29 +272,49 @@ func GetFileByID(id int64) (*File, error) {
 		slog.Error(loclog, "SEVERE", "failed to scan file", "error", err.Error(), "id", id)
 		return nil, err
 	}
-	json.Unmarshal(jsonMeta, &f.Meta)
-	return &f, nil
+	return f, nil
 }
 
-func InsertPost(p *Post) error {
+func (s *SQLStore) InsertPost(p *Post) error {
 	loclog := "[db.InsertPost]"
-	_, err := db.Exec("INSERT INTO posts (pub_id, content, issuer) VALUES (?, ?, ?)", p.PubID, p.Content, p.Issuer)
+	jsonContent, err := json.Marshal(p.Content)
 	if err != nil {
-		slog.Error(loclog, "SEVERE", "failed to insert post in posts table", "error", err.Error(), "pub_id", p.PubID, "content", p.Content, "issuer", p.Issuer)
+		slog.Error(loclog, "SEVERE", "failed to marshal post content", "error", err.Error(), "pub_id", p.PubID, "issuer", p.Issuer)
+		return err
+	}
+	err = s.db.QueryRow("INSERT INTO posts (pub_id, content, issuer, expires_at, max_view) VALUES (?, ?, ?, ?, ?) RETURNING id",
+		p.PubID, string(jsonContent), p.Issuer, nullZero(p.ExpiresAt), nullZero(p.MaxViews)).Scan(&p.ID)
+	if err != nil {
+		slog.Error(loclog, "SEVERE", "failed to insert post in posts table", "error", err.Error(), "pub_id", p.PubID, "title", p.Content.Title, "issuer", p.Issuer)
 		return err
 	}
 
-	slog.Info(loclog, "info", "post inserted in posts table", "pubID", p.PubID, "content", p.Content, "issuer", p.Issuer)
+	slog.Info(loclog, "info", "post inserted in posts table", "pubID", p.PubID, "title", p.Content.Title, "format", p.Content.Format, "issuer", p.Issuer)
 	return nil
 }
 
-func GetPostByPubID(pubID string) (*Post, error) {
-	loclog := "[db.GetPostByPubID]"
-	row := db.QueryRow("SELECT id, pub_id, content, creation_date, issuer, ref_view FROM posts WHERE pub_id = ?", pubID)
+const postColumns = "id, pub_id, content, creation_date, issuer, ref_view, expires_at, max_view, disabled"
 
+func scanPost(row scanner) (*Post, error) {
 	var p Post
 	var jsonContent []byte
-	err := row.Scan(&p.ID, &p.PubID, &jsonContent, &p.CreationDate, &p.Issuer, &p.RefView)
+	var expiresAt, maxViews sql.NullInt64
+	err := row.Scan(&p.ID, &p.PubID, &jsonContent, &p.CreationDate, &p.Issuer, &p.RefView, &expiresAt, &maxViews, &p.Disabled)
+	if err != nil {
+		return nil, err
+	}
+	p.ExpiresAt = expiresAt.Int64
+	p.MaxViews = maxViews.Int64
+	err = json.Unmarshal(jsonContent, &p.Content)
+	if err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+func (s *SQLStore) GetPostByPubID(pubID string) (*Post, error) {
+	loclog := "[db.GetPostByPubID]"
+	p, err := scanPost(s.db.QueryRow("SELECT "+postColumns+" FROM posts WHERE pub_id = ?", pubID))
 	if err != nil {
 		if err == sql.ErrNoRows {
 			slog.Debug(loclog, "info", "post not found", "pub_id", pubID)
@@ -179,14 +323,18 @@ func GetPostByPubID(pubID string) (*Post, error) {
 		slog.Error(loclog, "SEVERE", "failed to scan post", "error", err.Error(), "pub_id", pubID)
 		return nil, err
 	}
-	json.Unmarshal(jsonContent, &p.Content)
-	slog.Info(loclog, "info", "post found", "pub_id", pubID, "returning", p)
-	return &p, nil
+	slog.Debug(loclog, "info", "post found", "pub_id", pubID)
+	return p, nil
+}
+
+// nullZero stores 0 as NULL for optional integer columns
+func nullZero(v int64) sql.NullInt64 {
+	return sql.NullInt64{Int64: v, Valid: v != 0}
 }
 
-func GetFileEntries() (int64, error) {
+func (s *SQLStore) GetFileEntries() (int64, error) {
 	loclog := "[db.GetFileEntries]"
-	row := db.QueryRow("SELECT COUNT(*) FROM files")
+	row := s.db.QueryRow("SELECT COUNT(*) FROM files")
 	var count int64
 	err := row.Scan(&count)
 	if err != nil {
@@ -196,9 +344,9 @@ func GetFileEntries() (int64, error) {
 	return count, nil
 }
 
-func GetPostEntries() (int64, error) {
+func (s *SQLStore) GetPostEntries() (int64, error) {
 	loclog := "[db.GetPostEntries]"
-	row := db.QueryRow("SELECT COUNT(*) FROM posts")
+	row := s.db.QueryRow("SELECT COUNT(*) FROM posts")
 	var count int64
 	err := row.Scan(&count)
 	if err != nil {
@@ -207,3 +355,358 @@ func GetPostEntries() (int64, error) {
 	}
 	return count, nil
 }
+
+// AcquireBlob adds a reference to the blob with the given hash, creating its row if needed.
+// Returns the reference count after the increment, 1 means the blob is new.
+func (s *SQLStore) AcquireBlob(hash string, size int64) (int64, error) {
+	loclog := "[db.AcquireBlob]"
+	row := s.db.QueryRow(`INSERT INTO blobs (hash, size, refs) VALUES (?, ?, 1)
+		ON CONFLICT(hash) DO UPDATE SET refs = blobs.refs + 1
+		RETURNING refs`, hash, size)
+	var refs int64
+	err := row.Scan(&refs)
+	if err != nil {
+		slog.Error(loclog, "SEVERE", "failed to acquire blob", "error", err.Error(), "hash", hash)
+		return 0, err
+	}
+	slog.Debug(loclog, "info", "blob acquired", "hash", hash, "refs", refs)
+	return refs, nil
+}
+
+// ReleaseBlob drops a reference to the blob with the given hash and removes its row once unreferenced.
+// Returns the reference count left. When it drops to 0 remove is called while the row is still
+// locked, so a concurrent AcquireBlob waits for the content to be gone and then makes the blob anew.
+// The release is rolled back when remove fails, the blob stays referenced rather than losing content.
+// Releasing an untracked hash returns 0 after calling remove.
+func (s *SQLStore) ReleaseBlob(hash string, remove func() error) (int64, error) {
+	loclog := "[db.ReleaseBlob]"
+	tx, err := s.db.Begin()
+	if err != nil {
+		slog.Error(loclog, "SEVERE", "failed to begin transaction", "error", err.Error(), "hash", hash)
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	refs, err := releaseBlob(loclog, tx, hash, remove)
+	if err != nil {
+		return 0, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		slog.Error(loclog, "SEVERE", "failed to commit transaction", "error", err.Error(), "hash", hash)
+		return 0, err
+	}
+	slog.Debug(loclog, "info", "blob released", "hash", hash, "refs", refs)
+	return refs, nil
+}
+
+// releaseBlob is ReleaseBlob within tx, which the caller commits
+func releaseBlob(loclog string, tx *txn, hash string, remove func() error) (int64, error) {
+	var refs int64
+	err := tx.QueryRow("UPDATE blobs SET refs = refs - 1 WHERE hash = ? RETURNING refs", hash).Scan(&refs)
+	if err == sql.ErrNoRows {
+		slog.Warn(loclog, "warning", "released blob not tracked", "hash", hash)
+		return 0, remove()
+	}
+	if err != nil {
+		slog.Error(loclog, "SEVERE", "failed to release blob", "error", err.Error(), "hash", hash)
+		return 0, err
+	}
+	if refs <= 0 {
+		refs = 0
+		_, err = tx.Exec("DELETE FROM blobs WHERE hash = ?", hash)
+		if err != nil {
+			slog.Error(loclog, "SEVERE", "failed to delete blob row", "error", err.Error(), "hash", hash)
+			return 0, err
+		}
+		err = remove()
+		if err != nil {
+			return 0, err
+		}
+	}
+	return refs, nil
+}
+
+// Counter kinds, each maps to a counter column and is kept per day in daily_counts
+const (
+	FileViews     = "file_view"
+	FileDownloads = "file_dl"
+	PostViews     = "post_view"
+)
+
+// counterUpdates are the statements adding to the running total of each kind
+var counterUpdates = map[string]string{
+	FileViews:     "UPDATE files SET ref_view = ref_view + ? WHERE id = ?",
+	FileDownloads: "UPDATE files SET ref_dl = ref_dl + ? WHERE id = ?",
+	PostViews:     "UPDATE posts SET ref_view = ref_view + ? WHERE id = ?",
+}
+
+// counterReservations are the statements adding one to the counters that can be limited, up to the limit
+var counterReservations = map[string]string{
+	FileDownloads: "UPDATE files SET ref_dl = ref_dl + 1 WHERE id = ? AND (max_dl IS NULL OR max_dl = 0 OR ref_dl < max_dl)",
+	PostViews:     "UPDATE posts SET ref_view = ref_view + 1 WHERE id = ? AND (max_view IS NULL OR max_view = 0 OR ref_view < max_view)",
+}
+
+// CountDelta is an amount to add to one counter of one item on one day.
+type CountDelta struct {
+	Kind   string
+	ItemID int64
+	// Day is YYYY-MM-DD in utc
+	Day string
+	N   int64
+}
+
+type DailyCount struct {
+	Day   string `json:"day"`
+	Count int64  `json:"count"`
+}
+
+// ApplyCounts adds a batch of deltas to the counter columns and the daily history in one transaction.
+func (s *SQLStore) ApplyCounts(deltas []CountDelta) error {
+	loclog := "[db.ApplyCounts]"
+	tx, err := s.db.Begin()
+	if err != nil {
+		slog.Error(loclog, "SEVERE", "failed to begin transaction", "error", err.Error())
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, d := range deltas {
+		stmt, ok := counterUpdates[d.Kind]
+		if !ok {
+			slog.Error(loclog, "SEVERE", "unknown counter kind", "kind", d.Kind)
+			return errors.New("unknown counter kind " + d.Kind)
+		}
+		_, err = tx.Exec(stmt, d.N, d.ItemID)
+		if err != nil {
+			slog.Error(loclog, "SEVERE", "failed to update counter", "error", err.Error(), "kind", d.Kind, "item_id", d.ItemID)
+			return err
+		}
+		_, err = tx.Exec(`INSERT INTO daily_counts (kind, item_id, day, count) VALUES (?, ?, ?, ?)
+			ON CONFLICT(kind, item_id, day) DO UPDATE SET count = daily_counts.count + excluded.count`, d.Kind, d.ItemID, d.Day, d.N)
+		if err != nil {
+			slog.Error(loclog, "SEVERE", "failed to update daily count", "error", err.Error(), "kind", d.Kind, "item_id", d.ItemID)
+			return err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		slog.Error(loclog, "SEVERE", "failed to commit transaction", "error", err.Error())
+		return err
+	}
+	slog.Debug(loclog, "info", "counts applied", "deltas", len(deltas))
+	return nil
+}
+
+// ReserveCount adds one to the counter of an item unless it reached the item's limit, see CountStore.
+// The conditional update makes concurrent reservations, from any instance, stop at the limit.
+func (s *SQLStore) ReserveCount(kind string, itemID int64, day string) (bool, error) {
+	loclog := "[db.ReserveCount]"
+	stmt, ok := counterReservations[kind]
+	if !ok {
+		slog.Error(loclog, "SEVERE", "counter kind has no limit", "kind", kind)
+		return false, errors.New("counter kind has no limit " + kind)
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		slog.Error(loclog, "SEVERE", "failed to begin transaction", "error", err.Error())
+		return false, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(stmt, itemID)
+	if err != nil {
+		slog.Error(loclog, "SEVERE", "failed to reserve count", "error", err.Error(), "kind", kind, "item_id", itemID)
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil || n == 0 {
+		return false, err
+	}
+	_, err = tx.Exec(`INSERT INTO daily_counts (kind, item_id, day, count) VALUES (?, ?, ?, 1)
+		ON CONFLICT(kind, item_id, day) DO UPDATE SET count = daily_counts.count + 1`, kind, itemID, day)
+	if err != nil {
+		slog.Error(loclog, "SEVERE", "failed to update daily count", "error", err.Error(), "kind", kind, "item_id", itemID)
+		return false, err
+	}
+	if err = tx.Commit(); err != nil {
+		slog.Error(loclog, "SEVERE", "failed to commit transaction", "error", err.Error())
+		return false, err
+	}
+	return true, nil
+}
+
+// GetDailyCounts returns the per day history of a counter from since (YYYY-MM-DD) on, oldest first.
+// Days without activity are not included.
+func (s *SQLStore) GetDailyCounts(kind string, itemID int64, since string) ([]DailyCount, error) {
+	loclog := "[db.GetDailyCounts]"
+	rows, err := s.db.Query("SELECT day, count FROM daily_counts WHERE kind = ? AND item_id = ? AND day >= ? ORDER BY day", kind, itemID, since)
+	if err != nil {
+		slog.Error(loclog, "SEVERE", "failed to query daily counts", "error", err.Error(), "kind", kind, "item_id", itemID)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var counts []DailyCount
+	for rows.Next() {
+		var c DailyCount
+		err = rows.Scan(&c.Day, &c.Count)
+		if err != nil {
+			slog.Error(loclog, "SEVERE", "failed to scan daily count", "error", err.Error(), "kind", kind, "item_id", itemID)
+			return nil, err
+		}
+		counts = append(counts, c)
+	}
+	return counts, rows.Err()
+}
+
+// GetGoneFiles returns up to limit files that expired by now or reached their download limit.
+func (s *SQLStore) GetGoneFiles(now int64, limit int) ([]*File, error) {
+	loclog := "[db.GetGoneFiles]"
+	rows, err := s.db.Query("SELECT "+fileColumns+` FROM files
+		WHERE (expires_at IS NOT NULL AND expires_at <= ?) OR (max_dl IS NOT NULL AND ref_dl >= max_dl)
+		LIMIT ?`, now, limit)
+	if err != nil {
+		slog.Error(loclog, "SEVERE", "failed to query gone files", "error", err.Error())
+		return nil, err
+	}
+	defer rows.Close()
+
+	var files []*File
+	for rows.Next() {
+		f, err := scanFile(rows)
+		if err != nil {
+			slog.Error(loclog, "SEVERE", "failed to scan file", "error", err.Error())
+			return nil, err
+		}
+		files = append(files, f)
+	}
+	return files, rows.Err()
+}
+
+// DeleteGonePosts deletes posts that expired by now or reached their view limit, with their history.
+// Returns how many posts were deleted.
+func (s *SQLStore) DeleteGonePosts(now int64) (int64, error) {
+	loclog := "[db.DeleteGonePosts]"
+	const gone = "(expires_at IS NOT NULL AND expires_at <= ?) OR (max_view IS NOT NULL AND ref_view >= max_view)"
+	tx, err := s.db.Begin()
+	if err != nil {
+		slog.Error(loclog, "SEVERE", "failed to begin transaction", "error", err.Error())
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("DELETE FROM daily_counts WHERE kind = ? AND item_id IN (SELECT id FROM posts WHERE "+gone+")", PostViews, now)
+	if err != nil {
+		slog.Error(loclog, "SEVERE", "failed to delete post history", "error", err.Error())
+		return 0, err
+	}
+	result, err := tx.Exec("DELETE FROM posts WHERE "+gone, now)
+	if err != nil {
+		slog.Error(loclog, "SEVERE", "failed to delete posts", "error", err.Error())
+		return 0, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		slog.Error(loclog, "SEVERE", "failed to get rows affected", "error", err.Error())
+		return 0, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		slog.Error(loclog, "SEVERE", "failed to commit transaction", "error", err.Error())
+		return 0, err
+	}
+	return n, nil
+}
+
+type APIKey struct {
+	ID           int64
+	KeyHash      string
+	Prefix       string
+	Issuer       string
+	CreationDate string
+	Revoked      bool
+	// Admin keys can use the admin api
+	Admin bool
+}
+
+func (s *SQLStore) InsertAPIKey(k *APIKey) error {
+	loclog := "[db.InsertAPIKey]"
+	err := s.db.QueryRow("INSERT INTO api_keys (key_hash, prefix, issuer, admin) VALUES (?, ?, ?, ?) RETURNING id",
+		k.KeyHash, k.Prefix, k.Issuer, boolInt(k.Admin)).Scan(&k.ID)
+	if err != nil {
+		slog.Error(loclog, "SEVERE", "failed to insert api key", "error", err.Error(), "prefix", k.Prefix, "issuer", k.Issuer)
+		return err
+	}
+	slog.Info(loclog, "info", "api key inserted", "prefix", k.Prefix, "issuer", k.Issuer, "admin", k.Admin)
+	return nil
+}
+
+// CreatedAt parses CreationDate, see File.CreatedAt.
+func (k *APIKey) CreatedAt() time.Time {
+	return parseUnix(k.CreationDate)
+}
+
+const apiKeyColumns = "id, key_hash, prefix, issuer, creation_date, revoked, admin"
+
+func scanAPIKey(row scanner) (*APIKey, error) {
+	var k APIKey
+	err := row.Scan(&k.ID, &k.KeyHash, &k.Prefix, &k.Issuer, &k.CreationDate, &k.Revoked, &k.Admin)
+	if err != nil {
+		return nil, err
+	}
+	return &k, nil
+}
+
+// GetAPIKeyByHash returns the key with the given hash, revoked or not, or nil if there is none.
+func (s *SQLStore) GetAPIKeyByHash(keyHash string) (*APIKey, error) {
+	loclog := "[db.GetAPIKeyByHash]"
+	k, err := scanAPIKey(s.db.QueryRow("SELECT "+apiKeyColumns+" FROM api_keys WHERE key_hash = ?", keyHash))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil // Return nil if not found
+		}
+		slog.Error(loclog, "SEVERE", "failed to scan api key", "error", err.Error())
+		return nil, err
+	}
+	return k, nil
+}
+
+func (s *SQLStore) ListAPIKeys() ([]*APIKey, error) {
+	loclog := "[db.ListAPIKeys]"
+	rows, err := s.db.Query("SELECT " + apiKeyColumns + " FROM api_keys ORDER BY id")
+	if err != nil {
+		slog.Error(loclog, "SEVERE", "failed to query api keys", "error", err.Error())
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []*APIKey
+	for rows.Next() {
+		k, err := scanAPIKey(rows)
+		if err != nil {
+			slog.Error(loclog, "SEVERE", "failed to scan api key", "error", err.Error())
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
+
+// RevokeAPIKeys revokes the keys shown with the given prefix and returns how many were revoked.
+func (s *SQLStore) RevokeAPIKeys(prefix string) (int64, error) {
+	loclog := "[db.RevokeAPIKeys]"
+	result, err := s.db.Exec("UPDATE api_keys SET revoked = 1 WHERE prefix = ? AND revoked = 0", prefix)
+	if err != nil {
+		slog.Error(loclog, "SEVERE", "failed to revoke api keys", "error", err.Error(), "prefix", prefix)
+		return 0, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		slog.Error(loclog, "SEVERE", "failed to get rows affected", "error", err.Error(), "prefix", prefix)
+		return 0, err
+	}
+	slog.Info(loclog, "info", "api keys revoked", "prefix", prefix, "revoked", n)
+	return n, nil
+}
@@ -1,229 +1,715 @@
 package db
 
 import (
-	"os"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
+// forEachStore runs test against a fresh, empty store of each implementation.
+// Postgres is included when TEST_POSTGRES_DSN points at a database the tests may create schemas in,
+// see openTestPostgres.
+func forEachStore(t *testing.T, test func(t *testing.T, s Store)) {
+	t.Run("sqlite", func(t *testing.T) {
+		t.Parallel()
+		s, err := OpenSQLite(filepath.Join(t.TempDir(), "test.db"))
+		if err != nil {
+			t.Fatalf("Failed to open database: %v", err)
+		}
+		defer s.Close()
+		_, err = s.Migrate(false)
+		if err != nil {
+			t.Fatalf("Failed to migrate database: %v", err)
+		}
+		test(t, s)
+	})
+	t.Run("memory", func(t *testing.T) {
+		t.Parallel()
+		test(t, NewMemory())
+	})
+	t.Run("postgres", func(t *testing.T) {
+		t.Parallel()
+		test(t, openTestPostgres(t))
+	})
+}
+
 func TestInsertAndGetFile(t *testing.T) {
-	// Setup temporary database
-	tmpDB := "test.db"
-	os.Setenv("DB_PATH", tmpDB)
-
-	// Initialize DB
-	// We need to suppress logs or accept them during tests.
-	// InitDB calls openDB which reads env.DBPath.
-
-	// Since InitDB calls os.Exit on failure, we need to be careful.
-	// But it shouldn't fail if we give it a writable path.
-
-	// We might need to ensure the directory exists if it's in a subfolder,
-	// but "test.db" is in current dir.
-
-	// Reset global db variable if possible, but it's private.
-	// However, InitDB overwrites it.
-
-	// Silence logger for cleaner test output (optional)
-	// slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelError})))
-
-	InitDB()
-	defer os.Remove(tmpDB)
-	defer db.Close() // Assuming we can close it, but db is private and *sql.DB.
-
-	f := &File{
-		PubID: "test_pub_id",
-		Meta: FileMeta{
-			OriginalName:  "test.txt",
-			Size:          10,
-			Hash:          "test_hash",
-			LocalFileName: "test.txt",
-			FileType:      "text/plain",
-		},
-		Issuer: "tester",
-	}
+	forEachStore(t, func(t *testing.T, s Store) {
+		f := &File{
+			PubID: "test_pub_id",
+			Meta: FileMeta{
+				OriginalName:  "test.txt",
+				Size:          10,
+				Hash:          "test_hash",
+				LocalFileName: "test.txt",
+				FileType:      "text/plain",
+			},
+			Issuer: "tester",
+		}
+
+		err := s.InsertFile(f)
+		if err != nil {
+			t.Fatalf("Failed to insert file: %v", err)
+		}
+
+		if f.ID == 0 {
+			t.Errorf("Expected ID to be populated, got 0")
+		}
+
+		retrieved, err := s.GetFileByPubID("test_pub_id")
+		if err != nil {
+			t.Fatalf("Failed to get file: %v", err)
+		}
+
+		if retrieved == nil {
+			t.Fatalf("Expected file to be found, got nil")
+		}
+
+		if retrieved.PubID != f.PubID {
+			t.Errorf("Expected PubID %s, got %s", f.PubID, retrieved.PubID)
+		}
+		if retrieved.Meta.Hash != f.Meta.Hash {
+			t.Errorf("Expected Meta %s, got %s", f.Meta.Hash, retrieved.Meta.Hash)
+		}
+		if retrieved.Issuer != f.Issuer {
+			t.Errorf("Expected Issuer %s, got %s", f.Issuer, retrieved.Issuer)
+		}
+	})
+}
 
-	err := InsertFile(f)
-	if err != nil {
-		t.Fatalf("Failed to insert file: %v", err)
-	}
+func TestInsertAndGetPost(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		// Post structure is:
+		// pubID
+		// content (title, body, format, language)
+		// issuer
+		// Insert post
+		p := &Post{
+			PubID: "test_pub_id",
+			Content: PostContent{
+				Title:    "title",
+				Body:     "package main",
+				Format:   PostCode,
+				Language: "go",
+			},
+			Issuer: "tester",
+		}
+
+		err := s.InsertPost(p)
+		if err != nil {
+			t.Fatalf("Failed to insert post: %v", err)
+		}
+
+		retrieved, err := s.GetPostByPubID("test_pub_id")
+		if err != nil {
+			t.Fatalf("Failed to get post: %v", err)
+		}
+
+		if retrieved == nil {
+			t.Fatalf("Expected post to be found, got nil")
+		}
+
+		if retrieved.ID == 0 {
+			t.Errorf("Expected ID to be populated, got 0")
+		}
+
+		if retrieved.PubID != p.PubID {
+			t.Errorf("Expected PubID %s, got %s", p.PubID, retrieved.PubID)
+		}
+		if retrieved.Content != p.Content {
+			t.Errorf("Expected Content %+v, got %+v", p.Content, retrieved.Content)
+		}
+		if retrieved.Issuer != p.Issuer {
+			t.Errorf("Expected Issuer %s, got %s", p.Issuer, retrieved.Issuer)
+		}
+	})
+}
 
-	if f.ID == 0 {
-		t.Errorf("Expected ID to be populated, got 0")
-	}
+func TestCounting(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		// Insert some files and posts
+		f := &File{
+			PubID: "test_pub_id",
+			Meta: FileMeta{
+				OriginalName:  "test.txt",
+				Size:          10,
+				Hash:          "test_hash",
+				LocalFileName: "test.txt",
+				FileType:      "text/plain",
+			},
+			Issuer: "tester",
+		}
+		f2 := &File{
+			PubID: "test_pub_id_2",
+			Meta: FileMeta{
+				OriginalName:  "test.txt",
+				Size:          10,
+				Hash:          "test_hash",
+				LocalFileName: "test.txt",
+				FileType:      "text/plain",
+			},
+			Issuer: "tester",
+		}
+		p := &Post{
+			PubID:   "test_pub_id",
+			Content: PostContent{Title: "title", Body: "body", Format: PostPlain},
+			Issuer:  "tester",
+		}
+		p2 := &Post{
+			PubID:   "test_pub_id_2",
+			Content: PostContent{Title: "title", Body: "body", Format: PostPlain},
+			Issuer:  "tester",
+		}
+
+		s.InsertFile(f)
+		s.InsertFile(f)
+		s.InsertFile(f)
+
+		s.InsertPost(p)
+		s.InsertPost(p)
+		s.InsertPost(p)
+
+		// Check file count
+		count, err := s.GetFileEntries()
+		if err != nil {
+			t.Fatalf("Failed to get file count: %v", err)
+		}
+		if count != 1 {
+			t.Errorf("Expected file count to be 1, got %d", count)
+		}
+
+		// Check post count
+		count, err = s.GetPostEntries()
+		if err != nil {
+			t.Fatalf("Failed to get post count: %v", err)
+		}
+		if count != 1 {
+			t.Errorf("Expected post count to be 1, got %d", count)
+		}
+
+		s.InsertFile(f2)
+		s.InsertPost(p2)
+
+		// Check file count
+		count, err = s.GetFileEntries()
+		if err != nil {
+			t.Fatalf("Failed to get file count: %v", err)
+		}
+		if count != 2 {
+			t.Errorf("Expected file count to be 2, got %d", count)
+		}
+
+		// Check post count
+		count, err = s.GetPostEntries()
+		if err != nil {
+			t.Fatalf("Failed to get post count: %v", err)
+		}
+		if count != 2 {
+			t.Errorf("Expected post count to be 2, got %d", count)
+		}
+	})
+}
 
-	retrieved, err := GetFileByPubID("test_pub_id")
-	if err != nil {
-		t.Fatalf("Failed to get file: %v", err)
-	}
+func TestBlobRefs(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		// Two files with the same content share one blob
+		refs, err := s.AcquireBlob("test_hash", 10)
+		if err != nil {
+			t.Fatalf("Failed to acquire blob: %v", err)
+		}
+		if refs != 1 {
+			t.Errorf("Expected refs to be 1 for a new blob, got %d", refs)
+		}
+		refs, err = s.AcquireBlob("test_hash", 10)
+		if err != nil {
+			t.Fatalf("Failed to acquire blob: %v", err)
+		}
+		if refs != 2 {
+			t.Errorf("Expected refs to be 2, got %d", refs)
+		}
+
+		removed := 0
+		remove := func() error {
+			removed++
+			return nil
+		}
+
+		// Releasing one reference keeps the blob
+		refs, err = s.ReleaseBlob("test_hash", remove)
+		if err != nil {
+			t.Fatalf("Failed to release blob: %v", err)
+		}
+		if refs != 1 {
+			t.Errorf("Expected refs to be 1, got %d", refs)
+		}
+		if removed != 0 {
+			t.Errorf("Expected content of a referenced blob to be kept, removed %d times", removed)
+		}
+
+		// A failed removal undoes the release
+		_, err = s.ReleaseBlob("test_hash", func() error { return errors.New("test remove failure") })
+		if err == nil {
+			t.Fatalf("Expected release to fail with the removal")
+		}
+
+		// Releasing the last reference removes the row and the content
+		refs, err = s.ReleaseBlob("test_hash", remove)
+		if err != nil {
+			t.Fatalf("Failed to release blob: %v", err)
+		}
+		if refs != 0 {
+			t.Errorf("Expected refs to be 0, got %d", refs)
+		}
+		if removed != 1 {
+			t.Errorf("Expected content to be removed once, got %d", removed)
+		}
+		refs, err = s.AcquireBlob("test_hash", 10)
+		if err != nil {
+			t.Fatalf("Failed to acquire blob: %v", err)
+		}
+		if refs != 1 {
+			t.Errorf("Expected released blob to be new again, got refs %d", refs)
+		}
+	})
+}
 
-	if retrieved == nil {
-		t.Fatalf("Expected file to be found, got nil")
-	}
+func TestDeleteFileReleasesBlob(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		f := &File{PubID: "test_pub_id", Meta: FileMeta{Hash: "test_hash"}, Issuer: "tester"}
+		if err := s.InsertFile(f); err != nil {
+			t.Fatalf("Failed to insert file: %v", err)
+		}
+		if _, err := s.AcquireBlob("test_hash", 10); err != nil {
+			t.Fatalf("Failed to acquire blob: %v", err)
+		}
+		removed := 0
+		remove := func() error {
+			removed++
+			return nil
+		}
+
+		// A failed removal keeps the file and its reference
+		_, err := s.DeleteFileByPubID(f.PubID, "test_hash", func() error { return errors.New("test remove failure") })
+		if err == nil {
+			t.Fatalf("Expected delete to fail with the removal")
+		}
+		if retrieved, err := s.GetFileByPubID(f.PubID); err != nil || retrieved == nil {
+			t.Fatalf("Expected the file to be kept, got %v %v", retrieved, err)
+		}
+
+		deleted, err := s.DeleteFileByPubID(f.PubID, "test_hash", remove)
+		if err != nil || !deleted {
+			t.Fatalf("Failed to delete file: %v %v", deleted, err)
+		}
+		if removed != 1 {
+			t.Errorf("Expected the content to be removed with the last reference, got %d", removed)
+		}
+		// A file that is gone already doesn't release the blob again
+		deleted, err = s.DeleteFileByPubID(f.PubID, "test_hash", remove)
+		if err != nil || deleted {
+			t.Errorf("Expected nothing to delete, got %v %v", deleted, err)
+		}
+		if removed != 1 {
+			t.Errorf("Expected no second removal, got %d", removed)
+		}
+		if refs, err := s.AcquireBlob("test_hash", 10); err != nil || refs != 1 {
+			t.Errorf("Expected the blob to be released once, got refs %d %v", refs, err)
+		}
+	})
+}
 
-	if retrieved.PubID != f.PubID {
-		t.Errorf("Expected PubID %s, got %s", f.PubID, retrieved.PubID)
-	}
-	if retrieved.Meta.Hash != f.Meta.Hash {
-		t.Errorf("Expected Meta %s, got %s", f.Meta.Hash, retrieved.Meta.Hash)
-	}
-	if retrieved.Issuer != f.Issuer {
-		t.Errorf("Expected Issuer %s, got %s", f.Issuer, retrieved.Issuer)
-	}
+func TestGoneItems(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		now := time.Now().Unix()
+		files := []*File{
+			{PubID: "expired", ExpiresAt: now - 1},
+			{PubID: "not_expired", ExpiresAt: now + 3600},
+			{PubID: "forever"},
+			{PubID: "limited", MaxDL: 1},
+		}
+		for _, f := range files {
+			f.Issuer = "tester"
+			err := s.InsertFile(f)
+			if err != nil {
+				t.Fatalf("Failed to insert file: %v", err)
+			}
+		}
+		err := s.ApplyCounts([]CountDelta{{Kind: FileDownloads, ItemID: files[3].ID, Day: "2026-01-01", N: 1}})
+		if err != nil {
+			t.Fatalf("Failed to apply counts: %v", err)
+		}
+
+		gone, err := s.GetGoneFiles(now, 100)
+		if err != nil {
+			t.Fatalf("Failed to get gone files: %v", err)
+		}
+		if len(gone) != 2 || gone[0].PubID != "expired" || gone[1].PubID != "limited" {
+			t.Errorf("Expected expired and limited to be gone, got %+v", gone)
+		}
+
+		posts := []*Post{
+			{PubID: "expired", ExpiresAt: now - 1},
+			{PubID: "forever"},
+		}
+		for _, p := range posts {
+			p.Issuer = "tester"
+			p.Content = PostContent{Body: "body", Format: PostPlain}
+			err = s.InsertPost(p)
+			if err != nil {
+				t.Fatalf("Failed to insert post: %v", err)
+			}
+		}
+		n, err := s.DeleteGonePosts(now)
+		if err != nil {
+			t.Fatalf("Failed to delete gone posts: %v", err)
+		}
+		if n != 1 {
+			t.Errorf("Expected 1 post deleted, got %d", n)
+		}
+		p, err := s.GetPostByPubID("forever")
+		if err != nil || p == nil {
+			t.Errorf("Expected post without expiry to be kept, got %v %v", p, err)
+		}
+	})
 }
 
-func TestInsertAndGetPost(t *testing.T) {
-	// Setup temporary database
-	tmpDB := "test.db"
-	os.Setenv("DB_PATH", tmpDB)
-
-	// Initialize DB
-	// We need to suppress logs or accept them during tests.
-	// InitDB calls openDB which reads env.DBPath.
-
-	// Since InitDB calls os.Exit on failure, we need to be careful.
-	// But it shouldn't fail if we give it a writable path.
-
-	// We might need to ensure the directory exists if it's in a subfolder,
-	// but "test.db" is in current dir.
-
-	// Reset global db variable if possible, but it's private.
-	// However, InitDB overwrites it.
-
-	// Silence logger for cleaner test output (optional)
-	// slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelError})))
-
-	InitDB()
-	defer os.Remove(tmpDB)
-	defer db.Close() // Assuming we can close it, but db is private and *sql.DB.
-
-	// Post structure is:
-	// pubID
-	// content
-	// issuer
-	// Insert post
-	p := &Post{
-		PubID:   "test_pub_id",
-		Content: `{"files": ["12", "34"],"description": "description"}`,
-		Issuer:  "tester",
-	}
+func TestReserveCount(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		limited := &File{PubID: "limited", Issuer: "tester", MaxDL: 3}
+		forever := &File{PubID: "forever", Issuer: "tester"}
+		for _, f := range []*File{limited, forever} {
+			if err := s.InsertFile(f); err != nil {
+				t.Fatalf("Failed to insert file: %v", err)
+			}
+		}
+
+		// parallel requests stop at the limit
+		var wg sync.WaitGroup
+		var reserved atomic.Int64
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				ok, err := s.ReserveCount(FileDownloads, limited.ID, "2026-01-01")
+				if err != nil {
+					t.Errorf("Failed to reserve download: %v", err)
+				}
+				if ok {
+					reserved.Add(1)
+				}
+			}()
+		}
+		wg.Wait()
+		if n := reserved.Load(); n != 3 {
+			t.Errorf("Expected 3 downloads to be reserved, got %d", n)
+		}
+		f, err := s.GetFileByPubID("limited")
+		if err != nil || f.RefDL != 3 {
+			t.Errorf("Expected 3 downloads counted, got %+v %v", f, err)
+		}
+		history, err := s.GetDailyCounts(FileDownloads, limited.ID, "2026-01-01")
+		if err != nil || len(history) != 1 || history[0].Count != 3 {
+			t.Errorf("Expected the downloads in the history, got %+v %v", history, err)
+		}
+
+		for i := 0; i < 5; i++ {
+			if ok, err := s.ReserveCount(FileDownloads, forever.ID, "2026-01-01"); !ok || err != nil {
+				t.Fatalf("Expected an unlimited file to be reserved, got %v %v", ok, err)
+			}
+		}
+
+		post := &Post{PubID: "once", Issuer: "tester", MaxViews: 1, Content: PostContent{Body: "body", Format: PostPlain}}
+		if err := s.InsertPost(post); err != nil {
+			t.Fatalf("Failed to insert post: %v", err)
+		}
+		if ok, _ := s.ReserveCount(PostViews, post.ID, "2026-01-01"); !ok {
+			t.Errorf("Expected the first view to be reserved")
+		}
+		if ok, _ := s.ReserveCount(PostViews, post.ID, "2026-01-01"); ok {
+			t.Errorf("Expected the second view to be refused")
+		}
+	})
+}
 
-	err := InsertPost(p)
+// TestSQLiteConcurrentWrites runs writes from many connections at once, which wait for each other
+// rather than fail with SQLITE_BUSY. Run it with -tags puresqlite too, the drivers set this up apart.
+func TestSQLiteConcurrentWrites(t *testing.T) {
+	s, err := OpenSQLite(filepath.Join(t.TempDir(), "test.db"))
 	if err != nil {
-		t.Fatalf("Failed to insert post: %v", err)
+		t.Fatalf("Failed to open database: %v", err)
 	}
-
-	retrieved, err := GetPostByPubID("test_pub_id")
+	defer s.Close()
+	_, err = s.Migrate(false)
 	if err != nil {
-		t.Fatalf("Failed to get post: %v", err)
-	}
-
-	if retrieved == nil {
-		t.Fatalf("Expected post to be found, got nil")
+		t.Fatalf("Failed to migrate database: %v", err)
 	}
 
-	if retrieved.ID == 0 {
-		t.Errorf("Expected ID to be populated, got 0")
+	const writers = 16
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			f := &File{PubID: fmt.Sprintf("test_pub_id_%d", i), Issuer: "tester"}
+			if err := s.InsertFile(f); err != nil {
+				t.Errorf("Failed to insert file: %v", err)
+				return
+			}
+			if _, err := s.AcquireBlob("test_hash", 10); err != nil {
+				t.Errorf("Failed to acquire blob: %v", err)
+			}
+			for j := 0; j < 10; j++ {
+				err := s.ApplyCounts([]CountDelta{{Kind: FileViews, ItemID: f.ID, Day: "2026-01-01", N: 1}})
+				if err != nil {
+					t.Errorf("Failed to apply counts: %v", err)
+				}
+				if _, err := s.ReserveCount(FileDownloads, f.ID, "2026-01-01"); err != nil {
+					t.Errorf("Failed to reserve download: %v", err)
+				}
+			}
+		}()
 	}
+	wg.Wait()
 
-	if retrieved.PubID != p.PubID {
-		t.Errorf("Expected PubID %s, got %s", p.PubID, retrieved.PubID)
-	}
-	if retrieved.Content != p.Content {
-		t.Errorf("Expected Content %s, got %s", p.Content, retrieved.Content)
-	}
-	if retrieved.Issuer != p.Issuer {
-		t.Errorf("Expected Issuer %s, got %s", p.Issuer, retrieved.Issuer)
+	refs, err := s.AcquireBlob("test_hash", 10)
+	if err != nil || refs != writers+1 {
+		t.Errorf("Expected every writer to acquire the blob, got refs %d %v", refs, err)
 	}
 }
 
-func TestCounting(t *testing.T) {
-	// Setup temporary database
-	tmpDB := "test.db"
-	os.Setenv("DB_PATH", tmpDB)
-
-	// Initialize DB
-	InitDB()
-	defer os.Remove(tmpDB)
-	defer db.Close()
-
-	// Insert some files and posts
-	f := &File{
-		PubID: "test_pub_id",
-		Meta: FileMeta{
-			OriginalName:  "test.txt",
-			Size:          10,
-			Hash:          "test_hash",
-			LocalFileName: "test.txt",
-			FileType:      "text/plain",
-		},
-		Issuer: "tester",
-	}
-	f2 := &File{
-		PubID: "test_pub_id_2",
-		Meta: FileMeta{
-			OriginalName:  "test.txt",
-			Size:          10,
-			Hash:          "test_hash",
-			LocalFileName: "test.txt",
-			FileType:      "text/plain",
-		},
-		Issuer: "tester",
-	}
-	p := &Post{
-		PubID:   "test_pub_id",
-		Content: `{"files": ["12", "34"],"description": "description"}`,
-		Issuer:  "tester",
-	}
-	p2 := &Post{
-		PubID:   "test_pub_id_2",
-		Content: `{"files": ["12", "34"],"description": "description"}`,
-		Issuer:  "tester",
-	}
-
-	InsertFile(f)
-	InsertFile(f)
-	InsertFile(f)
-
-	InsertPost(p)
-	InsertPost(p)
-	InsertPost(p)
-
-	// Check file count
-	count, err := GetFileEntries()
-	if err != nil {
-		t.Fatalf("Failed to get file count: %v", err)
-	}
-	if count != 1 {
-		t.Errorf("Expected file count to be 1, got %d", count)
-	}
-
-	// Check post count
-	count, err = GetPostEntries()
-	if err != nil {
-		t.Fatalf("Failed to get post count: %v", err)
-	}
-	if count != 1 {
-		t.Errorf("Expected post count to be 1, got %d", count)
+// TestSQLiteBusyTimeout opens paths that carry parameters of their own, which the busy timeout is added to
+func TestSQLiteBusyTimeout(t *testing.T) {
+	dir := t.TempDir()
+	for _, path := range []string{
+		filepath.Join(dir, "plain.db"),
+		filepath.Join(dir, "query.db") + "?cache=private",
+		"file:" + filepath.Join(dir, "uri.db") + "?mode=rwc",
+	} {
+		s, err := OpenSQLite(path)
+		if err != nil {
+			t.Fatalf("Failed to open database %s: %v", path, err)
+		}
+		var timeout int
+		err = s.db.QueryRow("PRAGMA busy_timeout").Scan(&timeout)
+		s.Close()
+		if err != nil {
+			t.Fatalf("Failed to read busy timeout of %s: %v", path, err)
+		}
+		if timeout != sqliteBusyTimeout {
+			t.Errorf("Expected busy timeout %d for %s, got %d", sqliteBusyTimeout, path, timeout)
+		}
 	}
+}
 
-	InsertFile(f2)
-	InsertPost(p2)
+func TestAdminQueries(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		for _, name := range []string{"cat.png", "dog.png", "notes.txt"} {
+			err := s.InsertFile(&File{PubID: "id_" + name, Meta: FileMeta{OriginalName: name}, Issuer: "tester"})
+			if err != nil {
+				t.Fatalf("Failed to insert file: %v", err)
+			}
+		}
+
+		files, total, err := s.ListFiles(".png", 1, 0)
+		if err != nil {
+			t.Fatalf("Failed to list files: %v", err)
+		}
+		if total != 2 || len(files) != 1 {
+			t.Errorf("Expected 1 of 2 png files, got %d of %d", len(files), total)
+		}
+		_, total, err = s.ListFiles("", 50, 0)
+		if err != nil {
+			t.Fatalf("Failed to list files: %v", err)
+		}
+		if total != 3 {
+			t.Errorf("Expected 3 files, got %d", total)
+		}
+
+		ok, err := s.SetFileDisabled("id_cat.png", true)
+		if err != nil || !ok {
+			t.Fatalf("Failed to disable file: %v", err)
+		}
+		ok, err = s.SetFileExpiry("id_cat.png", 1234)
+		if err != nil || !ok {
+			t.Fatalf("Failed to set file expiry: %v", err)
+		}
+		ok, err = s.RotateFilePubID("id_cat.png", "rotated")
+		if err != nil || !ok {
+			t.Fatalf("Failed to rotate file: %v", err)
+		}
+		f, err := s.GetFileByPubID("rotated")
+		if err != nil || f == nil {
+			t.Fatalf("Failed to get rotated file: %v", err)
+		}
+		if !f.Disabled || f.ExpiresAt != 1234 {
+			t.Errorf("Expected disabled file expiring at 1234, got %+v", f)
+		}
+		f, err = s.GetFileByPubID("id_cat.png")
+		if err != nil || f != nil {
+			t.Errorf("Expected old pub id to be gone, got %+v, %v", f, err)
+		}
+		ok, err = s.SetFileExpiry("missing", 1)
+		if err != nil || ok {
+			t.Errorf("Expected no update for missing file, got %v, %v", ok, err)
+		}
+
+		p := &Post{PubID: "post", Issuer: "tester", Content: PostContent{Body: "body", Format: PostPlain}}
+		err = s.InsertPost(p)
+		if err != nil {
+			t.Fatalf("Failed to insert post: %v", err)
+		}
+		ok, err = s.DeletePostByPubID("post")
+		if err != nil || !ok {
+			t.Fatalf("Failed to delete post: %v", err)
+		}
+		got, err := s.GetPostByPubID("post")
+		if err != nil || got != nil {
+			t.Errorf("Expected deleted post to be gone, got %+v, %v", got, err)
+		}
+	})
+}
 
-	// Check file count
-	count, err = GetFileEntries()
-	if err != nil {
-		t.Fatalf("Failed to get file count: %v", err)
-	}
-	if count != 2 {
-		t.Errorf("Expected file count to be 2, got %d", count)
-	}
+func TestUploads(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		u := &Upload{
+			PubID:  "upload",
+			Issuer: "tester",
+			Length: 10,
+			Meta:   UploadMeta{OriginalName: "big.iso", ExpiresIn: 60},
+		}
+		err := s.InsertUpload(u)
+		if err != nil {
+			t.Fatalf("Failed to insert upload: %v", err)
+		}
+		if u.ID == 0 || u.UpdatedAt == 0 {
+			t.Errorf("Expected ID and UpdatedAt to be populated, got %+v", u)
+		}
+
+		ok, err := s.AdvanceUpload("upload", 0, 4, []string{"chunk_a"})
+		if err != nil || !ok {
+			t.Fatalf("Failed to advance upload: %v", err)
+		}
+		ok, err = s.AdvanceUpload("upload", 0, 8, []string{"chunk_b"})
+		if err != nil || ok {
+			t.Errorf("Expected advancing from a stale offset to fail, got %v, %v", ok, err)
+		}
+		got, err := s.GetUploadByPubID("upload")
+		if err != nil || got == nil {
+			t.Fatalf("Failed to get upload: %v", err)
+		}
+		if got.Offset != 4 || got.Length != 10 || got.Meta != u.Meta || got.Issuer != "tester" {
+			t.Errorf("Expected upload at offset 4, got %+v", got)
+		}
+		if len(got.Chunks) != 1 || got.Chunks[0] != "chunk_a" || got.FilePubID != "" {
+			t.Errorf("Expected the chunk of the advance that won, got %+v", got)
+		}
+
+		// the file is recorded once, however often completing is retried
+		f := &File{PubID: "from_upload", Issuer: "tester"}
+		ok, err = s.CompleteUpload("upload", f)
+		if err != nil || !ok || f.ID == 0 {
+			t.Fatalf("Failed to complete upload: %v, %v", ok, err)
+		}
+		ok, err = s.CompleteUpload("upload", &File{PubID: "from_upload_again", Issuer: "tester"})
+		if err != nil || ok {
+			t.Errorf("Expected completing again to fail, got %v, %v", ok, err)
+		}
+		if again, _ := s.GetFileByPubID("from_upload_again"); again != nil {
+			t.Errorf("Expected no second file, got %+v", again)
+		}
+		got, err = s.GetUploadByPubID("upload")
+		if err != nil || got == nil || got.FilePubID != "from_upload" {
+			t.Errorf("Expected the upload to name its file, got %+v, %v", got, err)
+		}
+
+		stale, err := s.GetStaleUploads(got.UpdatedAt, 10)
+		if err != nil {
+			t.Fatalf("Failed to get stale uploads: %v", err)
+		}
+		if len(stale) != 0 {
+			t.Errorf("Expected no stale uploads, got %+v", stale)
+		}
+		stale, err = s.GetStaleUploads(got.UpdatedAt+1, 10)
+		if err != nil {
+			t.Fatalf("Failed to get stale uploads: %v", err)
+		}
+		if len(stale) != 1 || stale[0].PubID != "upload" {
+			t.Errorf("Expected the upload to be stale, got %+v", stale)
+		}
+
+		ok, err = s.DeleteUploadByPubID("upload")
+		if err != nil || !ok {
+			t.Fatalf("Failed to delete upload: %v", err)
+		}
+		got, err = s.GetUploadByPubID("upload")
+		if err != nil || got != nil {
+			t.Errorf("Expected deleted upload to be gone, got %+v, %v", got, err)
+		}
+	})
+}
 
-	// Check post count
-	count, err = GetPostEntries()
-	if err != nil {
-		t.Fatalf("Failed to get post count: %v", err)
-	}
-	if count != 2 {
-		t.Errorf("Expected post count to be 2, got %d", count)
-	}
+func TestBans(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		err := s.PutBan(&Ban{Subject: "10.0.0.1", Reason: "enumeration", Strikes: 1, ExpiresAt: 100})
+		if err != nil {
+			t.Fatalf("Failed to put ban: %v", err)
+		}
+		err = s.PutBan(&Ban{Subject: "10.0.0.2", Allow: true})
+		if err != nil {
+			t.Fatalf("Failed to put allow entry: %v", err)
+		}
+
+		// replacing keeps one row per subject
+		err = s.PutBan(&Ban{Subject: "10.0.0.1", Reason: "too many requests", Strikes: 2, ExpiresAt: 200})
+		if err != nil {
+			t.Fatalf("Failed to replace ban: %v", err)
+		}
+		got, err := s.GetBan("10.0.0.1")
+		if err != nil || got == nil {
+			t.Fatalf("Failed to get ban: %v", err)
+		}
+		if got.Strikes != 2 || got.ExpiresAt != 200 || got.Reason != "too many requests" || got.Allow {
+			t.Errorf("Expected the replaced ban, got %+v", got)
+		}
+		if got.Active(200) || !got.Active(199) {
+			t.Errorf("Expected the ban to be active until 200, got %+v", got)
+		}
+
+		bans, err := s.ListBans()
+		if err != nil {
+			t.Fatalf("Failed to list bans: %v", err)
+		}
+		if len(bans) != 2 || bans[0].Subject != "10.0.0.1" || !bans[1].Allow || bans[1].ExpiresAt != 0 {
+			t.Errorf("Expected both entries by subject, got %+v", bans)
+		}
+		bans, err = s.ListActiveBans(200)
+		if err != nil {
+			t.Fatalf("Failed to list active bans: %v", err)
+		}
+		if len(bans) != 1 || bans[0].Subject != "10.0.0.2" {
+			t.Errorf("Expected only the allow entry to be active, got %+v", bans)
+		}
+
+		n, err := s.DeleteBansExpiredBefore(201)
+		if err != nil || n != 1 {
+			t.Errorf("Expected one expired ban to be deleted, got %d, %v", n, err)
+		}
+		got, err = s.GetBan("10.0.0.1")
+		if err != nil || got != nil {
+			t.Errorf("Expected expired ban to be gone, got %+v, %v", got, err)
+		}
+
+		ok, err := s.DeleteBan("10.0.0.2")
+		if err != nil || !ok {
+			t.Fatalf("Failed to delete allow entry: %v", err)
+		}
+		ok, err = s.DeleteBan("10.0.0.2")
+		if err != nil || ok {
+			t.Errorf("Expected deleting twice to report nothing deleted, got %v, %v", ok, err)
+		}
+	})
 }
@@ -0,0 +1,99 @@
+package db
+
+import (
+	"database/sql"
+	"strconv"
+	"strings"
+)
+
+// dialect is what differs between the sql databases SQLStore runs on.
+// Queries are written with ? placeholders and sqlite syntax where the two agree.
+type dialect struct {
+	name   string
+	driver string
+	// numbered placeholders ($1, $2...) replace ? before queries are sent
+	numbered bool
+	// like is the case insensitive LIKE operator
+	like string
+	// jsonField reads a top level text field of a json column
+	jsonField func(column, field string) string
+	// lockStmt, if set, runs first in the migration transaction so concurrent starts migrate one at a time
+	lockStmt string
+	// schemaMigrationsStmt creates the table recording applied migrations
+	schemaMigrationsStmt string
+	migrations           []migration
+}
+
+// rebind turns ? placeholders outside of quoted strings into $n for numbered dialects
+func (d *dialect) rebind(query string) string {
+	if !d.numbered || !strings.Contains(query, "?") {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	quoted := false
+	for _, c := range query {
+		switch {
+		case c == '\'':
+			quoted = !quoted
+		case c == '?' && !quoted:
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+// conn rebinds the queries it runs for its dialect
+type conn struct {
+	*sql.DB
+	d *dialect
+}
+
+func (c *conn) Exec(query string, args ...any) (sql.Result, error) {
+	return c.DB.Exec(c.d.rebind(query), args...)
+}
+
+func (c *conn) Query(query string, args ...any) (*sql.Rows, error) {
+	return c.DB.Query(c.d.rebind(query), args...)
+}
+
+func (c *conn) QueryRow(query string, args ...any) *sql.Row {
+	return c.DB.QueryRow(c.d.rebind(query), args...)
+}
+
+func (c *conn) Begin() (*txn, error) {
+	tx, err := c.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	return &txn{Tx: tx, d: c.d}, nil
+}
+
+// txn is conn for a transaction
+type txn struct {
+	*sql.Tx
+	d *dialect
+}
+
+func (t *txn) Exec(query string, args ...any) (sql.Result, error) {
+	return t.Tx.Exec(t.d.rebind(query), args...)
+}
+
+func (t *txn) Query(query string, args ...any) (*sql.Rows, error) {
+	return t.Tx.Query(t.d.rebind(query), args...)
+}
+
+func (t *txn) QueryRow(query string, args ...any) *sql.Row {
+	return t.Tx.QueryRow(t.d.rebind(query), args...)
+}
+
+// boolInt stores flags as 0 or 1, the integer columns both databases have for them
+func boolInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
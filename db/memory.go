@@ -0,0 +1,678 @@
+package db
+
+import (
+	"cmp"
+	"errors"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type dailyKey struct {
+	kind   string
+	itemID int64
+	day    string
+}
+
+type blobRef struct {
+	size int64
+	refs int64
+}
+
+// Memory is a Store that keeps everything in maps, for tests and throwaway instances.
+// It follows the sqlite store's behavior, including unique pub ids and key hashes.
+type Memory struct {
+	mu      sync.Mutex
+	lastID  int64
+	files   map[int64]*File
+	posts   map[int64]*Post
+	blobs   map[string]*blobRef
+	daily   map[dailyKey]int64
+	keys    map[int64]*APIKey
+	uploads map[int64]*Upload
+	bans    map[string]*Ban
+	now     func() time.Time
+}
+
+func NewMemory() *Memory {
+	return &Memory{
+		files:   make(map[int64]*File),
+		posts:   make(map[int64]*Post),
+		blobs:   make(map[string]*blobRef),
+		daily:   make(map[dailyKey]int64),
+		keys:    make(map[int64]*APIKey),
+		uploads: make(map[int64]*Upload),
+		bans:    make(map[string]*Ban),
+		now:     time.Now,
+	}
+}
+
+func (m *Memory) Close() error {
+	return nil
+}
+
+func (m *Memory) nextID() int64 {
+	m.lastID++
+	return m.lastID
+}
+
+func (m *Memory) creationDate() string {
+	return strconv.FormatInt(m.now().Unix(), 10)
+}
+
+// sortedIDs returns the keys of items, lowest (oldest) first
+func sortedIDs[T any](items map[int64]*T) []int64 {
+	ids := make([]int64, 0, len(items))
+	for id := range items {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+	return ids
+}
+
+// contains is LIKE '%q%', which is case insensitive for ascii in sqlite
+func contains(s, q string) bool {
+	return strings.Contains(strings.ToLower(s), strings.ToLower(q))
+}
+
+// page returns items[offset:offset+limit] in bounds
+func page[T any](items []T, limit, offset int) []T {
+	offset = min(max(offset, 0), len(items))
+	end := min(offset+max(limit, 0), len(items))
+	return items[offset:end]
+}
+
+func (m *Memory) deleteHistory(itemID int64, kinds ...string) {
+	for k := range m.daily {
+		if k.itemID == itemID && slices.Contains(kinds, k.kind) {
+			delete(m.daily, k)
+		}
+	}
+}
+
+func (m *Memory) fileByPubID(pubID string) *File {
+	for _, f := range m.files {
+		if f.PubID == pubID {
+			return f
+		}
+	}
+	return nil
+}
+
+func (m *Memory) postByPubID(pubID string) *Post {
+	for _, p := range m.posts {
+		if p.PubID == pubID {
+			return p
+		}
+	}
+	return nil
+}
+
+var errPubIDTaken = errors.New("pub_id already exists")
+
+func (m *Memory) InsertFile(f *File) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.insertFile(f)
+}
+
+func (m *Memory) insertFile(f *File) error {
+	if m.fileByPubID(f.PubID) != nil {
+		return errPubIDTaken
+	}
+	f.ID = m.nextID()
+	m.files[f.ID] = &File{
+		ID:           f.ID,
+		PubID:        f.PubID,
+		Meta:         f.Meta,
+		CreationDate: m.creationDate(),
+		Issuer:       f.Issuer,
+		ExpiresAt:    f.ExpiresAt,
+		MaxDL:        f.MaxDL,
+	}
+	return nil
+}
+
+func (m *Memory) GetFileByPubID(pubID string) (*File, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f := m.fileByPubID(pubID)
+	if f == nil {
+		return nil, nil
+	}
+	c := *f
+	return &c, nil
+}
+
+func (m *Memory) GetFileByID(id int64) (*File, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f, ok := m.files[id]
+	if !ok {
+		return nil, nil
+	}
+	c := *f
+	return &c, nil
+}
+
+func (m *Memory) DeleteFileByPubID(pubID, hash string, remove func() error) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f := m.fileByPubID(pubID)
+	if f == nil {
+		return false, nil
+	}
+	if hash != "" {
+		if _, err := m.releaseBlob(hash, remove); err != nil {
+			return false, err
+		}
+	}
+	m.deleteHistory(f.ID, FileViews, FileDownloads)
+	delete(m.files, f.ID)
+	return true, nil
+}
+
+func (m *Memory) GetFileEntries() (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return int64(len(m.files)), nil
+}
+
+func fileIsGone(f *File, now int64) bool {
+	return (f.ExpiresAt != 0 && f.ExpiresAt <= now) || (f.MaxDL != 0 && int64(f.RefDL) >= f.MaxDL)
+}
+
+func postIsGone(p *Post, now int64) bool {
+	return (p.ExpiresAt != 0 && p.ExpiresAt <= now) || (p.MaxViews != 0 && int64(p.RefView) >= p.MaxViews)
+}
+
+func (m *Memory) GetGoneFiles(now int64, limit int) ([]*File, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var files []*File
+	for _, id := range sortedIDs(m.files) {
+		if len(files) == limit {
+			break
+		}
+		if f := m.files[id]; fileIsGone(f, now) {
+			c := *f
+			files = append(files, &c)
+		}
+	}
+	return files, nil
+}
+
+func (m *Memory) ListFiles(q string, limit, offset int) ([]*File, int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ids := sortedIDs(m.files)
+	slices.Reverse(ids)
+	files := []*File{}
+	for _, id := range ids {
+		f := m.files[id]
+		if q == "" || contains(f.Meta.OriginalName, q) || contains(f.Issuer, q) || contains(f.Meta.Hash, q) || f.PubID == q {
+			c := *f
+			files = append(files, &c)
+		}
+	}
+	return page(files, limit, offset), int64(len(files)), nil
+}
+
+// updateFile applies fn to the file with pubID and reports whether there was one
+func (m *Memory) updateFile(pubID string, fn func(f *File)) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f := m.fileByPubID(pubID)
+	if f == nil {
+		return false, nil
+	}
+	fn(f)
+	return true, nil
+}
+
+func (m *Memory) SetFileExpiry(pubID string, expiresAt int64) (bool, error) {
+	return m.updateFile(pubID, func(f *File) { f.ExpiresAt = expiresAt })
+}
+
+func (m *Memory) SetFileDisabled(pubID string, disabled bool) (bool, error) {
+	return m.updateFile(pubID, func(f *File) { f.Disabled = disabled })
+}
+
+func (m *Memory) RotateFilePubID(pubID, newPubID string) (bool, error) {
+	m.mu.Lock()
+	taken := m.fileByPubID(newPubID) != nil
+	m.mu.Unlock()
+	if taken {
+		return false, errPubIDTaken
+	}
+	return m.updateFile(pubID, func(f *File) { f.PubID = newPubID })
+}
+
+func (m *Memory) InsertPost(p *Post) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.postByPubID(p.PubID) != nil {
+		return errPubIDTaken
+	}
+	p.ID = m.nextID()
+	m.posts[p.ID] = &Post{
+		ID:           p.ID,
+		PubID:        p.PubID,
+		Content:      p.Content,
+		CreationDate: m.creationDate(),
+		Issuer:       p.Issuer,
+		ExpiresAt:    p.ExpiresAt,
+		MaxViews:     p.MaxViews,
+	}
+	return nil
+}
+
+func (m *Memory) GetPostByPubID(pubID string) (*Post, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	p := m.postByPubID(pubID)
+	if p == nil {
+		return nil, nil
+	}
+	c := *p
+	return &c, nil
+}
+
+func (m *Memory) GetPostEntries() (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return int64(len(m.posts)), nil
+}
+
+func (m *Memory) DeleteGonePosts(now int64) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var n int64
+	for id, p := range m.posts {
+		if postIsGone(p, now) {
+			m.deleteHistory(id, PostViews)
+			delete(m.posts, id)
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (m *Memory) ListPosts(q string, limit, offset int) ([]*Post, int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ids := sortedIDs(m.posts)
+	slices.Reverse(ids)
+	posts := []*Post{}
+	for _, id := range ids {
+		p := m.posts[id]
+		if q == "" || contains(p.Content.Title, q) || contains(p.Issuer, q) || p.PubID == q {
+			c := *p
+			posts = append(posts, &c)
+		}
+	}
+	return page(posts, limit, offset), int64(len(posts)), nil
+}
+
+// updatePost applies fn to the post with pubID and reports whether there was one
+func (m *Memory) updatePost(pubID string, fn func(p *Post)) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	p := m.postByPubID(pubID)
+	if p == nil {
+		return false, nil
+	}
+	fn(p)
+	return true, nil
+}
+
+func (m *Memory) SetPostExpiry(pubID string, expiresAt int64) (bool, error) {
+	return m.updatePost(pubID, func(p *Post) { p.ExpiresAt = expiresAt })
+}
+
+func (m *Memory) SetPostDisabled(pubID string, disabled bool) (bool, error) {
+	return m.updatePost(pubID, func(p *Post) { p.Disabled = disabled })
+}
+
+func (m *Memory) RotatePostPubID(pubID, newPubID string) (bool, error) {
+	m.mu.Lock()
+	taken := m.postByPubID(newPubID) != nil
+	m.mu.Unlock()
+	if taken {
+		return false, errPubIDTaken
+	}
+	return m.updatePost(pubID, func(p *Post) { p.PubID = newPubID })
+}
+
+func (m *Memory) DeletePostByPubID(pubID string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	p := m.postByPubID(pubID)
+	if p == nil {
+		return false, nil
+	}
+	m.deleteHistory(p.ID, PostViews)
+	delete(m.posts, p.ID)
+	return true, nil
+}
+
+func (m *Memory) AcquireBlob(hash string, size int64) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	b, ok := m.blobs[hash]
+	if !ok {
+		b = &blobRef{size: size}
+		m.blobs[hash] = b
+	}
+	b.refs++
+	return b.refs, nil
+}
+
+func (m *Memory) ReleaseBlob(hash string, remove func() error) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.releaseBlob(hash, remove)
+}
+
+func (m *Memory) releaseBlob(hash string, remove func() error) (int64, error) {
+	b, ok := m.blobs[hash]
+	if !ok {
+		return 0, remove()
+	}
+	if b.refs > 1 {
+		b.refs--
+		return b.refs, nil
+	}
+	if err := remove(); err != nil {
+		return 0, err
+	}
+	delete(m.blobs, hash)
+	return 0, nil
+}
+
+func (m *Memory) ApplyCounts(deltas []CountDelta) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, d := range deltas {
+		if _, ok := counterUpdates[d.Kind]; !ok {
+			return errors.New("unknown counter kind " + d.Kind)
+		}
+	}
+	for _, d := range deltas {
+		switch d.Kind {
+		case FileViews:
+			if f, ok := m.files[d.ItemID]; ok {
+				f.RefView += int(d.N)
+			}
+		case FileDownloads:
+			if f, ok := m.files[d.ItemID]; ok {
+				f.RefDL += int(d.N)
+			}
+		case PostViews:
+			if p, ok := m.posts[d.ItemID]; ok {
+				p.RefView += int(d.N)
+			}
+		}
+		m.daily[dailyKey{d.Kind, d.ItemID, d.Day}] += d.N
+	}
+	return nil
+}
+
+func (m *Memory) ReserveCount(kind string, itemID int64, day string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	switch kind {
+	case FileDownloads:
+		f, ok := m.files[itemID]
+		if !ok || (f.MaxDL != 0 && int64(f.RefDL) >= f.MaxDL) {
+			return false, nil
+		}
+		f.RefDL++
+	case PostViews:
+		p, ok := m.posts[itemID]
+		if !ok || (p.MaxViews != 0 && int64(p.RefView) >= p.MaxViews) {
+			return false, nil
+		}
+		p.RefView++
+	default:
+		return false, errors.New("counter kind has no limit " + kind)
+	}
+	m.daily[dailyKey{kind, itemID, day}]++
+	return true, nil
+}
+
+func (m *Memory) GetDailyCounts(kind string, itemID int64, since string) ([]DailyCount, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var counts []DailyCount
+	for k, n := range m.daily {
+		if k.kind == kind && k.itemID == itemID && k.day >= since {
+			counts = append(counts, DailyCount{Day: k.day, Count: n})
+		}
+	}
+	slices.SortFunc(counts, func(a, b DailyCount) int { return strings.Compare(a.Day, b.Day) })
+	return counts, nil
+}
+
+func (m *Memory) InsertAPIKey(k *APIKey) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, other := range m.keys {
+		if other.KeyHash == k.KeyHash {
+			return errors.New("key_hash already exists")
+		}
+	}
+	k.ID = m.nextID()
+	m.keys[k.ID] = &APIKey{
+		ID:           k.ID,
+		KeyHash:      k.KeyHash,
+		Prefix:       k.Prefix,
+		Issuer:       k.Issuer,
+		CreationDate: m.creationDate(),
+		Admin:        k.Admin,
+	}
+	return nil
+}
+
+func (m *Memory) GetAPIKeyByHash(keyHash string) (*APIKey, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, k := range m.keys {
+		if k.KeyHash == keyHash {
+			c := *k
+			return &c, nil
+		}
+	}
+	return nil, nil
+}
+
+func (m *Memory) ListAPIKeys() ([]*APIKey, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var keys []*APIKey
+	for _, id := range sortedIDs(m.keys) {
+		c := *m.keys[id]
+		keys = append(keys, &c)
+	}
+	return keys, nil
+}
+
+func (m *Memory) RevokeAPIKeys(prefix string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var n int64
+	for _, k := range m.keys {
+		if k.Prefix == prefix && !k.Revoked {
+			k.Revoked = true
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (m *Memory) uploadByPubID(pubID string) *Upload {
+	for _, u := range m.uploads {
+		if u.PubID == pubID {
+			return u
+		}
+	}
+	return nil
+}
+
+func (m *Memory) InsertUpload(u *Upload) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.uploadByPubID(u.PubID) != nil {
+		return errPubIDTaken
+	}
+	u.ID = m.nextID()
+	u.UpdatedAt = m.now().Unix()
+	m.uploads[u.ID] = &Upload{
+		ID:           u.ID,
+		PubID:        u.PubID,
+		Issuer:       u.Issuer,
+		Length:       u.Length,
+		Offset:       u.Offset,
+		Meta:         u.Meta,
+		CreationDate: m.creationDate(),
+		UpdatedAt:    u.UpdatedAt,
+		Chunks:       slices.Clone(u.Chunks),
+	}
+	return nil
+}
+
+func (m *Memory) GetUploadByPubID(pubID string) (*Upload, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u := m.uploadByPubID(pubID)
+	if u == nil {
+		return nil, nil
+	}
+	return copyUpload(u), nil
+}
+
+func copyUpload(u *Upload) *Upload {
+	c := *u
+	c.Chunks = slices.Clone(u.Chunks)
+	return &c
+}
+
+func (m *Memory) AdvanceUpload(pubID string, from, to int64, chunks []string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u := m.uploadByPubID(pubID)
+	if u == nil || u.Offset != from {
+		return false, nil
+	}
+	u.Offset = to
+	u.Chunks = slices.Clone(chunks)
+	u.UpdatedAt = m.now().Unix()
+	return true, nil
+}
+
+func (m *Memory) CompleteUpload(pubID string, f *File) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u := m.uploadByPubID(pubID)
+	if u == nil || u.FilePubID != "" {
+		return false, nil
+	}
+	if err := m.insertFile(f); err != nil {
+		return false, err
+	}
+	u.FilePubID = f.PubID
+	return true, nil
+}
+
+func (m *Memory) DeleteUploadByPubID(pubID string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u := m.uploadByPubID(pubID)
+	if u == nil {
+		return false, nil
+	}
+	delete(m.uploads, u.ID)
+	return true, nil
+}
+
+func (m *Memory) GetStaleUploads(before int64, limit int) ([]*Upload, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var stale []*Upload
+	for _, id := range sortedIDs(m.uploads) {
+		if u := m.uploads[id]; u.UpdatedAt < before {
+			stale = append(stale, copyUpload(u))
+		}
+	}
+	slices.SortStableFunc(stale, func(a, b *Upload) int { return cmp.Compare(a.UpdatedAt, b.UpdatedAt) })
+	return page(stale, limit, 0), nil
+}
+
+func (m *Memory) PutBan(b *Ban) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c := *b
+	if old, ok := m.bans[b.Subject]; ok {
+		c.CreationDate = old.CreationDate
+	} else {
+		c.CreationDate = m.creationDate()
+	}
+	m.bans[b.Subject] = &c
+	return nil
+}
+
+func (m *Memory) GetBan(subject string) (*Ban, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	b, ok := m.bans[subject]
+	if !ok {
+		return nil, nil
+	}
+	c := *b
+	return &c, nil
+}
+
+func (m *Memory) ListBans() ([]*Ban, error) {
+	return m.listBans(func(*Ban) bool { return true }), nil
+}
+
+func (m *Memory) ListActiveBans(now int64) ([]*Ban, error) {
+	return m.listBans(func(b *Ban) bool { return b.Active(now) }), nil
+}
+
+func (m *Memory) listBans(match func(*Ban) bool) []*Ban {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	bans := []*Ban{}
+	for _, b := range m.bans {
+		if match(b) {
+			c := *b
+			bans = append(bans, &c)
+		}
+	}
+	slices.SortFunc(bans, func(a, b *Ban) int { return strings.Compare(a.Subject, b.Subject) })
+	return bans
+}
+
+func (m *Memory) DeleteBan(subject string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, ok := m.bans[subject]
+	delete(m.bans, subject)
+	return ok, nil
+}
+
+func (m *Memory) DeleteBansExpiredBefore(before int64) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var n int64
+	for subject, b := range m.bans {
+		if b.ExpiresAt != 0 && b.ExpiresAt < before {
+			delete(m.bans, subject)
+			n++
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,246 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+)
+
+// migration is one forward step of the schema. Released migrations are never edited,
+// changes go into a new migration with the next version.
+type migration struct {
+	version int
+	name    string
+	up      func(tx *sql.Tx) error
+}
+
+var sqliteDialect = &dialect{
+	name:   "sqlite",
+	driver: sqliteDriver,
+	// LIKE already ignores ascii case in sqlite
+	like: "LIKE",
+	jsonField: func(column, field string) string {
+		return "json_extract(" + column + ", '$." + field + "')"
+	},
+	schemaMigrationsStmt: schemaMigrationsStmt,
+	migrations:           sqliteMigrations,
+}
+
+// sqliteMigrations are applied in order, version n is sqliteMigrations[n-1].
+// postgresMigrations has to stay in step with them.
+var sqliteMigrations = []migration{
+	{1, "create files and posts", execAll(
+		// files table (id, pub_id (unique), meta (json), creation_date (timestamp), issuer, ref_view (integer), ref_dl (integer))
+		`CREATE TABLE IF NOT EXISTS files (
+				id 				INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT, 
+				pub_id 			TEXT NOT NULL UNIQUE, 
+				meta 			TEXT NOT NULL, 
+				creation_date 	TEXT DEFAULT (strftime('%s', 'now')),
+				issuer 			TEXT NOT NULL, 
+				ref_view 		INTEGER DEFAULT 0, 
+				ref_dl 			INTEGER DEFAULT 0
+				);`,
+		// posts table (id, pub_id (unique), content (json), creation_date (timestamp), issuer, ref_view (integer))
+		`CREATE TABLE IF NOT EXISTS posts (
+				id 				INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT, 
+				pub_id 			TEXT NOT NULL UNIQUE, 
+				content 		TEXT NOT NULL, 
+				creation_date 	TEXT DEFAULT (strftime('%s', 'now')), 
+				issuer 			TEXT NOT NULL, 
+				ref_view 		INTEGER DEFAULT 0
+				);`,
+	)},
+	{2, "create blobs", execAll(
+		// blobs table (hash (primary key), size (integer), refs (integer), creation_date (timestamp))
+		// refs counts the files rows sharing the content stored under hash
+		`CREATE TABLE IF NOT EXISTS blobs (
+				hash 			TEXT NOT NULL PRIMARY KEY, 
+				size 			INTEGER NOT NULL, 
+				refs 			INTEGER NOT NULL DEFAULT 0, 
+				creation_date 	TEXT DEFAULT (strftime('%s', 'now'))
+				);`,
+	)},
+	{3, "create daily_counts", execAll(
+		// daily_counts table (kind, item_id (files.id or posts.id), day (YYYY-MM-DD, utc), count (integer))
+		`CREATE TABLE IF NOT EXISTS daily_counts (
+				kind 			TEXT NOT NULL, 
+				item_id 		INTEGER NOT NULL, 
+				day 			TEXT NOT NULL, 
+				count 			INTEGER NOT NULL DEFAULT 0, 
+				PRIMARY KEY (kind, item_id, day)
+				);`,
+	)},
+	// expires_at is unix seconds, null for never; max_dl and max_view are null for unlimited
+	{4, "add expiry and limits", addColumns(
+		column{"files", "expires_at", "INTEGER"},
+		column{"files", "max_dl", "INTEGER"},
+		column{"posts", "expires_at", "INTEGER"},
+		column{"posts", "max_view", "INTEGER"},
+	)},
+	{5, "create api_keys", execAll(
+		// api_keys table (id, key_hash (sha256 hex, unique), prefix (first characters of the key, for display),
+		// issuer, creation_date (timestamp), revoked (integer, 0 or 1))
+		`CREATE TABLE IF NOT EXISTS api_keys (
+				id 				INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT, 
+				key_hash 		TEXT NOT NULL UNIQUE, 
+				prefix 			TEXT NOT NULL, 
+				issuer 			TEXT NOT NULL, 
+				creation_date 	TEXT DEFAULT (strftime('%s', 'now')), 
+				revoked 		INTEGER NOT NULL DEFAULT 0
+				);`,
+	)},
+	// disabled items are kept but not served, admin keys may use the admin api
+	{6, "add disabled and admin flags", addColumns(
+		column{"files", "disabled", "INTEGER NOT NULL DEFAULT 0"},
+		column{"posts", "disabled", "INTEGER NOT NULL DEFAULT 0"},
+		column{"api_keys", "admin", "INTEGER NOT NULL DEFAULT 0"},
+	)},
+	{7, "create uploads", execAll(
+		// uploads table (id, pub_id (unique), issuer, size (declared length), received (offset),
+		// meta (json), creation_date (timestamp), updated_at (unix seconds of the last chunk))
+		`CREATE TABLE IF NOT EXISTS uploads (
+				id 				INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT, 
+				pub_id 			TEXT NOT NULL UNIQUE, 
+				issuer 			TEXT NOT NULL, 
+				size 			INTEGER NOT NULL, 
+				received 		INTEGER NOT NULL DEFAULT 0, 
+				meta 			TEXT NOT NULL, 
+				creation_date 	TEXT DEFAULT (strftime('%s', 'now')), 
+				updated_at 		INTEGER NOT NULL
+				);`,
+		`CREATE INDEX IF NOT EXISTS uploads_updated_at ON uploads (updated_at);`,
+	)},
+	{8, "create bans", execAll(
+		// bans table (subject (client address, primary key), allow (integer, 0 or 1), reason,
+		// strikes (integer), expires_at (unix seconds, null for never), creation_date (timestamp))
+		`CREATE TABLE IF NOT EXISTS bans (
+				subject 		TEXT NOT NULL PRIMARY KEY, 
+				allow 			INTEGER NOT NULL DEFAULT 0, 
+				reason 			TEXT NOT NULL DEFAULT '', 
+				strikes 		INTEGER NOT NULL DEFAULT 0, 
+				expires_at 		INTEGER, 
+				creation_date 	TEXT DEFAULT (strftime('%s', 'now'))
+				);`,
+	)},
+	// chunks is the json array of the names of the upload's stored chunks in offset order,
+	// file_pub_id is the file a complete upload was recorded as, null until then
+	{9, "add upload chunks and file", addColumns(
+		column{"uploads", "chunks", "TEXT NOT NULL DEFAULT '[]'"},
+		column{"uploads", "file_pub_id", "TEXT"},
+	)},
+}
+
+// schema_migrations table (version (primary key), name, applied_at (timestamp))
+const schemaMigrationsStmt = `CREATE TABLE IF NOT EXISTS schema_migrations (
+				version 		INTEGER NOT NULL PRIMARY KEY, 
+				name 			TEXT NOT NULL, 
+				applied_at 		TEXT DEFAULT (strftime('%s', 'now'))
+				);`
+
+// ErrSchemaTooNew is returned when the database was migrated by a newer build than this one
+var ErrSchemaTooNew = errors.New("database schema is newer than this binary")
+
+// LatestVersion is the schema version this binary migrates to.
+func LatestVersion() int {
+	return sqliteMigrations[len(sqliteMigrations)-1].version
+}
+
+// Migrate applies the pending migrations in a single transaction and returns their names.
+// With dryRun the migrations are still run, so broken ones fail, but rolled back.
+// Databases created before versioning have no schema_migrations table; every migration
+// tolerates the tables and columns already being there, so they start from version 0.
+func (s *SQLStore) Migrate(dryRun bool) ([]string, error) {
+	loclog := "[db.Migrate]"
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if s.d.lockStmt != "" {
+		_, err = tx.Exec(s.d.lockStmt)
+		if err != nil {
+			return nil, err
+		}
+	}
+	_, err = tx.Exec(s.d.schemaMigrationsStmt)
+	if err != nil {
+		return nil, err
+	}
+	var current int
+	err = tx.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&current)
+	if err != nil {
+		return nil, err
+	}
+	if current > LatestVersion() {
+		return nil, fmt.Errorf("%w: database is at version %d, binary knows up to %d", ErrSchemaTooNew, current, LatestVersion())
+	}
+
+	var applied []string
+	for _, m := range s.d.migrations[current:] {
+		err = m.up(tx.Tx)
+		if err != nil {
+			return nil, fmt.Errorf("migration %d (%s): %w", m.version, m.name, err)
+		}
+		_, err = tx.Exec("INSERT INTO schema_migrations (version, name) VALUES (?, ?)", m.version, m.name)
+		if err != nil {
+			return nil, err
+		}
+		applied = append(applied, fmt.Sprintf("%d %s", m.version, m.name))
+		slog.Info(loclog, "info", "migration applied", "db", s.d.name, "version", m.version, "name", m.name, "dry_run", dryRun)
+	}
+	if dryRun {
+		return applied, nil
+	}
+	return applied, tx.Commit()
+}
+
+func execAll(stmts ...string) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		for _, stmt := range stmts {
+			_, err := tx.Exec(stmt)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+type column struct{ table, name, def string }
+
+func addColumns(cols ...column) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		for _, c := range cols {
+			err := addColumn(tx, c.table, c.name, c.def)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// addColumn adds a column to a table unless the table already has it.
+func addColumn(tx *sql.Tx, table, column, def string) error {
+	rows, err := tx.Query("SELECT name FROM pragma_table_info(?)", table)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		if err = rows.Scan(&name); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	_, err = tx.Exec("ALTER TABLE " + table + " ADD COLUMN " + column + " " + def)
+	return err
+}
@@ -0,0 +1,82 @@
+package db
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestMigrateLegacyDB(t *testing.T) {
+	// Setup temporary database with the schema from before versioning
+	s, err := OpenSQLite(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer s.Close()
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		t.Fatalf("Failed to begin: %v", err)
+	}
+	err = sqliteMigrations[0].up(tx.Tx)
+	if err == nil {
+		_, err = tx.Exec(`INSERT INTO files (pub_id, meta, issuer) VALUES ('old', '{"original_name":"old.txt"}', 'tester')`)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		t.Fatalf("Failed to create legacy schema: %v", err)
+	}
+
+	pending, err := s.Migrate(true)
+	if err != nil {
+		t.Fatalf("Failed to dry run migrations: %v", err)
+	}
+	if len(pending) != len(sqliteMigrations) {
+		t.Errorf("Expected %d pending migrations, got %v", len(sqliteMigrations), pending)
+	}
+	var n int
+	err = s.db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE name = 'schema_migrations'").Scan(&n)
+	if err != nil || n != 0 {
+		t.Errorf("Expected dry run to leave no schema_migrations table, got %d, %v", n, err)
+	}
+
+	applied, err := s.Migrate(false)
+	if err != nil {
+		t.Fatalf("Failed to migrate: %v", err)
+	}
+	if len(applied) != len(sqliteMigrations) {
+		t.Errorf("Expected %d applied migrations, got %v", len(sqliteMigrations), applied)
+	}
+	f, err := s.GetFileByPubID("old")
+	if err != nil || f == nil {
+		t.Fatalf("Failed to get legacy file after migrating: %v", err)
+	}
+	if f.Meta.OriginalName != "old.txt" || f.Disabled || f.ExpiresAt != 0 {
+		t.Errorf("Unexpected legacy file after migrating: %+v", f)
+	}
+
+	applied, err = s.Migrate(false)
+	if err != nil || len(applied) != 0 {
+		t.Errorf("Expected nothing to apply on a current database, got %v, %v", applied, err)
+	}
+}
+
+func TestMigrateTooNew(t *testing.T) {
+	// Setup temporary database
+	tmpDB := filepath.Join(t.TempDir(), "test.db")
+
+	// Initialize DB
+	s := InitDB("", tmpDB)
+	defer s.Close()
+
+	_, err := s.db.Exec("INSERT INTO schema_migrations (version, name) VALUES (?, 'from the future')", LatestVersion()+1)
+	if err != nil {
+		t.Fatalf("Failed to insert migration: %v", err)
+	}
+	_, err = s.Migrate(false)
+	if !errors.Is(err, ErrSchemaTooNew) {
+		t.Errorf("Expected ErrSchemaTooNew, got %v", err)
+	}
+}
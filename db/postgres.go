@@ -0,0 +1,112 @@
+package db
+
+import (
+	_ "github.com/jackc/pgx/v5/stdlib"
+)
+
+// pgNow is the creation_date default, unix seconds as text like sqlite's strftime('%s', 'now')
+const pgNow = "(extract(epoch from now())::bigint::text)"
+
+var postgresDialect = &dialect{
+	name:     "postgres",
+	driver:   "pgx",
+	numbered: true,
+	like:     "ILIKE",
+	jsonField: func(column, field string) string {
+		return "(" + column + "::jsonb ->> '" + field + "')"
+	},
+	// replicas starting together wait for the first one to finish migrating
+	lockStmt: "SELECT pg_advisory_xact_lock(4242001)",
+	schemaMigrationsStmt: `CREATE TABLE IF NOT EXISTS schema_migrations (
+				version 		INTEGER NOT NULL PRIMARY KEY, 
+				name 			TEXT NOT NULL, 
+				applied_at 		TEXT DEFAULT ` + pgNow + `
+				);`,
+	migrations: postgresMigrations,
+}
+
+// postgresMigrations mirror sqliteMigrations version for version.
+// sqlite INTEGER columns are 64 bit, so they are BIGINT here.
+var postgresMigrations = []migration{
+	{1, "create files and posts", execAll(
+		`CREATE TABLE IF NOT EXISTS files (
+				id 				BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY, 
+				pub_id 			TEXT NOT NULL UNIQUE, 
+				meta 			TEXT NOT NULL, 
+				creation_date 	TEXT DEFAULT `+pgNow+`,
+				issuer 			TEXT NOT NULL, 
+				ref_view 		BIGINT DEFAULT 0, 
+				ref_dl 			BIGINT DEFAULT 0
+				);`,
+		`CREATE TABLE IF NOT EXISTS posts (
+				id 				BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY, 
+				pub_id 			TEXT NOT NULL UNIQUE, 
+				content 		TEXT NOT NULL, 
+				creation_date 	TEXT DEFAULT `+pgNow+`, 
+				issuer 			TEXT NOT NULL, 
+				ref_view 		BIGINT DEFAULT 0
+				);`,
+	)},
+	{2, "create blobs", execAll(
+		`CREATE TABLE IF NOT EXISTS blobs (
+				hash 			TEXT NOT NULL PRIMARY KEY, 
+				size 			BIGINT NOT NULL, 
+				refs 			BIGINT NOT NULL DEFAULT 0, 
+				creation_date 	TEXT DEFAULT ` + pgNow + `
+				);`,
+	)},
+	{3, "create daily_counts", execAll(
+		`CREATE TABLE IF NOT EXISTS daily_counts (
+				kind 			TEXT NOT NULL, 
+				item_id 		BIGINT NOT NULL, 
+				day 			TEXT NOT NULL, 
+				count 			BIGINT NOT NULL DEFAULT 0, 
+				PRIMARY KEY (kind, item_id, day)
+				);`,
+	)},
+	{4, "add expiry and limits", execAll(
+		`ALTER TABLE files ADD COLUMN IF NOT EXISTS expires_at BIGINT, ADD COLUMN IF NOT EXISTS max_dl BIGINT;`,
+		`ALTER TABLE posts ADD COLUMN IF NOT EXISTS expires_at BIGINT, ADD COLUMN IF NOT EXISTS max_view BIGINT;`,
+	)},
+	{5, "create api_keys", execAll(
+		`CREATE TABLE IF NOT EXISTS api_keys (
+				id 				BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY, 
+				key_hash 		TEXT NOT NULL UNIQUE, 
+				prefix 			TEXT NOT NULL, 
+				issuer 			TEXT NOT NULL, 
+				creation_date 	TEXT DEFAULT ` + pgNow + `, 
+				revoked 		BIGINT NOT NULL DEFAULT 0
+				);`,
+	)},
+	{6, "add disabled and admin flags", execAll(
+		`ALTER TABLE files ADD COLUMN IF NOT EXISTS disabled BIGINT NOT NULL DEFAULT 0;`,
+		`ALTER TABLE posts ADD COLUMN IF NOT EXISTS disabled BIGINT NOT NULL DEFAULT 0;`,
+		`ALTER TABLE api_keys ADD COLUMN IF NOT EXISTS admin BIGINT NOT NULL DEFAULT 0;`,
+	)},
+	{7, "create uploads", execAll(
+		`CREATE TABLE IF NOT EXISTS uploads (
+				id 				BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY, 
+				pub_id 			TEXT NOT NULL UNIQUE, 
+				issuer 			TEXT NOT NULL, 
+				size 			BIGINT NOT NULL, 
+				received 		BIGINT NOT NULL DEFAULT 0, 
+				meta 			TEXT NOT NULL, 
+				creation_date 	TEXT DEFAULT `+pgNow+`, 
+				updated_at 		BIGINT NOT NULL
+				);`,
+		`CREATE INDEX IF NOT EXISTS uploads_updated_at ON uploads (updated_at);`,
+	)},
+	{8, "create bans", execAll(
+		`CREATE TABLE IF NOT EXISTS bans (
+				subject 		TEXT NOT NULL PRIMARY KEY, 
+				allow 			BIGINT NOT NULL DEFAULT 0, 
+				reason 			TEXT NOT NULL DEFAULT '', 
+				strikes 		BIGINT NOT NULL DEFAULT 0, 
+				expires_at 		BIGINT, 
+				creation_date 	TEXT DEFAULT ` + pgNow + `
+				);`,
+	)},
+	{9, "add upload chunks and file", execAll(
+		`ALTER TABLE uploads ADD COLUMN IF NOT EXISTS chunks TEXT NOT NULL DEFAULT '[]', ADD COLUMN IF NOT EXISTS file_pub_id TEXT;`,
+	)},
+}
@@ -0,0 +1,100 @@
+package db
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"net/url"
+	"os"
+	"testing"
+)
+
+// openTestPostgres returns a migrated store in a fresh schema of the database at TEST_POSTGRES_DSN,
+// which testpostgres.sh starts. The test is skipped when it is not set, and fails in CI so postgres
+// can't go untested there. The schema is dropped when the test ends.
+func openTestPostgres(t *testing.T) *SQLStore {
+	t.Helper()
+	dsn := os.Getenv("TEST_POSTGRES_DSN")
+	if dsn == "" {
+		if os.Getenv("CI") != "" {
+			t.Fatalf("TEST_POSTGRES_DSN not set in CI, run the tests with testpostgres.sh")
+		}
+		t.Skip("TEST_POSTGRES_DSN not set")
+	}
+	b := make([]byte, 6)
+	rand.Read(b)
+	schema := "test_" + hex.EncodeToString(b)
+
+	admin, err := sql.Open("pgx", dsn)
+	if err != nil {
+		t.Fatalf("Failed to connect to postgres: %v", err)
+	}
+	_, err = admin.Exec("CREATE SCHEMA " + schema)
+	if err != nil {
+		t.Fatalf("Failed to create schema: %v", err)
+	}
+	t.Cleanup(func() {
+		admin.Exec("DROP SCHEMA " + schema + " CASCADE")
+		admin.Close()
+	})
+
+	// unknown connection string parameters are sent to the server as settings
+	if u, err := url.Parse(dsn); err == nil && (u.Scheme == "postgres" || u.Scheme == "postgresql") {
+		q := u.Query()
+		q.Set("search_path", schema)
+		u.RawQuery = q.Encode()
+		dsn = u.String()
+	} else {
+		dsn += " search_path=" + schema
+	}
+	s, err := OpenPostgres(dsn)
+	if err != nil {
+		t.Fatalf("Failed to open postgres: %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	_, err = s.Migrate(false)
+	if err != nil {
+		t.Fatalf("Failed to migrate postgres: %v", err)
+	}
+	return s
+}
+
+func TestPostgresMigrationsInStep(t *testing.T) {
+	if len(postgresMigrations) != len(sqliteMigrations) {
+		t.Fatalf("Expected %d postgres migrations, got %d", len(sqliteMigrations), len(postgresMigrations))
+	}
+	for i, m := range postgresMigrations {
+		if m.version != i+1 || m.version != sqliteMigrations[i].version || m.name != sqliteMigrations[i].name {
+			t.Errorf("Postgres migration %d (%s) does not match sqlite migration %d (%s)",
+				m.version, m.name, sqliteMigrations[i].version, sqliteMigrations[i].name)
+		}
+	}
+}
+
+func TestRebind(t *testing.T) {
+	got := postgresDialect.rebind(`SELECT a FROM t WHERE b LIKE ? ESCAPE '\' AND c = '?' AND d IN (?, ?)`)
+	want := `SELECT a FROM t WHERE b LIKE $1 ESCAPE '\' AND c = '?' AND d IN ($2, $3)`
+	if got != want {
+		t.Errorf("Expected %s, got %s", want, got)
+	}
+	if q := "SELECT ?"; sqliteDialect.rebind(q) != q {
+		t.Errorf("Expected sqlite queries to be left alone, got %s", sqliteDialect.rebind(q))
+	}
+}
+
+func TestPostgresMigrate(t *testing.T) {
+	s := openTestPostgres(t)
+	applied, err := s.Migrate(false)
+	if err != nil || len(applied) != 0 {
+		t.Errorf("Expected nothing to apply on a current database, got %v, %v", applied, err)
+	}
+	_, err = s.db.Exec("INSERT INTO schema_migrations (version, name) VALUES (?, 'from the future')", LatestVersion()+1)
+	if err != nil {
+		t.Fatalf("Failed to insert migration: %v", err)
+	}
+	_, err = s.Migrate(false)
+	if !errors.Is(err, ErrSchemaTooNew) {
+		t.Errorf("Expected ErrSchemaTooNew, got %v", err)
+	}
+}
@@ -0,0 +1,18 @@
+//go:build cgo && !puresqlite
+
+package db
+
+import (
+	"strconv"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// sqliteDriver is mattn/go-sqlite3 when cgo is available, build with -tags puresqlite
+// or CGO_ENABLED=0 for the pure go driver
+const sqliteDriver = "sqlite3"
+
+// sqliteDSN sets sqliteBusyTimeout on every connection the pool opens
+func sqliteDSN(path string) string {
+	return sqliteParam(path, "_busy_timeout="+strconv.Itoa(sqliteBusyTimeout))
+}
@@ -0,0 +1,18 @@
+//go:build !cgo || puresqlite
+
+package db
+
+import (
+	"strconv"
+
+	_ "modernc.org/sqlite"
+)
+
+// sqliteDriver is modernc.org/sqlite, which needs no c toolchain, for static and cross compiled builds
+const sqliteDriver = "sqlite"
+
+// sqliteDSN sets sqliteBusyTimeout on every connection the pool opens,
+// this driver does not wait on a locked database by default
+func sqliteDSN(path string) string {
+	return sqliteParam(path, "_pragma=busy_timeout("+strconv.Itoa(sqliteBusyTimeout)+")")
+}
@@ -0,0 +1,18 @@
+//go:build !cgo || puresqlite
+
+package db
+
+import "testing"
+
+func TestSQLiteDSN(t *testing.T) {
+	for path, want := range map[string]string{
+		"test.db":               "test.db?_pragma=busy_timeout(5000)",
+		"test.db?cache=shared":  "test.db?cache=shared&_pragma=busy_timeout(5000)",
+		"file:test.db?mode=rwc": "file:test.db?mode=rwc&_pragma=busy_timeout(5000)",
+		"file:test.db":          "file:test.db?_pragma=busy_timeout(5000)",
+	} {
+		if got := sqliteDSN(path); got != want {
+			t.Errorf("Expected %q for %q, got %q", want, path, got)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package db
+
+// Store is everything the server keeps in its database.
+// Lookups return nil and no error when nothing matches.
+type Store interface {
+	FileStore
+	PostStore
+	BlobRefStore
+	CountStore
+	KeyStore
+	UploadStore
+	BanStore
+	Close() error
+}
+
+type FileStore interface {
+	// InsertFile stores f and sets its ID
+	InsertFile(f *File) error
+	GetFileByPubID(pubID string) (*File, error)
+	GetFileByID(id int64) (*File, error)
+	// DeleteFileByPubID removes the file and its history and releases its blob with hash, as
+	// BlobRefStore.ReleaseBlob does, all or nothing. An empty hash leaves the blob alone.
+	// Returns false if no file had that pub id, the blob is not released then.
+	DeleteFileByPubID(pubID, hash string, remove func() error) (bool, error)
+	GetFileEntries() (int64, error)
+	// GetGoneFiles returns up to limit files that expired by now (unix seconds) or reached their download limit
+	GetGoneFiles(now int64, limit int) ([]*File, error)
+	// ListFiles returns a page of files, newest first, matching q, and the number of matching files
+	ListFiles(q string, limit, offset int) ([]*File, int64, error)
+	SetFileExpiry(pubID string, expiresAt int64) (bool, error)
+	SetFileDisabled(pubID string, disabled bool) (bool, error)
+	RotateFilePubID(pubID, newPubID string) (bool, error)
+}
+
+type PostStore interface {
+	// InsertPost stores p and sets its ID
+	InsertPost(p *Post) error
+	GetPostByPubID(pubID string) (*Post, error)
+	GetPostEntries() (int64, error)
+	// DeleteGonePosts deletes the posts that expired by now or reached their view limit and returns how many
+	DeleteGonePosts(now int64) (int64, error)
+	// ListPosts returns a page of posts, newest first, matching q, and the number of matching posts
+	ListPosts(q string, limit, offset int) ([]*Post, int64, error)
+	SetPostExpiry(pubID string, expiresAt int64) (bool, error)
+	SetPostDisabled(pubID string, disabled bool) (bool, error)
+	RotatePostPubID(pubID, newPubID string) (bool, error)
+	DeletePostByPubID(pubID string) (bool, error)
+}
+
+// BlobRefStore counts the files sharing each stored blob
+type BlobRefStore interface {
+	// AcquireBlob returns the reference count after adding one, 1 means the blob is new
+	AcquireBlob(hash string, size int64) (int64, error)
+	// ReleaseBlob returns the reference count left. When it drops to 0, remove deletes the content
+	// before the release is committed, with acquiring the blob blocked until then.
+	// The release is undone when remove fails.
+	ReleaseBlob(hash string, remove func() error) (int64, error)
+}
+
+type CountStore interface {
+	// ApplyCounts adds the deltas to the totals and the daily history, all or nothing
+	ApplyCounts(deltas []CountDelta) error
+	// ReserveCount adds one download or view to an item and its history of day, unless the item reached
+	// its limit (max_dl or max_views), and returns whether it did. It is written at once, not buffered.
+	ReserveCount(kind string, itemID int64, day string) (bool, error)
+	// GetDailyCounts returns the history of a counter from since (YYYY-MM-DD) on, oldest first
+	GetDailyCounts(kind string, itemID int64, since string) ([]DailyCount, error)
+}
+
+type KeyStore interface {
+	// InsertAPIKey stores k and sets its ID
+	InsertAPIKey(k *APIKey) error
+	// GetAPIKeyByHash returns the key with that hash, revoked or not
+	GetAPIKeyByHash(keyHash string) (*APIKey, error)
+	ListAPIKeys() ([]*APIKey, error)
+	// RevokeAPIKeys revokes the keys with the given prefix and returns how many were revoked
+	RevokeAPIKeys(prefix string) (int64, error)
+}
+
+// UploadStore keeps the resumable uploads in progress
+type UploadStore interface {
+	// InsertUpload stores u and sets its ID
+	InsertUpload(u *Upload) error
+	GetUploadByPubID(pubID string) (*Upload, error)
+	// AdvanceUpload moves the offset from from to to and records chunks as the upload's chunks,
+	// false if the offset was not from
+	AdvanceUpload(pubID string, from, to int64, chunks []string) (bool, error)
+	// CompleteUpload inserts f, setting its ID, and records it as the file the upload became, all or nothing.
+	// Returns false without inserting f if the upload is gone or already complete.
+	CompleteUpload(pubID string, f *File) (bool, error)
+	DeleteUploadByPubID(pubID string) (bool, error)
+	// GetStaleUploads returns up to limit uploads that received nothing since before (unix seconds)
+	GetStaleUploads(before int64, limit int) ([]*Upload, error)
+}
+
+// BanStore keeps the ban and allow list, by client address
+type BanStore interface {
+	// PutBan stores b, replacing the entry for the same subject
+	PutBan(b *Ban) error
+	GetBan(subject string) (*Ban, error)
+	// ListBans returns every entry, expired ones included
+	ListBans() ([]*Ban, error)
+	// ListActiveBans returns the entries still applying at now (unix seconds)
+	ListActiveBans(now int64) ([]*Ban, error)
+	DeleteBan(subject string) (bool, error)
+	// DeleteBansExpiredBefore forgets the entries that expired before before (unix seconds)
+	DeleteBansExpiredBefore(before int64) (int64, error)
+}
+
+var (
+	_ Store = (*SQLStore)(nil)
+	_ Store = (*Memory)(nil)
+)
@@ -0,0 +1,194 @@
+package db
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log/slog"
+	"time"
+)
+
+// UploadMeta is stored as json in the uploads meta column, it is what the file is recorded with once complete
+type UploadMeta struct {
+	OriginalName string `json:"original_name"`
+	// FileType is the type the client declared, used when sniffing the content tells nothing better
+	FileType string `json:"file_type,omitempty"`
+	// ExpiresIn is seconds from completion, 0 for never
+	ExpiresIn int64 `json:"expires_in,omitempty"`
+	MaxDL     int64 `json:"max_dl,omitempty"`
+}
+
+// Upload is a resumable upload in progress, it becomes a file once Offset reaches Length
+type Upload struct {
+	ID           int64
+	PubID        string
+	Issuer       string
+	Length       int64
+	Offset       int64
+	Meta         UploadMeta
+	CreationDate string
+	// UpdatedAt is unix seconds of the last received chunk
+	UpdatedAt int64
+	// Chunks names the stored chunks, in offset order, that make up the Offset bytes received
+	Chunks []string
+	// FilePubID is the file the upload was recorded as once complete, empty until then
+	FilePubID string
+}
+
+func (s *SQLStore) InsertUpload(u *Upload) error {
+	loclog := "[db.InsertUpload]"
+	jsonMeta, err := json.Marshal(u.Meta)
+	if err != nil {
+		slog.Error(loclog, "SEVERE", "failed to marshal upload meta", "error", err.Error())
+		return err
+	}
+	u.UpdatedAt = time.Now().Unix()
+	err = s.db.QueryRow("INSERT INTO uploads (pub_id, issuer, size, received, meta, updated_at) VALUES (?, ?, ?, ?, ?, ?) RETURNING id",
+		u.PubID, u.Issuer, u.Length, u.Offset, string(jsonMeta), u.UpdatedAt).Scan(&u.ID)
+	if err != nil {
+		slog.Error(loclog, "SEVERE", "failed to insert upload", "error", err.Error(), "pub_id", u.PubID)
+		return err
+	}
+	slog.Info(loclog, "info", "upload inserted", "pub_id", u.PubID, "length", u.Length, "issuer", u.Issuer)
+	return nil
+}
+
+const uploadColumns = "id, pub_id, issuer, size, received, meta, creation_date, updated_at, chunks, file_pub_id"
+
+func scanUpload(row scanner) (*Upload, error) {
+	var u Upload
+	var jsonMeta, jsonChunks string
+	var filePubID sql.NullString
+	err := row.Scan(&u.ID, &u.PubID, &u.Issuer, &u.Length, &u.Offset, &jsonMeta, &u.CreationDate, &u.UpdatedAt, &jsonChunks, &filePubID)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal([]byte(jsonMeta), &u.Meta)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal([]byte(jsonChunks), &u.Chunks)
+	if err != nil {
+		return nil, err
+	}
+	u.FilePubID = filePubID.String
+	return &u, nil
+}
+
+func (s *SQLStore) GetUploadByPubID(pubID string) (*Upload, error) {
+	loclog := "[db.GetUploadByPubID]"
+	u, err := scanUpload(s.db.QueryRow("SELECT "+uploadColumns+" FROM uploads WHERE pub_id = ?", pubID))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		slog.Error(loclog, "SEVERE", "failed to scan upload", "error", err.Error(), "pub_id", pubID)
+		return nil, err
+	}
+	return u, nil
+}
+
+// AdvanceUpload moves the upload's offset from from to to, records chunks as its chunks and marks it
+// as updated now. The chunks only change along with the offset, so the condition on it keeps them in step.
+// Returns false if the upload is gone or its offset is no longer from.
+func (s *SQLStore) AdvanceUpload(pubID string, from, to int64, chunks []string) (bool, error) {
+	loclog := "[db.AdvanceUpload]"
+	jsonChunks, err := json.Marshal(chunks)
+	if err != nil {
+		slog.Error(loclog, "SEVERE", "failed to marshal upload chunks", "error", err.Error(), "pub_id", pubID)
+		return false, err
+	}
+	result, err := s.db.Exec("UPDATE uploads SET received = ?, chunks = ?, updated_at = ? WHERE pub_id = ? AND received = ?",
+		to, string(jsonChunks), time.Now().Unix(), pubID, from)
+	if err != nil {
+		slog.Error(loclog, "SEVERE", "failed to advance upload", "error", err.Error(), "pub_id", pubID)
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		slog.Error(loclog, "SEVERE", "failed to get rows affected", "error", err.Error(), "pub_id", pubID)
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// CompleteUpload inserts f and records its pub id on the upload in one transaction, so an upload
+// is never recorded as two files. Returns false, inserting nothing, if the upload is gone or already complete.
+func (s *SQLStore) CompleteUpload(pubID string, f *File) (bool, error) {
+	loclog := "[db.CompleteUpload]"
+	jsonMeta, err := json.Marshal(f.Meta)
+	if err != nil {
+		slog.Error(loclog, "SEVERE", "failed to marshal file meta", "error", err.Error(), "pub_id", f.PubID)
+		return false, err
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		slog.Error(loclog, "SEVERE", "failed to begin transaction", "error", err.Error(), "upload_id", pubID)
+		return false, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("UPDATE uploads SET file_pub_id = ? WHERE pub_id = ? AND file_pub_id IS NULL", f.PubID, pubID)
+	if err != nil {
+		slog.Error(loclog, "SEVERE", "failed to record upload file", "error", err.Error(), "upload_id", pubID)
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		slog.Error(loclog, "SEVERE", "failed to get rows affected", "error", err.Error(), "upload_id", pubID)
+		return false, err
+	}
+	if n == 0 {
+		return false, nil
+	}
+	err = tx.QueryRow(insertFileStmt,
+		f.PubID, string(jsonMeta), f.Issuer, nullZero(f.ExpiresAt), nullZero(f.MaxDL)).Scan(&f.ID)
+	if err != nil {
+		slog.Error(loclog, "SEVERE", "failed to insert file in files table", "error", err.Error(), "pub_id", f.PubID, "upload_id", pubID)
+		return false, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		slog.Error(loclog, "SEVERE", "failed to commit transaction", "error", err.Error(), "upload_id", pubID)
+		return false, err
+	}
+	slog.Info(loclog, "info", "upload recorded as file", "pub_id", f.PubID, "upload_id", pubID)
+	return true, nil
+}
+
+func (s *SQLStore) DeleteUploadByPubID(pubID string) (bool, error) {
+	loclog := "[db.DeleteUploadByPubID]"
+	result, err := s.db.Exec("DELETE FROM uploads WHERE pub_id = ?", pubID)
+	if err != nil {
+		slog.Error(loclog, "SEVERE", "failed to delete upload", "error", err.Error(), "pub_id", pubID)
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		slog.Error(loclog, "SEVERE", "failed to get rows affected", "error", err.Error(), "pub_id", pubID)
+		return false, err
+	}
+	slog.Info(loclog, "info", "upload deleted from uploads table", "pub_id", pubID, "deleted", n > 0)
+	return n > 0, nil
+}
+
+// GetStaleUploads returns up to limit uploads, oldest first, that received nothing since before (unix seconds)
+func (s *SQLStore) GetStaleUploads(before int64, limit int) ([]*Upload, error) {
+	loclog := "[db.GetStaleUploads]"
+	rows, err := s.db.Query("SELECT "+uploadColumns+" FROM uploads WHERE updated_at < ? ORDER BY updated_at LIMIT ?", before, limit)
+	if err != nil {
+		slog.Error(loclog, "SEVERE", "failed to query stale uploads", "error", err.Error())
+		return nil, err
+	}
+	defer rows.Close()
+
+	var uploads []*Upload
+	for rows.Next() {
+		u, err := scanUpload(rows)
+		if err != nil {
+			slog.Error(loclog, "SEVERE", "failed to scan upload", "error", err.Error())
+			return nil, err
+		}
+		uploads = append(uploads, u)
+	}
+	return uploads, rows.Err()
+}
@@ -1,8 +1,11 @@
 package env
 
 import (
+	"errors"
+	"io/fs"
 	"log/slog"
 	"os"
+	"sync"
 
 	"github.com/joho/godotenv"
 )
@@ -13,48 +16,138 @@ func (key EnvKey) Get() string {
 	return os.Getenv(string(key))
 }
 
+// fromFile holds the variables set from .env, the ones ReloadEnv may change
+var (
+	fromFile   = make(map[string]bool)
+	fromFileMu sync.Mutex
+)
+
+// LoadEnv sets the variables of the .env file in the working directory, if there is one,
+// that are not set already. See config for how they are read.
 func LoadEnv() {
 	loclog := "[env.LoadEnv]"
-	err := godotenv.Load()
+	err := setFromFile()
+	if errors.Is(err, fs.ErrNotExist) {
+		slog.Info(loclog, "info", "no .env file, using the environment as is")
+		return
+	}
 	if err != nil {
 		slog.Error(loclog, "FATAL", "error loading .env file", "error", err.Error())
 		os.Exit(1)
 	}
 	slog.Info(loclog, "info", ".env loaded")
+}
 
-	// log
-	vars := []EnvKey{
-		DevHost,
-		DevPort,
-		Host,
-		Port,
-		DevMode,
-		TLSCertPath,
-		TLSKeyPath,
-		AllowedOrigins,
-		AllowedMethods,
-		DBPath,
-		HealthCheckToken,
-		RateLimit,
-		RateBurst,
+// ReloadEnv reads .env again, variables that did not come from it are left as they are.
+func ReloadEnv() error {
+	err := setFromFile()
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+func setFromFile() error {
+	fromFileMu.Lock()
+	defer fromFileMu.Unlock()
+	values, err := godotenv.Read()
+	if errors.Is(err, fs.ErrNotExist) {
+		values = nil
+	} else if err != nil {
+		return err
+	}
+	for key := range fromFile {
+		if _, ok := values[key]; !ok {
+			os.Unsetenv(key)
+			delete(fromFile, key)
+		}
+	}
+	for key, v := range values {
+		if _, set := os.LookupEnv(key); set && !fromFile[key] {
+			continue
+		}
+		os.Setenv(key, v)
+		fromFile[key] = true
 	}
-	for _, v := range vars {
-		slog.Info(loclog, "info", "envvar", "key", v, "value", v.Get())
+	if values == nil {
+		return fs.ErrNotExist
 	}
+	return nil
 }
 
 const (
-	DevHost          EnvKey = "DEV_HOST"
-	DevPort          EnvKey = "DEV_PORT"
-	Host             EnvKey = "HOST"
-	Port             EnvKey = "PORT"
-	DevMode          EnvKey = "DEV"
-	TLSCertPath      EnvKey = "TLS_CERT_PATH"
-	TLSKeyPath       EnvKey = "TLS_KEY_PATH"
-	AllowedOrigins   EnvKey = "ALLOWED_ORIGINS"
-	AllowedMethods   EnvKey = "ALLOWED_METHODS"
-	DBPath           EnvKey = "DB_PATH"
+	// ConfigFile names a toml file with settings, see config.Loader
+	ConfigFile     EnvKey = "CONFIG_FILE"
+	DevHost        EnvKey = "DEV_HOST"
+	DevPort        EnvKey = "DEV_PORT"
+	Host           EnvKey = "HOST"
+	Port           EnvKey = "PORT"
+	DevMode        EnvKey = "DEV"
+	TLSCertPath    EnvKey = "TLS_CERT_PATH"
+	TLSKeyPath     EnvKey = "TLS_KEY_PATH"
+	AllowedOrigins EnvKey = "ALLOWED_ORIGINS"
+	AllowedMethods EnvKey = "ALLOWED_METHODS"
+	DBPath         EnvKey = "DB_PATH"
+	// DBDSN is a postgres connection string, when set it is used instead of the sqlite file at DB_PATH.
+	// DBDSN, HealthCheckToken, RedisURL and S3SecretKey are secrets, they are never logged and can be
+	// read from the file named by the same variable with a _FILE suffix, e.g. HC_TOKEN_FILE.
+	DBDSN            EnvKey = "DB_DSN"
 	HealthCheckToken EnvKey = "HC_TOKEN"
 	RateLimit        EnvKey = "RATE_LIMIT"
 	RateBurst        EnvKey = "RATE_BURST"
+	BlobBackend      EnvKey = "BLOB_BACKEND"
+	BlobPath         EnvKey = "BLOB_PATH"
+	S3Endpoint       EnvKey = "S3_ENDPOINT"
+	S3Bucket         EnvKey = "S3_BUCKET"
+	S3Region         EnvKey = "S3_REGION"
+	S3AccessKey      EnvKey = "S3_ACCESS_KEY"
+	S3SecretKey      EnvKey = "S3_SECRET_KEY"
+	S3UseSSL         EnvKey = "S3_USE_SSL"
+	// TrustedProxies are the CIDRs and addresses of the reverse proxies whose forwarding header
+	// (see TrustedProxyHeader) is believed, comma separated, "private" for loopback and private networks.
+	// Unset, the client is always the connection's address.
+	TrustedProxies EnvKey = "TRUSTED_PROXIES"
+	// TrustedProxyHeader is the forwarding header the trusted proxies write, "forwarded", "x-forwarded-for"
+	// or "x-real-ip", unset for x-forwarded-for. The others are ignored, a proxy passes them on from the client.
+	TrustedProxyHeader EnvKey = "TRUSTED_PROXY_HEADER"
+	// RatePolicies overrides RATE_LIMIT/RATE_BURST per route and api key,
+	// e.g. "POST /api/v1/send=5/m; /health=unlimited; admin=unlimited" (see ratelimiter.ParseRules)
+	RatePolicies EnvKey = "RATE_POLICIES"
+	// Anonymous clients are limited per network of these prefix lengths, unset for /32 and /64
+	RateIPv4Prefix EnvKey = "RATE_IPV4_PREFIX"
+	RateIPv6Prefix EnvKey = "RATE_IPV6_PREFIX"
+	// RateMaxVisitors caps the rate limit buckets kept in memory, the least recently seen are evicted (default 100000)
+	RateMaxVisitors EnvKey = "RATE_MAX_VISITORS"
+	// RedisURL (redis://host:port/db) keeps the rate limits in redis, shared by every instance using it
+	RedisURL EnvKey = "REDIS_URL"
+	// Download byte rates such as "512K" or "10M" per second (see ratelimiter.ParseByteRate), unset for unlimited.
+	// BandwidthLimit is shared by all downloads, the others apply to each ip or api key.
+	BandwidthLimit  EnvKey = "BANDWIDTH_LIMIT"
+	BandwidthPerIP  EnvKey = "BANDWIDTH_PER_IP"
+	BandwidthPerKey EnvKey = "BANDWIDTH_PER_KEY"
+	// MaxConcurrentDownloads is how many downloads one ip or api key may run at once, unset for unlimited
+	MaxConcurrentDownloads EnvKey = "MAX_CONCURRENT_DOWNLOADS"
+	// An ip answered 429 BAN_MAX_REFUSED times or 404 BAN_MAX_NOT_FOUND times within BAN_WINDOW is banned,
+	// first for BAN_DURATION, then twice as long each time up to BAN_MAX_DURATION. Counts of 0 turn that check off.
+	BanMaxRefused  EnvKey = "BAN_MAX_REFUSED"
+	BanMaxNotFound EnvKey = "BAN_MAX_NOT_FOUND"
+	BanWindow      EnvKey = "BAN_WINDOW"
+	BanDuration    EnvKey = "BAN_DURATION"
+	BanMaxDuration EnvKey = "BAN_MAX_DURATION"
+	// CounterFlushInterval is a go duration, e.g. "10s"
+	CounterFlushInterval EnvKey = "COUNTER_FLUSH_INTERVAL"
+	// ReaperInterval is a go duration, how often expired files and posts are deleted
+	ReaperInterval EnvKey = "REAPER_INTERVAL"
+	// UploadTTL is a go duration, how long an unfinished resumable upload is kept after its last chunk
+	UploadTTL EnvKey = "UPLOAD_TTL"
+	// Server timeouts are go durations. Reading a request's headers may take READ_HEADER_TIMEOUT, the whole
+	// request READ_TIMEOUT and writing the response WRITE_TIMEOUT, except for uploads and downloads, which
+	// may take TRANSFER_TIMEOUT. Idle keep-alive connections are closed after IDLE_TIMEOUT.
+	ReadHeaderTimeout EnvKey = "READ_HEADER_TIMEOUT"
+	ReadTimeout       EnvKey = "READ_TIMEOUT"
+	WriteTimeout      EnvKey = "WRITE_TIMEOUT"
+	IdleTimeout       EnvKey = "IDLE_TIMEOUT"
+	TransferTimeout   EnvKey = "TRANSFER_TIMEOUT"
+	// ShutdownTimeout is how long running requests are given to finish on SIGTERM or SIGINT
+	ShutdownTimeout EnvKey = "SHUTDOWN_TIMEOUT"
 )
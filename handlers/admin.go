@@ -0,0 +1,449 @@
+package handlers
+
+import (
+	"encoding/json"
+	"femboyz/clientip"
+	"femboyz/db"
+	"femboyz/pages"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultPerPage = 50
+	maxPerPage     = 200
+	// statsDays is how much per day history the item details include
+	statsDays = 30
+)
+
+var adminPage = func() []byte {
+	b, err := pages.FS.ReadFile("admin.html")
+	if err != nil {
+		panic(err)
+	}
+	return b
+}()
+
+// Admin serves the dashboard. The page holds no data itself, it asks for an admin api key
+// and talks to the admin api with it.
+func (h *Handlers) Admin(w http.ResponseWriter, r *http.Request) {
+	loclog := "[handlers.Admin]"
+	ip := clientip.FromRequest(r)
+	slog.Info(loclog, "info", "admin page request", "method", r.Method, "ip", ip)
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.WriteHeader(http.StatusOK)
+	w.Write(adminPage)
+}
+
+// AdminAPI returns the handler for /api/v1/admin/, it must be served behind auth.RequireAdmin.
+func (h *Handlers) AdminAPI() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/v1/admin/files", h.adminListFiles)
+	mux.HandleFunc("GET /api/v1/admin/files/{id}", h.adminGetFile)
+	mux.HandleFunc("DELETE /api/v1/admin/files/{id}", h.adminDeleteFile)
+	mux.HandleFunc("POST /api/v1/admin/files/{id}/expiry", h.adminFileExpiry)
+	mux.HandleFunc("POST /api/v1/admin/files/{id}/disable", h.adminFileDisabled(true))
+	mux.HandleFunc("POST /api/v1/admin/files/{id}/enable", h.adminFileDisabled(false))
+	mux.HandleFunc("POST /api/v1/admin/files/{id}/rotate", h.adminRotateFile)
+	mux.HandleFunc("GET /api/v1/admin/posts", h.adminListPosts)
+	mux.HandleFunc("GET /api/v1/admin/posts/{id}", h.adminGetPost)
+	mux.HandleFunc("DELETE /api/v1/admin/posts/{id}", h.adminDeletePost)
+	mux.HandleFunc("POST /api/v1/admin/posts/{id}/expiry", h.adminPostExpiry)
+	mux.HandleFunc("POST /api/v1/admin/posts/{id}/disable", h.adminPostDisabled(true))
+	mux.HandleFunc("POST /api/v1/admin/posts/{id}/enable", h.adminPostDisabled(false))
+	mux.HandleFunc("POST /api/v1/admin/posts/{id}/rotate", h.adminRotatePost)
+	return mux
+}
+
+type AdminFile struct {
+	PubID        string `json:"pub_id"`
+	URL          string `json:"url"`
+	Name         string `json:"name"`
+	Size         int64  `json:"size"`
+	Type         string `json:"type"`
+	Hash         string `json:"hash"`
+	Issuer       string `json:"issuer"`
+	CreationDate string `json:"creation_date"`
+	Views        int64  `json:"views"`
+	Downloads    int64  `json:"downloads"`
+	ExpiresAt    int64  `json:"expires_at,omitempty"`
+	MaxDownloads int64  `json:"max_downloads,omitempty"`
+	Disabled     bool   `json:"disabled"`
+	Gone         bool   `json:"gone"`
+}
+
+type AdminPost struct {
+	PubID        string `json:"pub_id"`
+	URL          string `json:"url"`
+	Title        string `json:"title"`
+	Format       string `json:"format"`
+	Issuer       string `json:"issuer"`
+	CreationDate string `json:"creation_date"`
+	Views        int64  `json:"views"`
+	ExpiresAt    int64  `json:"expires_at,omitempty"`
+	MaxViews     int64  `json:"max_views,omitempty"`
+	Disabled     bool   `json:"disabled"`
+	Gone         bool   `json:"gone"`
+}
+
+type AdminList[T any] struct {
+	Items   []T   `json:"items"`
+	Total   int64 `json:"total"`
+	Page    int   `json:"page"`
+	PerPage int   `json:"per_page"`
+}
+
+// AdminStats is the per day history of an item's counters, days without activity are left out
+type AdminStats struct {
+	Views     []db.DailyCount `json:"views"`
+	Downloads []db.DailyCount `json:"downloads,omitempty"`
+}
+
+type AdminFileDetails struct {
+	File  AdminFile  `json:"file"`
+	Stats AdminStats `json:"stats"`
+}
+
+type AdminPostDetails struct {
+	Post  AdminPost  `json:"post"`
+	Stats AdminStats `json:"stats"`
+}
+
+// ExpiryRequest sets a new expiry, either relative with expires_in or absolute with expires_at (0 for never)
+type ExpiryRequest struct {
+	ExpiresIn *Lifetime `json:"expires_in"`
+	ExpiresAt *int64    `json:"expires_at"`
+}
+
+func (h *Handlers) toAdminFile(r *http.Request, f *db.File) AdminFile {
+	return AdminFile{
+		PubID:        f.PubID,
+		URL:          publicURL(r, "/"+f.PubID),
+		Name:         f.Meta.OriginalName,
+		Size:         f.Meta.Size,
+		Type:         f.Meta.FileType,
+		Hash:         f.Meta.Hash,
+		Issuer:       f.Issuer,
+		CreationDate: f.CreationDate,
+		Views:        int64(f.RefView) + h.counters.Pending(db.FileViews, f.ID),
+		Downloads:    int64(f.RefDL) + h.counters.Pending(db.FileDownloads, f.ID),
+		ExpiresAt:    f.ExpiresAt,
+		MaxDownloads: f.MaxDL,
+		Disabled:     f.Disabled,
+		Gone:         h.fileGone(f, time.Now()),
+	}
+}
+
+func (h *Handlers) toAdminPost(r *http.Request, p *db.Post) AdminPost {
+	return AdminPost{
+		PubID:        p.PubID,
+		URL:          publicURL(r, "/p/"+p.PubID),
+		Title:        p.Content.Title,
+		Format:       p.Content.Format,
+		Issuer:       p.Issuer,
+		CreationDate: p.CreationDate,
+		Views:        int64(p.RefView) + h.counters.Pending(db.PostViews, p.ID),
+		ExpiresAt:    p.ExpiresAt,
+		MaxViews:     p.MaxViews,
+		Disabled:     p.Disabled,
+		Gone:         h.postGone(p, time.Now()),
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// paging reads page (from 1) and per_page from the query
+func paging(r *http.Request) (page, perPage int) {
+	page, err := strconv.Atoi(r.URL.Query().Get("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+	perPage, err = strconv.Atoi(r.URL.Query().Get("per_page"))
+	if err != nil || perPage < 1 {
+		perPage = defaultPerPage
+	}
+	return page, min(perPage, maxPerPage)
+}
+
+func statsSince() string {
+	return time.Now().UTC().AddDate(0, 0, -statsDays).Format(time.DateOnly)
+}
+
+// adminFile loads the file named in the path, writing the error response itself when it returns nil.
+func (h *Handlers) adminFile(w http.ResponseWriter, r *http.Request, loclog string) *db.File {
+	id := r.PathValue("id")
+	f, err := h.store.GetFileByPubID(id)
+	if err != nil {
+		slog.Error(loclog, "error", "admin file request failed", "id", id, "error", err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return nil
+	}
+	if f == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return nil
+	}
+	return f
+}
+
+// adminPost loads the post named in the path, writing the error response itself when it returns nil.
+func (h *Handlers) adminPost(w http.ResponseWriter, r *http.Request, loclog string) *db.Post {
+	id := r.PathValue("id")
+	p, err := h.store.GetPostByPubID(id)
+	if err != nil {
+		slog.Error(loclog, "error", "admin post request failed", "id", id, "error", err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return nil
+	}
+	if p == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return nil
+	}
+	return p
+}
+
+func (h *Handlers) adminListFiles(w http.ResponseWriter, r *http.Request) {
+	loclog := "[handlers.adminListFiles]"
+	page, perPage := paging(r)
+	files, total, err := h.store.ListFiles(r.URL.Query().Get("q"), perPage, (page-1)*perPage)
+	if err != nil {
+		slog.Error(loclog, "error", "failed to list files", "error", err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	list := AdminList[AdminFile]{Items: make([]AdminFile, 0, len(files)), Total: total, Page: page, PerPage: perPage}
+	for _, f := range files {
+		list.Items = append(list.Items, h.toAdminFile(r, f))
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+func (h *Handlers) adminListPosts(w http.ResponseWriter, r *http.Request) {
+	loclog := "[handlers.adminListPosts]"
+	page, perPage := paging(r)
+	posts, total, err := h.store.ListPosts(r.URL.Query().Get("q"), perPage, (page-1)*perPage)
+	if err != nil {
+		slog.Error(loclog, "error", "failed to list posts", "error", err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	list := AdminList[AdminPost]{Items: make([]AdminPost, 0, len(posts)), Total: total, Page: page, PerPage: perPage}
+	for _, p := range posts {
+		list.Items = append(list.Items, h.toAdminPost(r, p))
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+func (h *Handlers) adminGetFile(w http.ResponseWriter, r *http.Request) {
+	loclog := "[handlers.adminGetFile]"
+	f := h.adminFile(w, r, loclog)
+	if f == nil {
+		return
+	}
+	since := statsSince()
+	views, err := h.store.GetDailyCounts(db.FileViews, f.ID, since)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	downloads, err := h.store.GetDailyCounts(db.FileDownloads, f.ID, since)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, AdminFileDetails{
+		File:  h.toAdminFile(r, f),
+		Stats: AdminStats{Views: views, Downloads: downloads},
+	})
+}
+
+func (h *Handlers) adminGetPost(w http.ResponseWriter, r *http.Request) {
+	loclog := "[handlers.adminGetPost]"
+	p := h.adminPost(w, r, loclog)
+	if p == nil {
+		return
+	}
+	views, err := h.store.GetDailyCounts(db.PostViews, p.ID, statsSince())
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, AdminPostDetails{
+		Post:  h.toAdminPost(r, p),
+		Stats: AdminStats{Views: views},
+	})
+}
+
+func (h *Handlers) adminDeleteFile(w http.ResponseWriter, r *http.Request) {
+	loclog := "[handlers.adminDeleteFile]"
+	f := h.adminFile(w, r, loclog)
+	if f == nil {
+		return
+	}
+	err := h.removeFile(r.Context(), f)
+	if err != nil {
+		slog.Error(loclog, "error", "failed to delete file", "id", f.PubID, "error", err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	slog.Info(loclog, "info", "file deleted by admin", "id", f.PubID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handlers) adminDeletePost(w http.ResponseWriter, r *http.Request) {
+	loclog := "[handlers.adminDeletePost]"
+	id := r.PathValue("id")
+	deleted, err := h.store.DeletePostByPubID(id)
+	if err != nil {
+		slog.Error(loclog, "error", "failed to delete post", "id", id, "error", err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if !deleted {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	slog.Info(loclog, "info", "post deleted by admin", "id", id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// readExpiry decodes an ExpiryRequest into the unix time to store, 0 for never.
+func readExpiry(w http.ResponseWriter, r *http.Request) (int64, bool) {
+	var er ExpiryRequest
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxFieldSize)).Decode(&er)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return 0, false
+	}
+	switch {
+	case er.ExpiresIn != nil:
+		return er.ExpiresIn.expiresAt(time.Now()), true
+	case er.ExpiresAt != nil && *er.ExpiresAt >= 0:
+		return *er.ExpiresAt, true
+	}
+	http.Error(w, "expires_in or expires_at is required", http.StatusBadRequest)
+	return 0, false
+}
+
+func (h *Handlers) adminFileExpiry(w http.ResponseWriter, r *http.Request) {
+	loclog := "[handlers.adminFileExpiry]"
+	f := h.adminFile(w, r, loclog)
+	if f == nil {
+		return
+	}
+	expiresAt, ok := readExpiry(w, r)
+	if !ok {
+		return
+	}
+	_, err := h.store.SetFileExpiry(f.PubID, expiresAt)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	f.ExpiresAt = expiresAt
+	writeJSON(w, http.StatusOK, h.toAdminFile(r, f))
+}
+
+func (h *Handlers) adminPostExpiry(w http.ResponseWriter, r *http.Request) {
+	loclog := "[handlers.adminPostExpiry]"
+	p := h.adminPost(w, r, loclog)
+	if p == nil {
+		return
+	}
+	expiresAt, ok := readExpiry(w, r)
+	if !ok {
+		return
+	}
+	_, err := h.store.SetPostExpiry(p.PubID, expiresAt)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	p.ExpiresAt = expiresAt
+	writeJSON(w, http.StatusOK, h.toAdminPost(r, p))
+}
+
+func (h *Handlers) adminFileDisabled(disabled bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		loclog := "[handlers.adminFileDisabled]"
+		f := h.adminFile(w, r, loclog)
+		if f == nil {
+			return
+		}
+		_, err := h.store.SetFileDisabled(f.PubID, disabled)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		f.Disabled = disabled
+		writeJSON(w, http.StatusOK, h.toAdminFile(r, f))
+	}
+}
+
+func (h *Handlers) adminPostDisabled(disabled bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		loclog := "[handlers.adminPostDisabled]"
+		p := h.adminPost(w, r, loclog)
+		if p == nil {
+			return
+		}
+		_, err := h.store.SetPostDisabled(p.PubID, disabled)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		p.Disabled = disabled
+		writeJSON(w, http.StatusOK, h.toAdminPost(r, p))
+	}
+}
+
+func (h *Handlers) adminRotateFile(w http.ResponseWriter, r *http.Request) {
+	loclog := "[handlers.adminRotateFile]"
+	f := h.adminFile(w, r, loclog)
+	if f == nil {
+		return
+	}
+	newID, err := newPubID(h.fileExists)
+	if err == nil {
+		_, err = h.store.RotateFilePubID(f.PubID, newID)
+	}
+	if err != nil {
+		slog.Error(loclog, "error", "failed to rotate file pub id", "id", f.PubID, "error", err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	slog.Info(loclog, "info", "file pub id rotated by admin", "id", f.PubID, "new_id", newID)
+	f.PubID = newID
+	writeJSON(w, http.StatusOK, h.toAdminFile(r, f))
+}
+
+func (h *Handlers) adminRotatePost(w http.ResponseWriter, r *http.Request) {
+	loclog := "[handlers.adminRotatePost]"
+	p := h.adminPost(w, r, loclog)
+	if p == nil {
+		return
+	}
+	newID, err := newPubID(h.postExists)
+	if err == nil {
+		_, err = h.store.RotatePostPubID(p.PubID, newID)
+	}
+	if err != nil {
+		slog.Error(loclog, "error", "failed to rotate post pub id", "id", p.PubID, "error", err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	slog.Info(loclog, "info", "post pub id rotated by admin", "id", p.PubID, "new_id", newID)
+	p.PubID = newID
+	writeJSON(w, http.StatusOK, h.toAdminPost(r, p))
+}
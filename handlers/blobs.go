@@ -0,0 +1,138 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"femboyz/db"
+	"femboyz/uidgenerator"
+	"io"
+	"log/slog"
+	"path/filepath"
+)
+
+// blobKey is where content with the given sha256 hex digest is stored
+func blobKey(hash string) string {
+	return "sha256/" + hash[:2] + "/" + hash
+}
+
+// stagingKey is where an upload is written before its hash is known
+func stagingKey() string {
+	return "staging/" + uidgenerator.Generate()
+}
+
+// storeBlob streams an uploaded file into blob storage, keyed by its sha256 hash,
+// and returns the metadata gathered while writing it. name and declaredType are what the client sent.
+// The blob gains a reference that the caller must release if the file is not recorded.
+func (h *Handlers) storeBlob(ctx context.Context, r io.Reader, name, declaredType string) (*db.FileMeta, error) {
+	loclog := "[handlers.storeBlob]"
+	// the first 512 bytes are all http.DetectContentType looks at
+	head := make([]byte, 512)
+	n, err := io.ReadFull(r, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	head = head[:n]
+
+	sum := sha256.New()
+	cw := &countingWriter{}
+	body := io.TeeReader(io.MultiReader(bytes.NewReader(head), r), io.MultiWriter(sum, cw))
+
+	staging := stagingKey()
+	if err = h.blobs.Put(ctx, staging, body, -1); err != nil {
+		h.blobs.Delete(ctx, staging)
+		return nil, err
+	}
+
+	hash := hex.EncodeToString(sum.Sum(nil))
+	key := blobKey(hash)
+
+	// the reference held from here on keeps releaseBlob from deleting the content,
+	// the store makes acquiring wait while a release is deleting it
+	refs, err := h.store.AcquireBlob(hash, cw.n)
+	if err != nil {
+		h.blobs.Delete(ctx, staging)
+		return nil, err
+	}
+	shared := false
+	if refs > 1 {
+		// the upload that made the blob may still be moving its content in place, or have failed to
+		_, err = h.blobs.Stat(ctx, key)
+		shared = err == nil
+	}
+	if shared {
+		slog.Info(loclog, "info", "content already stored, sharing blob", "hash", hash, "refs", refs)
+		h.blobs.Delete(ctx, staging)
+	} else if err = h.blobs.Move(ctx, staging, key); err != nil {
+		// the content is the same whoever moves it in place, so a concurrent move is harmless
+		h.releaseBlob(ctx, hash, key)
+		h.blobs.Delete(ctx, staging)
+		return nil, err
+	}
+
+	return &db.FileMeta{
+		OriginalName:  filepath.Base(name),
+		Size:          cw.n,
+		Hash:          hash,
+		LocalFileName: key,
+		FileType:      detectFileType(head, name, declaredType),
+	}, nil
+}
+
+// releaseBlob drops a reference to a blob and deletes its content once nothing refers to it.
+// The content is deleted within the release (see db.BlobRefStore), so another server sharing
+// the database can't acquire the blob in between and be left without content.
+func (h *Handlers) releaseBlob(ctx context.Context, hash, key string) error {
+	loclog := "[handlers.releaseBlob]"
+	refs, err := h.store.ReleaseBlob(hash, h.blobRemover(ctx, hash, key))
+	if err != nil {
+		return err
+	}
+	if refs == 0 {
+		slog.Info(loclog, "info", "unreferenced blob deleted", "hash", hash)
+	}
+	return nil
+}
+
+// blobRemover deletes the content of an unreferenced blob for the store, see db.BlobRefStore
+func (h *Handlers) blobRemover(ctx context.Context, hash, key string) func() error {
+	loclog := "[handlers.blobRemover]"
+	return func() error {
+		err := h.blobs.Delete(ctx, key)
+		if err != nil {
+			slog.Error(loclog, "error", "failed to delete unreferenced blob", "hash", hash, "key", key, "error", err.Error())
+		}
+		return err
+	}
+}
+
+// removeFile deletes the files row and releases its blob in the same store operation, so a failed
+// release leaves the file in place to be removed again rather than its blob referenced forever.
+// Files stored before content addressing own their blob and have it deleted directly.
+func (h *Handlers) removeFile(ctx context.Context, f *db.File) error {
+	loclog := "[handlers.removeFile]"
+	fmeta := f.Meta
+	if len(fmeta.Hash) == sha256.Size*2 && fmeta.LocalFileName == blobKey(fmeta.Hash) {
+		_, err := h.store.DeleteFileByPubID(f.PubID, fmeta.Hash, h.blobRemover(ctx, fmeta.Hash, fmeta.LocalFileName))
+		return err
+	}
+	deleted, err := h.store.DeleteFileByPubID(f.PubID, "", nil)
+	if err != nil || !deleted {
+		return err
+	}
+	err = h.blobs.Delete(ctx, fmeta.LocalFileName)
+	if err != nil {
+		slog.Error(loclog, "error", "failed to delete blob of removed file", "pub_id", f.PubID, "key", fmeta.LocalFileName, "error", err.Error())
+	}
+	return err
+}
+
+type countingWriter struct {
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	c.n += int64(len(p))
+	return len(p), nil
+}
@@ -0,0 +1,99 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// errRefused stops the body of a download that reserve refused
+var errRefused = errors.New("download refused")
+
+// bodyHeaders describe the body of a download, they are dropped when it is refused
+var bodyHeaders = []string{"Content-Type", "Content-Length", "Content-Range", "Content-Disposition",
+	"Content-Encoding", "Accept-Ranges", "ETag", "Last-Modified"}
+
+// downloadWriter records what a raw download actually sent, to tell completed downloads apart
+// from aborted ones and from the earlier pieces of a resumed download.
+type downloadWriter struct {
+	http.ResponseWriter
+	status  int
+	written int64
+	// reserve, when set, is called once a body is about to be sent, so answers without one
+	// (304, 412, 416) are not counted. A status other than 0 is sent instead of the body.
+	reserve func() int
+	refused bool
+}
+
+func (dw *downloadWriter) WriteHeader(status int) {
+	if dw.status == 0 {
+		if dw.reserve != nil && (status == http.StatusOK || status == http.StatusPartialContent) {
+			if refused := dw.reserve(); refused != 0 {
+				for _, k := range bodyHeaders {
+					dw.Header().Del(k)
+				}
+				status = refused
+				dw.refused = true
+			}
+		}
+		dw.status = status
+	}
+	dw.ResponseWriter.WriteHeader(status)
+}
+
+func (dw *downloadWriter) Write(p []byte) (int, error) {
+	if dw.status == 0 {
+		dw.WriteHeader(http.StatusOK)
+	}
+	if dw.refused {
+		return 0, errRefused
+	}
+	n, err := dw.ResponseWriter.Write(p)
+	dw.written += int64(n)
+	return n, err
+}
+
+func (dw *downloadWriter) Unwrap() http.ResponseWriter {
+	return dw.ResponseWriter
+}
+
+// completed reports whether the response delivered the last byte of a file of the given size:
+// either the whole file, or a single range running to the end of it.
+// Multi-range responses are never counted, which is why files with a download limit are counted
+// before they are served instead (see Handlers.reserve).
+func (dw *downloadWriter) completed(size int64) bool {
+	switch dw.status {
+	case http.StatusOK:
+		return dw.written == size
+	case http.StatusPartialContent:
+		first, last, ok := parseContentRange(dw.Header().Get("Content-Range"))
+		return ok && last == size-1 && dw.written == last-first+1
+	}
+	return false
+}
+
+// parseContentRange reads "bytes first-last/size"
+func parseContentRange(cr string) (int64, int64, bool) {
+	spec, ok := strings.CutPrefix(cr, "bytes ")
+	if !ok {
+		return 0, 0, false
+	}
+	spec, _, ok = strings.Cut(spec, "/")
+	if !ok {
+		return 0, 0, false
+	}
+	a, b, ok := strings.Cut(spec, "-")
+	if !ok {
+		return 0, 0, false
+	}
+	first, err := strconv.ParseInt(a, 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	last, err := strconv.ParseInt(b, 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	return first, last, true
+}
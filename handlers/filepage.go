@@ -0,0 +1,176 @@
+package handlers
+
+import (
+	"bytes"
+	"femboyz/clientip"
+	"femboyz/db"
+	"femboyz/pages"
+	"fmt"
+	"html/template"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// maxTextPreview is how much of a text file is shown on its page
+const maxTextPreview = 64 << 10
+
+var fileTmpl = template.Must(template.ParseFS(pages.FS, "file.html"))
+
+type filePage struct {
+	Name    string
+	Size    string
+	Type    string
+	Hash    string
+	Created time.Time
+	Expires time.Time
+	// DownloadsLeft is -1 when downloads are unlimited
+	DownloadsLeft int64
+	Views         int
+	Downloads     int
+	DownloadURL   string
+	InlineURL     string
+	// Preview is one of image, video, audio, pdf, text or empty for no preview
+	Preview   string
+	Text      string
+	Truncated bool
+}
+
+// inlineTypes are the types served with Content-Disposition: inline so the page can embed them.
+// Anything that a browser would execute (html, svg, ...) is never inline.
+var inlineTypes = map[string]string{
+	"image/png":       "image",
+	"image/jpeg":      "image",
+	"image/gif":       "image",
+	"image/webp":      "image",
+	"image/avif":      "image",
+	"image/bmp":       "image",
+	"video/mp4":       "video",
+	"video/webm":      "video",
+	"video/ogg":       "video",
+	"audio/mpeg":      "audio",
+	"audio/ogg":       "audio",
+	"audio/wav":       "audio",
+	"audio/wave":      "audio",
+	"audio/flac":      "audio",
+	"audio/aac":       "audio",
+	"audio/mp4":       "audio",
+	"audio/webm":      "audio",
+	"application/pdf": "pdf",
+}
+
+// previewKind says how the file page previews a file of the given content type
+func previewKind(fileType string) string {
+	mediaType, _, err := mime.ParseMediaType(fileType)
+	if err != nil {
+		return ""
+	}
+	if kind, ok := inlineTypes[mediaType]; ok {
+		return kind
+	}
+	if strings.HasPrefix(mediaType, "text/") || mediaType == "application/json" || mediaType == "application/xml" {
+		return "text"
+	}
+	return ""
+}
+
+func (h *Handlers) FilePage(w http.ResponseWriter, r *http.Request) {
+	loclog := "[handlers.FilePage]"
+	ip := clientip.FromRequest(r)
+	slog.Info(loclog, "info", "file page request", "method", r.Method, "ip", ip)
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	id := r.PathValue("id")
+	f := h.lookupFile(w, loclog, id, ip)
+	if f == nil {
+		return
+	}
+
+	// HEAD comes from link unfurlers and uptime probes, not readers
+	if r.Method == http.MethodGet {
+		h.counters.FileView(f.ID)
+	}
+
+	fmeta := f.Meta
+	q := url.Values{"id": {f.PubID}, "raw": {"true"}}
+	page := filePage{
+		Name:          fmeta.OriginalName,
+		Size:          humanSize(fmeta.Size),
+		Type:          fmeta.FileType,
+		Hash:          fmeta.Hash,
+		Created:       f.CreatedAt(),
+		DownloadsLeft: -1,
+		Views:         f.RefView + int(h.counters.Pending(db.FileViews, f.ID)),
+		Downloads:     f.RefDL + int(h.counters.Pending(db.FileDownloads, f.ID)),
+		DownloadURL:   "/api/v1/pull/f?" + q.Encode(),
+		Preview:       previewKind(fmeta.FileType),
+	}
+	if f.ExpiresAt != 0 {
+		page.Expires = time.Unix(f.ExpiresAt, 0)
+	}
+	if f.MaxDL != 0 {
+		page.DownloadsLeft = max(f.MaxDL-int64(page.Downloads), 0)
+		// a preview would be a download, or show the content without one
+		page.Preview = ""
+	}
+	q.Set("inline", "true")
+	page.InlineURL = "/api/v1/pull/f?" + q.Encode()
+
+	var err error
+	if page.Preview == "text" {
+		page.Text, page.Truncated, err = h.textPreview(r, fmeta.LocalFileName)
+		if err != nil {
+			slog.Warn(loclog, "warning", "file page failed to read text preview", "id", id, "ip", ip, "error", err.Error())
+			page.Preview = ""
+		}
+	}
+
+	var buf bytes.Buffer
+	err = fileTmpl.Execute(&buf, page)
+	if err != nil {
+		slog.Error(loclog, "error", "file page failed to execute template", "id", id, "ip", ip, "error", err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf.Bytes())
+}
+
+// textPreview reads the start of a blob for display.
+func (h *Handlers) textPreview(r *http.Request, key string) (string, bool, error) {
+	blob, err := h.blobs.Get(r.Context(), key)
+	if err != nil {
+		return "", false, err
+	}
+	defer blob.Close()
+	data, err := io.ReadAll(io.LimitReader(blob, maxTextPreview+1))
+	if err != nil {
+		return "", false, err
+	}
+	truncated := len(data) > maxTextPreview
+	if truncated {
+		data = data[:maxTextPreview]
+	}
+	return strings.ToValidUTF8(string(data), "�"), truncated, nil
+}
+
+func humanSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
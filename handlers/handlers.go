@@ -1,21 +1,60 @@
 package handlers
 
 import (
+	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/json"
+	"errors"
+	"femboyz/auth"
+	"femboyz/blobstore"
+	"femboyz/clientip"
+	"femboyz/counters"
 	"femboyz/db"
-	"femboyz/env"
 	"femboyz/uidgenerator"
+	"io"
 	"log/slog"
+	"mime"
 	"mime/multipart"
 	"net/http"
-	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
-var timeStarted time.Time
+// how many times Send tries to find an unused pub id before giving up
+const maxPubIDAttempts = 5
 
-func Init() {
-	timeStarted = time.Now()
+// Handlers serves the api and pages from the stores it is created with
+type Handlers struct {
+	store db.Store
+	// blobs holds file contents, keyed by FileMeta.LocalFileName
+	blobs    blobstore.BlobStore
+	counters *counters.Counters
+	started  time.Time
+	// healthToken is the Authorization header HealthCheck requires, see SetHealthToken
+	healthToken atomic.Pointer[string]
+
+	// uploadLocks holds a *sync.Mutex per upload id, see lockUpload
+	uploadLocks sync.Map
+	// uploadTTL is how long an upload is kept after its last chunk, set by StartReaper
+	uploadTTL time.Duration
+
+	reaperStop, reaperDone chan struct{}
+}
+
+func New(store db.Store, blobs blobstore.BlobStore, c *counters.Counters) *Handlers {
+	return &Handlers{
+		store:    store,
+		blobs:    blobs,
+		counters: c,
+		started:  time.Now(),
+	}
+}
+
+// SetHealthToken sets the Authorization header value HealthCheck requires, it can be changed while serving
+func (h *Handlers) SetHealthToken(token string) {
+	h.healthToken.Store(&token)
 }
 
 type Health struct {
@@ -24,9 +63,9 @@ type Health struct {
 	Entries []int64 `json:"entries"`
 }
 
-func HealthCheck(w http.ResponseWriter, r *http.Request) {
+func (h *Handlers) HealthCheck(w http.ResponseWriter, r *http.Request) {
 	loclog := "[handlers.HealthCheck]"
-	ip := getRequestIP(r)
+	ip := clientip.FromRequest(r)
 	slog.Info(loclog, "info", "health check request", "method", r.Method, "ip", ip)
 	// if not GET - drop connection
 	if r.Method != http.MethodGet {
@@ -35,29 +74,31 @@ func HealthCheck(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// check for token
-	token := r.Header.Get("Authorization")
-	if token != env.HealthCheckToken.Get() {
-		slog.Warn(loclog, "warning", "health check request token not match", "token", token, "ip", ip)
+	want := ""
+	if token := h.healthToken.Load(); token != nil {
+		want = *token
+	}
+	if !tokenEqual(r.Header.Get("Authorization"), want) {
+		slog.Warn(loclog, "warning", "health check request token not match", "ip", ip)
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(getHealth())
+	json.NewEncoder(w).Encode(h.getHealth())
 }
 
-func getRequestIP(r *http.Request) string {
-	proxyIP := r.Header.Get("X-Forwarded-For")
-	if proxyIP != "" {
-		return proxyIP
-	}
-	return r.RemoteAddr
+// tokenEqual compares in constant time, so a token can't be guessed byte by byte from response times.
+// Hashing first keeps the length of the token from showing too.
+func tokenEqual(got, want string) bool {
+	g, w := sha256.Sum256([]byte(got)), sha256.Sum256([]byte(want))
+	return subtle.ConstantTimeCompare(g[:], w[:]) == 1
 }
 
-func getHealth() Health {
-	ut := time.Since(timeStarted)
-	fileEntries, _ := db.GetFileEntries()
-	postEntries, _ := db.GetPostEntries()
+func (h *Handlers) getHealth() Health {
+	ut := time.Since(h.started)
+	fileEntries, _ := h.store.GetFileEntries()
+	postEntries, _ := h.store.GetPostEntries()
 	return Health{
 		Status: "ok",
 		Uptime: ut.String(),
@@ -76,12 +117,17 @@ type File struct {
 	Fileurl  string `json:"fileurl"`
 }
 
-func PullFile(w http.ResponseWriter, r *http.Request) {
+// PullFile returns a file by its pub id.
+// By default the response is multipart with a metadata.json part followed by the file.
+// With raw=true the file itself is streamed with Range, If-Range and conditional request support,
+// adding inline=true asks for it to be displayed instead of saved when its type is safe to display.
+func (h *Handlers) PullFile(w http.ResponseWriter, r *http.Request) {
 	loclog := "[handlers.PullFile]"
-	ip := getRequestIP(r)
+	ip := clientip.FromRequest(r)
 	slog.Info(loclog, "info", "pull file request", "method", r.Method, "ip", ip)
-	// if not GET - drop connection
-	if r.Method != http.MethodGet {
+	raw := r.URL.Query().Get("raw") == "true"
+	// if not GET (or HEAD for raw downloads) - drop connection
+	if r.Method != http.MethodGet && !(raw && r.Method == http.MethodHead) {
 		slog.Warn(loclog, "warning", "pull file request method not GET", "method", r.Method, "ip", ip)
 		return
 	}
@@ -92,27 +138,36 @@ func PullFile(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if !uidgenerator.Validate(id) {
-		slog.Warn(loclog, "warning", "pull file request id not valid", "id", id, "ip", ip)
-		w.WriteHeader(http.StatusNotFound)
+	f := h.lookupFile(w, loclog, id, ip)
+	if f == nil {
 		return
 	}
 
-	f, err := db.GetFileByPubID(id)
+	fmeta := f.Meta
+	blob, err := h.blobs.Get(r.Context(), fmeta.LocalFileName)
 	if err != nil {
-		slog.Error(loclog, "error", "pull file request failed", "id", id, "ip", ip, "error", err.Error())
+		slog.Error(loclog, "error", "pull file request failed to open file", "id", id, "ip", ip, "error", err.Error())
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	if f == nil {
-		slog.Warn(loclog, "warning", "pull file request file not found", "id", id, "ip", ip)
-		w.WriteHeader(http.StatusNotFound)
+	defer blob.Close()
+
+	// a limited file counts every request that gets content as a download, whatever range it asks for,
+	// so ranges can't be used to get the content piece by piece without using up downloads
+	var reserve func() int
+	if f.MaxDL != 0 && r.Method == http.MethodGet {
+		reserve = func() int { return h.reserveStatus(loclog, db.FileDownloads, f.ID, id, ip) }
+	}
+	if raw {
+		h.serveRawFile(w, r, f, blob, r.URL.Query().Get("inline") == "true", reserve)
+		return
+	}
+	if reserve != nil && !h.reserve(w, loclog, db.FileDownloads, f.ID, id, ip) {
 		return
 	}
 
 	// f.Meta is a json struct that may contain metadata about the file and different types of files may have different metadata
 	// for example, image files may have metadata
-	fmeta := f.Meta
 	sendMeta := map[string]interface{}{
 		"creation_date": f.CreationDate,
 		"filename":      fmeta.OriginalName,
@@ -120,46 +175,260 @@ func PullFile(w http.ResponseWriter, r *http.Request) {
 		"filetype":      fmeta.FileType,
 		"filehash":      fmeta.Hash,
 		"file_pub_id":   f.PubID,
-		"views":         f.RefView,
-		"downloads":     f.RefDL,
-	}
-
-	fileData, err := os.ReadFile("testblobs/" + fmeta.LocalFileName)
-	if err != nil {
-		slog.Error(loclog, "error", "pull file request failed to read file", "id", id, "ip", ip, "error", err.Error())
-		w.WriteHeader(http.StatusInternalServerError)
-		return
+		"views":         f.RefView + int(h.counters.Pending(db.FileViews, f.ID)),
+		"downloads":     f.RefDL + int(h.counters.Pending(db.FileDownloads, f.ID)),
 	}
 
 	mw := multipart.NewWriter(w)
 	w.Header().Set("Content-Type", mw.FormDataContentType())
+	w.WriteHeader(http.StatusOK)
 
 	metaPart, _ := mw.CreateFormFile("metadata", "metadata.json")
 	json.NewEncoder(metaPart).Encode(sendMeta)
 
 	filePart, _ := mw.CreateFormFile("file", fmeta.OriginalName)
-	filePart.Write(fileData)
-
-	w.WriteHeader(http.StatusOK)
+	_, err = io.Copy(filePart, blob)
+	if err != nil {
+		slog.Warn(loclog, "warning", "pull file request interrupted", "id", id, "ip", ip, "error", err.Error())
+		return
+	}
 	mw.Close()
+	if f.MaxDL == 0 {
+		h.counters.FileDownload(f.ID)
+	}
 }
 
-func Admin(w http.ResponseWriter, r *http.Request) {
+// serveRawFile streams the blob as the response body.
+// http.ServeContent takes care of Range, If-Range, If-None-Match and If-Modified-Since
+// using the ETag and modification time set here.
+// Inline requests are the previews on the file page, they are not counted as downloads.
+// reserve is set for files with a download limit and is called once a body is about to be sent.
+func (h *Handlers) serveRawFile(w http.ResponseWriter, r *http.Request, f *db.File, blob io.ReadSeeker, inline bool, reserve func() int) {
+	fmeta := f.Meta
+	hdr := w.Header()
+	hdr.Set("X-Content-Type-Options", "nosniff")
+	disposition := "attachment"
+	// text is previewed from the page itself, serving it inline could let html-ish content run
+	if kind := previewKind(fmeta.FileType); inline && kind != "" && kind != "text" {
+		disposition = "inline"
+	}
+	if fmeta.Hash != "" {
+		hdr.Set("ETag", `"`+fmeta.Hash+`"`)
+	}
+	if fmeta.FileType != "" {
+		hdr.Set("Content-Type", fmeta.FileType)
+	} else {
+		hdr.Set("Content-Type", "application/octet-stream")
+	}
+	if cd := mime.FormatMediaType(disposition, map[string]string{"filename": fmeta.OriginalName}); cd != "" {
+		hdr.Set("Content-Disposition", cd)
+	} else {
+		hdr.Set("Content-Disposition", disposition)
+	}
+	dw := &downloadWriter{ResponseWriter: w, reserve: reserve}
+	http.ServeContent(dw, r, fmeta.OriginalName, f.CreatedAt(), blob)
+	if r.Method == http.MethodGet && f.MaxDL == 0 && !inline && dw.completed(fmeta.Size) {
+		h.counters.FileDownload(f.ID)
+	}
+}
 
+// lookupFile resolves a file pub id, writing the error response itself when it returns nil.
+func (h *Handlers) lookupFile(w http.ResponseWriter, loclog, id, ip string) *db.File {
+	if !uidgenerator.Validate(id) {
+		slog.Warn(loclog, "warning", "file request id not valid", "id", id, "ip", ip)
+		w.WriteHeader(http.StatusNotFound)
+		return nil
+	}
+	f, err := h.store.GetFileByPubID(id)
+	if err != nil {
+		slog.Error(loclog, "error", "file request failed", "id", id, "ip", ip, "error", err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return nil
+	}
+	if f == nil {
+		slog.Warn(loclog, "warning", "file request file not found", "id", id, "ip", ip)
+		w.WriteHeader(http.StatusNotFound)
+		return nil
+	}
+	if h.fileGone(f, time.Now()) {
+		slog.Info(loclog, "info", "file request file is gone", "id", id, "ip", ip)
+		w.WriteHeader(http.StatusGone)
+		return nil
+	}
+	return f
+}
+
+type SendResponse struct {
+	PubID string `json:"pub_id"`
+	URL   string `json:"url"`
+	// ExpiresAt is unix seconds, omitted for uploads that don't expire
+	ExpiresAt int64 `json:"expires_at,omitempty"`
 }
 
-func FilePage(w http.ResponseWriter, r *http.Request) {
+// Send must be served behind auth.Require, uploads are recorded with the issuer of the api key.
+// It accepts a multipart/form-data upload with the file in the "file" field,
+// or an application/json body describing a post (see PostRequest).
+// Form fields sent before the file set its lifecycle: "expires_in" (seconds or a go duration)
+// and "max_downloads".
+// The file is streamed to blob storage, hashed and sniffed on the way, then recorded in the files table.
+// Content that is already stored is not stored again, the new row shares the existing blob.
+func (h *Handlers) Send(w http.ResponseWriter, r *http.Request) {
+	loclog := "[handlers.Send]"
+	ip := clientip.FromRequest(r)
+	slog.Info(loclog, "info", "send request", "method", r.Method, "ip", ip)
+	// if not POST - drop connection
+	if r.Method != http.MethodPost {
+		slog.Warn(loclog, "warning", "send request method not POST", "method", r.Method, "ip", ip)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	id := auth.FromContext(r.Context())
+	if id == nil {
+		slog.Warn(loclog, "warning", "send request without identity", "ip", ip)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
 
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "application/json" {
+		h.sendPost(w, r, ip, id.Issuer)
+		return
+	}
+
+	mr, err := r.MultipartReader()
+	if err != nil {
+		slog.Warn(loclog, "warning", "send request is not multipart", "ip", ip, "error", err.Error())
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	// read fields until the file part, the body is read as a stream so nothing else is buffered
+	var part *multipart.Part
+	var lifetime Lifetime
+	var maxDL int64
+	for {
+		part, err = mr.NextPart()
+		if err == io.EOF {
+			slog.Warn(loclog, "warning", "send request has no file part", "ip", ip)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			slog.Warn(loclog, "warning", "send request failed to read part", "ip", ip, "error", err.Error())
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if part.FormName() == "file" && part.FileName() != "" {
+			break
+		}
+		switch part.FormName() {
+		case "expires_in":
+			lifetime, err = parseLifetime(readField(part))
+		case "max_downloads":
+			maxDL, err = parseLimit(readField(part))
+		}
+		part.Close()
+		if err != nil {
+			slog.Warn(loclog, "warning", "send request field not valid", "field", part.FormName(), "ip", ip, "error", err.Error())
+			http.Error(w, part.FormName()+": "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	defer part.Close()
+
+	pubID, err := newPubID(h.fileExists)
+	if err != nil {
+		slog.Error(loclog, "error", "send request failed to allocate pub id", "ip", ip, "error", err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	meta, err := h.storeBlob(r.Context(), part, part.FileName(), part.Header.Get("Content-Type"))
+	if err != nil {
+		slog.Error(loclog, "error", "send request failed to store file", "ip", ip, "error", err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	f := &db.File{
+		PubID:     pubID,
+		Meta:      *meta,
+		Issuer:    id.Issuer,
+		ExpiresAt: lifetime.expiresAt(time.Now()),
+		MaxDL:     maxDL,
+	}
+	err = h.store.InsertFile(f)
+	if err != nil {
+		slog.Error(loclog, "error", "send request failed to insert file", "ip", ip, "error", err.Error())
+		h.releaseBlob(r.Context(), meta.Hash, meta.LocalFileName)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	slog.Info(loclog, "info", "file uploaded", "pub_id", pubID, "size", meta.Size, "type", meta.FileType, "issuer", id.Issuer, "ip", ip)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(SendResponse{
+		PubID:     pubID,
+		URL:       publicURL(r, "/"+pubID),
+		ExpiresAt: f.ExpiresAt,
+	})
 }
 
-func PostPage(w http.ResponseWriter, r *http.Request) {
+// maxFieldSize caps the form fields read before the file part
+const maxFieldSize = 1 << 10
 
+func readField(part *multipart.Part) string {
+	b, _ := io.ReadAll(io.LimitReader(part, maxFieldSize))
+	return string(b)
 }
 
-func Send(w http.ResponseWriter, r *http.Request) {
+// detectFileType sniffs the content and falls back to the file extension or the declared type
+// when sniffing can't tell anything better than application/octet-stream.
+func detectFileType(head []byte, name, declaredType string) string {
+	const unknown = "application/octet-stream"
+	if len(head) > 0 {
+		if t := http.DetectContentType(head); t != unknown {
+			return t
+		}
+	}
+	if t := mime.TypeByExtension(filepath.Ext(name)); t != "" {
+		return t
+	}
+	if declaredType != "" {
+		if _, _, err := mime.ParseMediaType(declaredType); err == nil {
+			return declaredType
+		}
+	}
+	return unknown
+}
 
+// newPubID returns a generated id that exists reports as unused.
+func newPubID(exists func(string) (bool, error)) (string, error) {
+	for range maxPubIDAttempts {
+		id := uidgenerator.Generate()
+		used, err := exists(id)
+		if err != nil {
+			return "", err
+		}
+		if !used {
+			return id, nil
+		}
+	}
+	return "", errors.New("no free pub id found")
 }
 
-func PullPost(w http.ResponseWriter, r *http.Request) {
+func (h *Handlers) fileExists(id string) (bool, error) {
+	f, err := h.store.GetFileByPubID(id)
+	return f != nil, err
+}
 
+// publicURL builds an absolute url for path on the host the request came in on.
+func publicURL(r *http.Request, path string) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + path
 }
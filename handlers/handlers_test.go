@@ -0,0 +1,742 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"femboyz/auth"
+	"femboyz/blobstore"
+	"femboyz/counters"
+	"femboyz/db"
+	"femboyz/uidgenerator"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestHandlers(t *testing.T) *Handlers {
+	t.Helper()
+	bs, err := blobstore.NewLocal(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to create blob store: %v", err)
+	}
+	store := db.NewMemory()
+	return New(store, bs, counters.New(store))
+}
+
+// send runs an upload through Send as issuer and returns the recorded response
+func send(h *Handlers, contentType string, body io.Reader) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", "/api/v1/send", body)
+	req.Header.Set("Content-Type", contentType)
+	req = req.WithContext(auth.WithIdentity(req.Context(), &auth.Identity{Issuer: "tester"}))
+	w := httptest.NewRecorder()
+	h.Send(w, req)
+	return w
+}
+
+func sendFile(t *testing.T, h *Handlers, name, content string, fields map[string]string) SendResponse {
+	t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for k, v := range fields {
+		mw.WriteField(k, v)
+	}
+	fw, _ := mw.CreateFormFile("file", name)
+	io.WriteString(fw, content)
+	mw.Close()
+
+	w := send(h, mw.FormDataContentType(), &body)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected status 201, got %d: %s", w.Code, w.Body.String())
+	}
+	var resp SendResponse
+	err := json.NewDecoder(w.Body).Decode(&resp)
+	if err != nil {
+		t.Fatalf("Failed to decode send response: %v", err)
+	}
+	return resp
+}
+
+func get(handler http.HandlerFunc, target string, header map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", target, nil)
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	w := httptest.NewRecorder()
+	handler(w, req)
+	return w
+}
+
+func TestSendAndPullFile(t *testing.T) {
+	t.Parallel()
+	h := newTestHandlers(t)
+
+	first := sendFile(t, h, "hello.txt", "hello world", nil)
+	second := sendFile(t, h, "copy.txt", "hello world", nil)
+	if first.PubID == second.PubID {
+		t.Fatalf("Expected distinct pub ids, got %s twice", first.PubID)
+	}
+
+	w := get(h.PullFile, "/api/v1/pull/f?raw=true&id="+first.PubID, nil)
+	if w.Code != http.StatusOK || w.Body.String() != "hello world" {
+		t.Errorf("Expected the file, got %d %q", w.Code, w.Body.String())
+	}
+	if cd := w.Header().Get("Content-Disposition"); !strings.HasPrefix(cd, "attachment") {
+		t.Errorf("Expected an attachment, got %q", cd)
+	}
+
+	w = get(h.PullFile, "/api/v1/pull/f?raw=true&id="+second.PubID, map[string]string{"Range": "bytes=6-"})
+	if w.Code != http.StatusPartialContent || w.Body.String() != "world" {
+		t.Errorf("Expected the requested range, got %d %q", w.Code, w.Body.String())
+	}
+
+	// both uploads share one blob
+	var keys []string
+	h.blobs.List(t.Context(), "sha256/", func(info blobstore.Info) error {
+		keys = append(keys, info.Key)
+		return nil
+	})
+	if len(keys) != 1 {
+		t.Errorf("Expected one stored blob, got %v", keys)
+	}
+	if n := h.counters.Pending(db.FileDownloads, mustFile(t, h, first.PubID).ID); n != 1 {
+		t.Errorf("Expected 1 pending download, got %d", n)
+	}
+
+	w = get(h.PullFile, "/api/v1/pull/f?raw=true&id=unknown", nil)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for an unknown id, got %d", w.Code)
+	}
+}
+
+func TestRawRanges(t *testing.T) {
+	t.Parallel()
+	h := newTestHandlers(t)
+	resp := sendFile(t, h, "hello.txt", "hello world", nil)
+	f := mustFile(t, h, resp.PubID)
+	target := "/api/v1/pull/f?raw=true&id=" + resp.PubID
+	etag := `"` + f.Meta.Hash + `"`
+
+	w := get(h.PullFile, target, map[string]string{"Range": "bytes=2-4"})
+	if w.Code != http.StatusPartialContent || w.Body.String() != "llo" {
+		t.Errorf("Expected the range, got %d %q", w.Code, w.Body.String())
+	}
+	if cr := w.Header().Get("Content-Range"); cr != "bytes 2-4/11" {
+		t.Errorf("Expected Content-Range bytes 2-4/11, got %q", cr)
+	}
+	if n := h.counters.Pending(db.FileDownloads, f.ID); n != 0 {
+		t.Errorf("Expected a range short of the end not to count, got %d", n)
+	}
+
+	if w := get(h.PullFile, target, map[string]string{"Range": "bytes=20-"}); w.Code != http.StatusRequestedRangeNotSatisfiable {
+		t.Errorf("Expected 416 past the end, got %d", w.Code)
+	}
+	if w := get(h.PullFile, target, map[string]string{"If-None-Match": etag}); w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+		t.Errorf("Expected 304 for a matching etag, got %d %q", w.Code, w.Body.String())
+	}
+	// a range of content that changed since is answered with all of it
+	w = get(h.PullFile, target, map[string]string{"Range": "bytes=0-4", "If-Range": `"other"`})
+	if w.Code != http.StatusOK || w.Body.String() != "hello world" {
+		t.Errorf("Expected the whole file for a stale If-Range, got %d %q", w.Code, w.Body.String())
+	}
+	if n := h.counters.Pending(db.FileDownloads, f.ID); n != 1 {
+		t.Errorf("Expected the whole file to count once, got %d", n)
+	}
+
+	req := httptest.NewRequest("HEAD", target, nil)
+	w = httptest.NewRecorder()
+	h.PullFile(w, req)
+	if w.Code != http.StatusOK || w.Body.Len() != 0 || w.Header().Get("Content-Length") != "11" || w.Header().Get("ETag") != etag {
+		t.Errorf("Expected headers only for HEAD, got %d %v %q", w.Code, w.Header(), w.Body.String())
+	}
+}
+
+func TestSendMultipart(t *testing.T) {
+	t.Parallel()
+	h := newTestHandlers(t)
+
+	// the fields before the file part set its lifecycle
+	before := time.Now().Unix()
+	resp := sendFile(t, h, "notes.txt", "some notes", map[string]string{"expires_in": "1h", "max_downloads": "3"})
+	f := mustFile(t, h, resp.PubID)
+	if f.MaxDL != 3 {
+		t.Errorf("Expected max downloads 3, got %d", f.MaxDL)
+	}
+	if f.ExpiresAt < before+3600 || f.ExpiresAt > time.Now().Unix()+3600 || resp.ExpiresAt != f.ExpiresAt {
+		t.Errorf("Expected to expire in an hour, got %d (response %d)", f.ExpiresAt, resp.ExpiresAt)
+	}
+	sum := sha256.Sum256([]byte("some notes"))
+	if f.Meta.OriginalName != "notes.txt" || f.Meta.Size != 10 || f.Meta.Hash != hex.EncodeToString(sum[:]) ||
+		!strings.HasPrefix(f.Meta.FileType, "text/plain") || f.Issuer != "tester" {
+		t.Errorf("Unexpected file %+v", f)
+	}
+
+	for _, tc := range []struct {
+		name, maxDL string
+		file        bool
+	}{
+		{"no file", "3", false},
+		{"invalid field", "many", true},
+	} {
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		mw.WriteField("max_downloads", tc.maxDL)
+		if tc.file {
+			fw, _ := mw.CreateFormFile("file", "notes.txt")
+			io.WriteString(fw, "some notes")
+		}
+		mw.Close()
+		if w := send(h, mw.FormDataContentType(), &body); w.Code != http.StatusBadRequest {
+			t.Errorf("Expected 400 for %s, got %d", tc.name, w.Code)
+		}
+	}
+
+	// without raw the file comes back as metadata.json and the file
+	w := get(h.PullFile, "/api/v1/pull/f?id="+resp.PubID, nil)
+	_, params, err := mime.ParseMediaType(w.Header().Get("Content-Type"))
+	if w.Code != http.StatusOK || err != nil {
+		t.Fatalf("Expected a multipart response, got %d %v", w.Code, err)
+	}
+	mr := multipart.NewReader(w.Body, params["boundary"])
+	part, err := mr.NextPart()
+	if err != nil || part.FileName() != "metadata.json" {
+		t.Fatalf("Expected the metadata part, got %v", err)
+	}
+	var meta map[string]any
+	if err := json.NewDecoder(part).Decode(&meta); err != nil {
+		t.Fatalf("Failed to decode metadata: %v", err)
+	}
+	if meta["filename"] != "notes.txt" || meta["file_pub_id"] != resp.PubID {
+		t.Errorf("Unexpected metadata %v", meta)
+	}
+	part, err = mr.NextPart()
+	if err != nil || part.FileName() != "notes.txt" {
+		t.Fatalf("Expected the file part, got %v", err)
+	}
+	if content, _ := io.ReadAll(part); string(content) != "some notes" {
+		t.Errorf("Expected the file content, got %q", content)
+	}
+}
+
+func TestInlineNotCounted(t *testing.T) {
+	t.Parallel()
+	h := newTestHandlers(t)
+	resp := sendFile(t, h, "pixel.png", "\x89PNG\r\n\x1a\nnot really a png", nil)
+
+	w := get(h.PullFile, "/api/v1/pull/f?raw=true&inline=true&id="+resp.PubID, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected the preview, got %d", w.Code)
+	}
+	if cd := w.Header().Get("Content-Disposition"); !strings.HasPrefix(cd, "inline") {
+		t.Errorf("Expected an inline file, got %q", cd)
+	}
+	if n := h.counters.Pending(db.FileDownloads, mustFile(t, h, resp.PubID).ID); n != 0 {
+		t.Errorf("Expected the preview not to count as a download, got %d", n)
+	}
+}
+
+func mustFile(t *testing.T, h *Handlers, pubID string) *db.File {
+	t.Helper()
+	f, err := h.store.GetFileByPubID(pubID)
+	if err != nil || f == nil {
+		t.Fatalf("Failed to get file %s: %v", pubID, err)
+	}
+	return f
+}
+
+func TestDownloadLimit(t *testing.T) {
+	t.Parallel()
+	h := newTestHandlers(t)
+
+	resp := sendFile(t, h, "once.txt", "only once", map[string]string{"max_downloads": "1"})
+	target := "/api/v1/pull/f?raw=true&id=" + resp.PubID
+	if w := get(h.PullFile, target, nil); w.Code != http.StatusOK {
+		t.Fatalf("Expected first download to succeed, got %d", w.Code)
+	}
+	if w := get(h.PullFile, target, nil); w.Code != http.StatusGone {
+		t.Errorf("Expected 410 after the download limit, got %d", w.Code)
+	}
+
+	// every request for a limited file is a download, whatever it asks for
+	resp = sendFile(t, h, "twice.txt", "only twice", map[string]string{"max_downloads": "2"})
+	target = "/api/v1/pull/f?raw=true&inline=true&id=" + resp.PubID
+	for _, rng := range []string{"bytes=0-3,4-", "bytes=0-3"} {
+		if w := get(h.PullFile, target, map[string]string{"Range": rng}); w.Code != http.StatusPartialContent {
+			t.Fatalf("Expected the range %s, got %d", rng, w.Code)
+		}
+	}
+	if w := get(h.PullFile, target, nil); w.Code != http.StatusGone {
+		t.Errorf("Expected ranges to use up the downloads, got %d", w.Code)
+	}
+
+	// answers without the content don't use up downloads
+	resp = sendFile(t, h, "cached.txt", "only once", map[string]string{"max_downloads": "1"})
+	target = "/api/v1/pull/f?raw=true&id=" + resp.PubID
+	f := mustFile(t, h, resp.PubID)
+	etag := `"` + f.Meta.Hash + `"`
+	if w := get(h.PullFile, target, map[string]string{"If-None-Match": etag}); w.Code != http.StatusNotModified {
+		t.Fatalf("Expected 304 for a matching etag, got %d", w.Code)
+	}
+	if w := get(h.PullFile, target, map[string]string{"If-Match": `"other"`}); w.Code != http.StatusPreconditionFailed {
+		t.Fatalf("Expected 412 for another etag, got %d", w.Code)
+	}
+	w := get(h.PullFile, target, nil)
+	if w.Code != http.StatusOK || w.Body.String() != "only once" {
+		t.Fatalf("Expected the download to be left, got %d %q", w.Code, w.Body.String())
+	}
+	w = get(h.PullFile, target, nil)
+	if w.Code != http.StatusGone || w.Header().Get("Content-Length") != "" || w.Header().Get("ETag") != "" {
+		t.Errorf("Expected a bare 410 once the download is used, got %d %v", w.Code, w.Header())
+	}
+
+	// a file that can't be read keeps its downloads
+	resp = sendFile(t, h, "lost.txt", "nowhere to be found", map[string]string{"max_downloads": "1"})
+	f = mustFile(t, h, resp.PubID)
+	if err := h.blobs.Delete(t.Context(), f.Meta.LocalFileName); err != nil {
+		t.Fatalf("Failed to delete blob: %v", err)
+	}
+	if w := get(h.PullFile, "/api/v1/pull/f?raw=true&id="+resp.PubID, nil); w.Code != http.StatusInternalServerError {
+		t.Fatalf("Expected 500 for a missing blob, got %d", w.Code)
+	}
+	if f = mustFile(t, h, resp.PubID); f.RefDL != 0 {
+		t.Errorf("Expected the failed download not to count, got %d", f.RefDL)
+	}
+
+	// parallel requests don't get past the limit
+	resp = sendFile(t, h, "race.txt", "only once", map[string]string{"max_downloads": "1"})
+	target = "/api/v1/pull/f?raw=true&id=" + resp.PubID
+	codes := make(chan int, 10)
+	var wg sync.WaitGroup
+	for i := 0; i < cap(codes); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			codes <- get(h.PullFile, target, nil).Code
+		}()
+	}
+	wg.Wait()
+	close(codes)
+	served := 0
+	for code := range codes {
+		if code == http.StatusOK {
+			served++
+		}
+	}
+	if served != 1 {
+		t.Errorf("Expected the file to be served once, got %d", served)
+	}
+}
+
+func TestFilePageLimited(t *testing.T) {
+	t.Parallel()
+	h := newTestHandlers(t)
+	resp := sendFile(t, h, "once.txt", "secret text", map[string]string{"max_downloads": "1"})
+
+	req := httptest.NewRequest("GET", "/"+resp.PubID, nil)
+	req.SetPathValue("id", resp.PubID)
+	w := httptest.NewRecorder()
+	h.FilePage(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected the file page, got %d", w.Code)
+	}
+	if page := w.Body.String(); strings.Contains(page, "secret text") || strings.Contains(page, "inline=true") {
+		t.Errorf("Expected no preview of a limited file, got:\n%s", page)
+	}
+	if w := get(h.PullFile, "/api/v1/pull/f?raw=true&id="+resp.PubID, nil); w.Code != http.StatusOK {
+		t.Errorf("Expected the page not to use up the download, got %d", w.Code)
+	}
+}
+
+func TestStoreBlobShared(t *testing.T) {
+	t.Parallel()
+	h := newTestHandlers(t)
+	ctx := context.Background()
+
+	const uploads = 8
+	metas := make(chan *db.FileMeta, uploads)
+	var wg sync.WaitGroup
+	for i := 0; i < uploads; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			meta, err := h.storeBlob(ctx, strings.NewReader("same content"), "same.txt", "")
+			if err != nil {
+				t.Errorf("Failed to store blob: %v", err)
+				return
+			}
+			metas <- meta
+		}()
+	}
+	wg.Wait()
+	close(metas)
+
+	var last *db.FileMeta
+	for meta := range metas {
+		if last != nil {
+			if err := h.releaseBlob(ctx, last.Hash, last.LocalFileName); err != nil {
+				t.Fatalf("Failed to release blob: %v", err)
+			}
+		}
+		last = meta
+	}
+	if _, err := h.blobs.Stat(ctx, last.LocalFileName); err != nil {
+		t.Fatalf("Expected the content to stay while referenced, got %v", err)
+	}
+	if err := h.releaseBlob(ctx, last.Hash, last.LocalFileName); err != nil {
+		t.Fatalf("Failed to release blob: %v", err)
+	}
+	if _, err := h.blobs.Stat(ctx, last.LocalFileName); !errors.Is(err, blobstore.ErrNotExist) {
+		t.Errorf("Expected the content to be deleted with its last reference, got %v", err)
+	}
+}
+
+func TestPreviewKind(t *testing.T) {
+	for fileType, want := range map[string]string{
+		"image/png":                 "image",
+		"video/webm":                "video",
+		"audio/mpeg":                "audio",
+		"application/pdf":           "pdf",
+		"text/plain; charset=utf-8": "text",
+		"text/html; charset=utf-8":  "text",
+		"application/json":          "text",
+		"image/svg+xml":             "",
+		"application/zip":           "",
+		"":                          "",
+		"not a type":                "",
+	} {
+		if got := previewKind(fileType); got != want {
+			t.Errorf("Expected preview %q for %q, got %q", want, fileType, got)
+		}
+	}
+}
+
+// getFilePage runs FilePage for the file with pub id and returns the page
+func getFilePage(t *testing.T, h *Handlers, pubID string) string {
+	t.Helper()
+	req := httptest.NewRequest("GET", "/"+pubID, nil)
+	req.SetPathValue("id", pubID)
+	w := httptest.NewRecorder()
+	h.FilePage(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected the file page, got %d", w.Code)
+	}
+	return w.Body.String()
+}
+
+func TestFilePagePreview(t *testing.T) {
+	t.Parallel()
+	h := newTestHandlers(t)
+
+	resp := sendFile(t, h, "pixel.png", "\x89PNG\r\n\x1a\nnot really a png", nil)
+	page := getFilePage(t, h, resp.PubID)
+	if !strings.Contains(page, `<img src="/api/v1/pull/f?id=`+resp.PubID+`&amp;inline=true&amp;raw=true"`) {
+		t.Errorf("Expected an inline image preview, got:\n%s", page)
+	}
+
+	// text is shown escaped on the page itself, and never served inline
+	resp = sendFile(t, h, "page.html", "<script>alert(1)</script>", nil)
+	page = getFilePage(t, h, resp.PubID)
+	if strings.Contains(page, "<script>") || !strings.Contains(page, "&lt;script&gt;") {
+		t.Errorf("Expected the text preview to be escaped, got:\n%s", page)
+	}
+	w := get(h.PullFile, "/api/v1/pull/f?raw=true&inline=true&id="+resp.PubID, nil)
+	if cd := w.Header().Get("Content-Disposition"); !strings.HasPrefix(cd, "attachment") {
+		t.Errorf("Expected html to be an attachment, got %q", cd)
+	}
+
+	resp = sendFile(t, h, "data.bin", "\x00\x01\x02", nil)
+	if page = getFilePage(t, h, resp.PubID); strings.Contains(page, `class="preview"`) {
+		t.Errorf("Expected no preview of binary content, got:\n%s", page)
+	}
+}
+
+func TestFilePageViews(t *testing.T) {
+	t.Parallel()
+	h := newTestHandlers(t)
+	resp := sendFile(t, h, "seen.txt", "look at me", nil)
+	id := mustFile(t, h, resp.PubID).ID
+
+	for _, method := range []string{"HEAD", "GET"} {
+		req := httptest.NewRequest(method, "/"+resp.PubID, nil)
+		req.SetPathValue("id", resp.PubID)
+		w := httptest.NewRecorder()
+		h.FilePage(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected the file page on %s, got %d", method, w.Code)
+		}
+	}
+	if n := h.counters.Pending(db.FileViews, id); n != 1 {
+		t.Errorf("Expected only the GET to count as a view, got %d", n)
+	}
+}
+
+func TestSendAndPullPost(t *testing.T) {
+	t.Parallel()
+	h := newTestHandlers(t)
+
+	w := send(h, "application/json", strings.NewReader(`{"title":"notes","body":"# hi\n<script>x</script>","format":"markdown"}`))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected status 201, got %d: %s", w.Code, w.Body.String())
+	}
+	var resp SendResponse
+	json.NewDecoder(w.Body).Decode(&resp)
+
+	w = get(h.PullPost, "/api/v1/pull/p?id="+resp.PubID, nil)
+	var post PostResponse
+	err := json.NewDecoder(w.Body).Decode(&post)
+	if err != nil {
+		t.Fatalf("Failed to decode post: %v", err)
+	}
+	if post.Title != "notes" || post.Format != db.PostMarkdown {
+		t.Errorf("Unexpected post %+v", post)
+	}
+
+	req := httptest.NewRequest("GET", "/p/"+resp.PubID, nil)
+	req.SetPathValue("id", resp.PubID)
+	w = httptest.NewRecorder()
+	h.PostPage(w, req)
+	page := w.Body.String()
+	if w.Code != http.StatusOK || !strings.Contains(page, "<h1") || strings.Contains(page, "<script>x") {
+		t.Errorf("Expected rendered and sanitized markdown, got %d:\n%s", w.Code, page)
+	}
+
+	w = send(h, "application/json", strings.NewReader(`{"body":"x","format":"nope"}`))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an unknown format, got %d", w.Code)
+	}
+
+	w = send(h, "application/json", strings.NewReader(`{"body":"once","format":"plain","max_views":1}`))
+	json.NewDecoder(w.Body).Decode(&resp)
+	if w := get(h.PullPost, "/api/v1/pull/p?id="+resp.PubID, nil); w.Code != http.StatusOK {
+		t.Fatalf("Expected the first view, got %d", w.Code)
+	}
+	if w := get(h.PullPost, "/api/v1/pull/p?id="+resp.PubID, nil); w.Code != http.StatusGone {
+		t.Errorf("Expected 410 after the view limit, got %d", w.Code)
+	}
+}
+
+func TestAdminDisable(t *testing.T) {
+	t.Parallel()
+	h := newTestHandlers(t)
+	api := h.AdminAPI()
+
+	resp := sendFile(t, h, "hidden.txt", "secret", nil)
+	req := httptest.NewRequest("POST", "/api/v1/admin/files/"+resp.PubID+"/disable", nil)
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected disable to succeed, got %d", w.Code)
+	}
+	if w := get(h.PullFile, "/api/v1/pull/f?raw=true&id="+resp.PubID, nil); w.Code != http.StatusGone {
+		t.Errorf("Expected 410 for a disabled file, got %d", w.Code)
+	}
+
+	req = httptest.NewRequest("DELETE", "/api/v1/admin/files/"+resp.PubID, nil)
+	w = httptest.NewRecorder()
+	api.ServeHTTP(w, req)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("Expected delete to succeed, got %d", w.Code)
+	}
+	n, _ := h.store.GetFileEntries()
+	if n != 0 {
+		t.Errorf("Expected no files left, got %d", n)
+	}
+}
+
+// upload sends a request to the uploads api as issuer
+func upload(h *Handlers, method, target, issuer string, body io.Reader, header map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, body)
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	req = req.WithContext(auth.WithIdentity(req.Context(), &auth.Identity{Issuer: issuer}))
+	w := httptest.NewRecorder()
+	h.UploadAPI().ServeHTTP(w, req)
+	return w
+}
+
+func patchChunk(h *Handlers, target, offset string, body io.Reader) *httptest.ResponseRecorder {
+	return upload(h, "PATCH", target, "tester", body, map[string]string{
+		"Content-Type":  "application/offset+octet-stream",
+		"Upload-Offset": offset,
+	})
+}
+
+type brokenReader struct{}
+
+func (brokenReader) Read([]byte) (int, error) {
+	return 0, errors.New("connection reset")
+}
+
+func TestResumableUpload(t *testing.T) {
+	t.Parallel()
+	h := newTestHandlers(t)
+
+	w := upload(h, "POST", "/api/v1/uploads", "tester", nil, map[string]string{
+		"Upload-Length":   "11",
+		"Upload-Metadata": "filename " + base64.StdEncoding.EncodeToString([]byte("hello.txt")),
+	})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected status 201, got %d: %s", w.Code, w.Body.String())
+	}
+	loc, err := url.Parse(w.Header().Get("Location"))
+	if err != nil || !strings.HasPrefix(loc.Path, "/api/v1/uploads/") {
+		t.Fatalf("Expected the upload location, got %q", w.Header().Get("Location"))
+	}
+	target := loc.Path
+
+	// the connection drops after "hello", what arrived is kept
+	w = patchChunk(h, target, "0", io.MultiReader(strings.NewReader("hello"), brokenReader{}))
+	if w.Code != http.StatusNoContent || w.Header().Get("Upload-Offset") != "5" {
+		t.Fatalf("Expected the partial chunk to be kept, got %d at offset %q", w.Code, w.Header().Get("Upload-Offset"))
+	}
+	w = upload(h, "HEAD", target, "tester", nil, nil)
+	if w.Code != http.StatusOK || w.Header().Get("Upload-Offset") != "5" || w.Header().Get("Upload-Length") != "11" {
+		t.Errorf("Expected offset 5 of 11, got %d %q of %q", w.Code, w.Header().Get("Upload-Offset"), w.Header().Get("Upload-Length"))
+	}
+	if w = upload(h, "HEAD", target, "someone else", nil, nil); w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for another issuer's upload, got %d", w.Code)
+	}
+	if w = patchChunk(h, target, "0", strings.NewReader("hello")); w.Code != http.StatusConflict {
+		t.Errorf("Expected 409 for a stale offset, got %d", w.Code)
+	}
+	if w = patchChunk(h, target, "5", strings.NewReader(" world and more")); w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected 413 for a chunk past the upload length, got %d", w.Code)
+	}
+
+	// a chunk another server stored at the same offset without advancing the upload is not part of it
+	orphan := uploadPrefix(path.Base(target)) + newChunkName(5)
+	if err = h.blobs.Put(t.Context(), orphan, strings.NewReader(" WORLD"), -1); err != nil {
+		t.Fatalf("Failed to store chunk: %v", err)
+	}
+
+	w = patchChunk(h, target, "5", strings.NewReader(" world"))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected the last chunk to finish the upload, got %d: %s", w.Code, w.Body.String())
+	}
+	var resp SendResponse
+	err = json.NewDecoder(w.Body).Decode(&resp)
+	if err != nil {
+		t.Fatalf("Failed to decode upload response: %v", err)
+	}
+	w = get(h.PullFile, "/api/v1/pull/f?raw=true&id="+resp.PubID, nil)
+	if w.Code != http.StatusOK || w.Body.String() != "hello world" {
+		t.Errorf("Expected the uploaded file, got %d %q", w.Code, w.Body.String())
+	}
+	if f := mustFile(t, h, resp.PubID); f.Meta.OriginalName != "hello.txt" || f.Issuer != "tester" {
+		t.Errorf("Unexpected file %+v", f)
+	}
+
+	if w = upload(h, "HEAD", target, "tester", nil, nil); w.Code != http.StatusNotFound {
+		t.Errorf("Expected the finished upload to be gone, got %d", w.Code)
+	}
+	var keys []string
+	h.blobs.List(t.Context(), "uploads/", func(info blobstore.Info) error {
+		keys = append(keys, info.Key)
+		return nil
+	})
+	if len(keys) != 0 {
+		t.Errorf("Expected no chunks left, got %v", keys)
+	}
+
+	// locks are only taken for uploads that exist, and dropped with them
+	patchChunk(h, "/api/v1/uploads/"+uidgenerator.Generate(), "0", strings.NewReader("hello"))
+	h.uploadLocks.Range(func(k, _ any) bool {
+		t.Errorf("Expected no upload locks left, got %v", k)
+		return true
+	})
+}
+
+func TestFinishUploadRetry(t *testing.T) {
+	t.Parallel()
+	h := newTestHandlers(t)
+
+	// the upload was recorded as a file, then failed to be removed
+	u := &db.Upload{PubID: uidgenerator.Generate(), Issuer: "tester", Length: 5, Offset: 5, Meta: db.UploadMeta{OriginalName: "hello.txt"}}
+	if err := h.store.InsertUpload(u); err != nil {
+		t.Fatalf("Failed to insert upload: %v", err)
+	}
+	f := &db.File{PubID: "test_pub_id", Issuer: "tester", Meta: db.FileMeta{OriginalName: "hello.txt"}}
+	if ok, err := h.store.CompleteUpload(u.PubID, f); err != nil || !ok {
+		t.Fatalf("Failed to complete upload: %v, %v", ok, err)
+	}
+
+	w := patchChunk(h, "/api/v1/uploads/"+u.PubID, "5", strings.NewReader(""))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected the retry to finish the upload, got %d: %s", w.Code, w.Body.String())
+	}
+	var resp SendResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("Failed to decode upload response: %v", err)
+	}
+	if resp.PubID != f.PubID {
+		t.Errorf("Expected the file recorded before, got %s", resp.PubID)
+	}
+	if n, _ := h.store.GetFileEntries(); n != 1 {
+		t.Errorf("Expected 1 file, got %d", n)
+	}
+	if got, _ := h.store.GetUploadByPubID(u.PubID); got != nil {
+		t.Errorf("Expected the upload to be removed, got %+v", got)
+	}
+}
+
+func TestReapStaleUploads(t *testing.T) {
+	t.Parallel()
+	h := newTestHandlers(t)
+	h.uploadTTL = time.Hour
+
+	w := upload(h, "POST", "/api/v1/uploads", "tester", nil, map[string]string{
+		"Upload-Length":   "10",
+		"Upload-Metadata": "filename " + base64.StdEncoding.EncodeToString([]byte("big.iso")),
+	})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected status 201, got %d: %s", w.Code, w.Body.String())
+	}
+	target := strings.TrimPrefix(w.Header().Get("Location"), "http://example.com")
+	if w = patchChunk(h, target, "0", strings.NewReader("12345")); w.Code != http.StatusNoContent {
+		t.Fatalf("Expected the chunk to be stored, got %d", w.Code)
+	}
+
+	h.reap(t.Context(), time.Now())
+	if w = upload(h, "HEAD", target, "tester", nil, nil); w.Code != http.StatusOK {
+		t.Fatalf("Expected a fresh upload to be kept, got %d", w.Code)
+	}
+	h.reap(t.Context(), time.Now().Add(2*time.Hour))
+	if w = upload(h, "HEAD", target, "tester", nil, nil); w.Code != http.StatusNotFound {
+		t.Errorf("Expected a stale upload to be deleted, got %d", w.Code)
+	}
+}
+
+func TestHealthCheckToken(t *testing.T) {
+	t.Parallel()
+	h := newTestHandlers(t)
+	h.SetHealthToken("secret")
+	check := func(token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/health", nil)
+		req.Header.Set("Authorization", token)
+		w := httptest.NewRecorder()
+		h.HealthCheck(w, req)
+		return w
+	}
+
+	if w := check("secret"); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"status":"ok"`) {
+		t.Errorf("Expected the right token to get the health, got %d %s", w.Code, w.Body.String())
+	}
+	for _, token := range []string{"", "secreT", "secret2"} {
+		if w := check(token); w.Body.Len() != 0 {
+			t.Errorf("Expected token %q to get nothing, got %s", token, w.Body.String())
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"femboyz/db"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Lifetime is how long an upload stays available, given as whole seconds or a go duration ("36h").
+type Lifetime time.Duration
+
+func parseLifetime(s string) (Lifetime, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, nil
+	}
+	var d time.Duration
+	if sec, err := strconv.ParseInt(s, 10, 64); err == nil {
+		d = time.Duration(sec) * time.Second
+	} else if d, err = time.ParseDuration(s); err != nil {
+		return 0, errors.New("expires_in is neither seconds nor a duration")
+	}
+	if d < 0 {
+		return 0, errors.New("expires_in is negative")
+	}
+	return Lifetime(d), nil
+}
+
+func (l *Lifetime) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		s = string(b)
+	}
+	v, err := parseLifetime(s)
+	if err != nil {
+		return err
+	}
+	*l = v
+	return nil
+}
+
+// expiresAt turns a lifetime into the unix time stored in the database, 0 for never
+func (l Lifetime) expiresAt(now time.Time) int64 {
+	if l == 0 {
+		return 0
+	}
+	return now.Add(time.Duration(l)).Unix()
+}
+
+func parseLimit(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, nil
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, errors.New("limit is not a positive number")
+	}
+	return n, nil
+}
+
+// fileGone reports whether a file was disabled, expired or was downloaded as often as allowed.
+func (h *Handlers) fileGone(f *db.File, now time.Time) bool {
+	if f.Disabled {
+		return true
+	}
+	if f.ExpiresAt != 0 && now.Unix() >= f.ExpiresAt {
+		return true
+	}
+	return f.MaxDL != 0 && int64(f.RefDL)+h.counters.Pending(db.FileDownloads, f.ID) >= f.MaxDL
+}
+
+// postGone reports whether a post was disabled, expired or was viewed as often as allowed.
+func (h *Handlers) postGone(p *db.Post, now time.Time) bool {
+	if p.Disabled {
+		return true
+	}
+	if p.ExpiresAt != 0 && now.Unix() >= p.ExpiresAt {
+		return true
+	}
+	return p.MaxViews != 0 && int64(p.RefView)+h.counters.Pending(db.PostViews, p.ID) >= p.MaxViews
+}
+
+// reserve counts a download of a file or a view of a post with a limit before it is served, so parallel
+// requests, or requests to other instances, can't get past the limit. Items without a limit are counted
+// by the caller once served, see counters. It writes the error response itself when it returns false.
+func (h *Handlers) reserve(w http.ResponseWriter, loclog, kind string, itemID int64, id, ip string) bool {
+	if status := h.reserveStatus(loclog, kind, itemID, id, ip); status != 0 {
+		w.WriteHeader(status)
+		return false
+	}
+	return true
+}
+
+// reserveStatus is reserve for callers that write the response themselves,
+// it returns the status to answer with when the request can't be served, or 0.
+func (h *Handlers) reserveStatus(loclog, kind string, itemID int64, id, ip string) int {
+	ok, err := h.counters.Reserve(kind, itemID)
+	if err != nil {
+		slog.Error(loclog, "error", "failed to count request", "id", id, "ip", ip, "error", err.Error())
+		return http.StatusInternalServerError
+	}
+	if !ok {
+		slog.Info(loclog, "info", "request limit reached", "id", id, "ip", ip)
+		return http.StatusGone
+	}
+	return 0
+}
+
+// reapBatch is how many gone files are removed per query while reaping
+const reapBatch = 100
+
+// StartReaper deletes gone files, their blobs, gone posts and uploads that received nothing for uploadTTL
+// every interval until StopReaper.
+func (h *Handlers) StartReaper(interval, uploadTTL time.Duration) {
+	loclog := "[handlers.StartReaper]"
+	h.uploadTTL = uploadTTL
+	h.reaperStop = make(chan struct{})
+	h.reaperDone = make(chan struct{})
+	go func() {
+		defer close(h.reaperDone)
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			h.reap(context.Background(), time.Now())
+			select {
+			case <-t.C:
+			case <-h.reaperStop:
+				return
+			}
+		}
+	}()
+	slog.Info(loclog, "info", "reaper started", "interval", interval, "upload_ttl", uploadTTL)
+}
+
+func (h *Handlers) StopReaper() {
+	if h.reaperStop == nil {
+		return
+	}
+	close(h.reaperStop)
+	<-h.reaperDone
+}
+
+func (h *Handlers) reap(ctx context.Context, now time.Time) {
+	loclog := "[handlers.reap]"
+	var removed int
+	for {
+		files, err := h.store.GetGoneFiles(now.Unix(), reapBatch)
+		if err != nil {
+			slog.Error(loclog, "error", "failed to get gone files", "error", err.Error())
+			return
+		}
+		for _, f := range files {
+			err = h.removeFile(ctx, f)
+			if err != nil {
+				slog.Error(loclog, "error", "failed to remove gone file", "pub_id", f.PubID, "error", err.Error())
+				// leave the rest of this round, the same files would come back from the next query
+				return
+			}
+			removed++
+		}
+		if len(files) < reapBatch {
+			break
+		}
+	}
+	posts, err := h.store.DeleteGonePosts(now.Unix())
+	if err != nil {
+		slog.Error(loclog, "error", "failed to delete gone posts", "error", err.Error())
+		return
+	}
+	uploads := h.reapUploads(ctx, now)
+	if removed > 0 || posts > 0 || uploads > 0 {
+		slog.Info(loclog, "info", "gone items deleted", "files", removed, "posts", posts, "uploads", uploads)
+	}
+}
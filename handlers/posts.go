@@ -0,0 +1,331 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"femboyz/clientip"
+	"femboyz/db"
+	"femboyz/pages"
+	"femboyz/uidgenerator"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/alecthomas/chroma/v2"
+	chromahtml "github.com/alecthomas/chroma/v2/formatters/html"
+	"github.com/alecthomas/chroma/v2/lexers"
+	"github.com/alecthomas/chroma/v2/styles"
+	"github.com/microcosm-cc/bluemonday"
+	"github.com/yuin/goldmark"
+	highlighting "github.com/yuin/goldmark-highlighting/v2"
+	"github.com/yuin/goldmark/extension"
+)
+
+// maxPostSize caps the json body of a post upload
+const maxPostSize = 4 << 20
+
+// highlightStyle is the chroma style used for code posts and fenced code in markdown
+const highlightStyle = "github"
+
+var (
+	postTmpl  = template.Must(template.ParseFS(pages.FS, "post.html"))
+	codeFmt   = chromahtml.New(chromahtml.WithClasses(true))
+	highlight = styles.Get(highlightStyle)
+	markdown  = goldmark.New(
+		goldmark.WithExtensions(
+			extension.GFM,
+			highlighting.NewHighlighting(
+				highlighting.WithStyle(highlightStyle),
+				highlighting.WithFormatOptions(chromahtml.WithClasses(true)),
+			),
+		),
+	)
+	// sanitizer keeps user generated markup plus the classes chroma emits
+	sanitizer = func() *bluemonday.Policy {
+		p := bluemonday.UGCPolicy()
+		p.AllowAttrs("class").OnElements("pre", "code", "span")
+		return p
+	}()
+	// highlightCSS is the stylesheet for the chroma classes
+	highlightCSS = func() template.CSS {
+		var buf bytes.Buffer
+		codeFmt.WriteCSS(&buf, highlight)
+		return template.CSS(buf.String())
+	}()
+)
+
+// PostRequest is the json body accepted by Send to create a post
+type PostRequest struct {
+	Title    string `json:"title"`
+	Body     string `json:"body"`
+	Format   string `json:"format"`
+	Language string `json:"language"`
+	// ExpiresIn is seconds or a go duration string, empty for never
+	ExpiresIn Lifetime `json:"expires_in"`
+	MaxViews  int64    `json:"max_views"`
+}
+
+// validate normalizes the request into post content
+func (pr PostRequest) validate() (db.PostContent, string) {
+	c := db.PostContent{
+		Title:    strings.TrimSpace(pr.Title),
+		Body:     pr.Body,
+		Format:   pr.Format,
+		Language: strings.TrimSpace(pr.Language),
+	}
+	if strings.TrimSpace(c.Body) == "" {
+		return c, "body is empty"
+	}
+	switch c.Format {
+	case "":
+		c.Format = db.PostPlain
+	case db.PostPlain, db.PostMarkdown, db.PostCode:
+	default:
+		return c, "unknown format"
+	}
+	if c.Format != db.PostCode {
+		c.Language = ""
+	}
+	if pr.MaxViews < 0 {
+		return c, "max_views is negative"
+	}
+	return c, ""
+}
+
+// sendPost creates a post from a json body, called by Send.
+func (h *Handlers) sendPost(w http.ResponseWriter, r *http.Request, ip, issuer string) {
+	loclog := "[handlers.sendPost]"
+	var pr PostRequest
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxPostSize))
+	err := dec.Decode(&pr)
+	if err != nil {
+		slog.Warn(loclog, "warning", "send post request body not valid", "ip", ip, "error", err.Error())
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	content, problem := pr.validate()
+	if problem != "" {
+		slog.Warn(loclog, "warning", "send post request rejected", "ip", ip, "reason", problem)
+		http.Error(w, problem, http.StatusBadRequest)
+		return
+	}
+
+	pubID, err := newPubID(h.postExists)
+	if err != nil {
+		slog.Error(loclog, "error", "send post request failed to allocate pub id", "ip", ip, "error", err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	p := &db.Post{
+		PubID:     pubID,
+		Content:   content,
+		Issuer:    issuer,
+		ExpiresAt: pr.ExpiresIn.expiresAt(time.Now()),
+		MaxViews:  pr.MaxViews,
+	}
+	err = h.store.InsertPost(p)
+	if err != nil {
+		slog.Error(loclog, "error", "send post request failed to insert post", "ip", ip, "error", err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	slog.Info(loclog, "info", "post created", "pub_id", pubID, "format", content.Format, "issuer", issuer, "ip", ip)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(SendResponse{
+		PubID:     pubID,
+		URL:       publicURL(r, "/p/"+pubID),
+		ExpiresAt: p.ExpiresAt,
+	})
+}
+
+func (h *Handlers) postExists(id string) (bool, error) {
+	p, err := h.store.GetPostByPubID(id)
+	return p != nil, err
+}
+
+// lookupPost resolves a post pub id, writing the error response itself when it returns nil.
+func (h *Handlers) lookupPost(w http.ResponseWriter, loclog, id, ip string) *db.Post {
+	if !uidgenerator.Validate(id) {
+		slog.Warn(loclog, "warning", "post request id not valid", "id", id, "ip", ip)
+		w.WriteHeader(http.StatusNotFound)
+		return nil
+	}
+	p, err := h.store.GetPostByPubID(id)
+	if err != nil {
+		slog.Error(loclog, "error", "post request failed", "id", id, "ip", ip, "error", err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return nil
+	}
+	if p == nil {
+		slog.Warn(loclog, "warning", "post request post not found", "id", id, "ip", ip)
+		w.WriteHeader(http.StatusNotFound)
+		return nil
+	}
+	if h.postGone(p, time.Now()) {
+		slog.Info(loclog, "info", "post request post is gone", "id", id, "ip", ip)
+		w.WriteHeader(http.StatusGone)
+		return nil
+	}
+	return p
+}
+
+// countView counts a view of p, a post with a view limit before it is shown (see reserve).
+// It writes the error response itself when it returns false.
+func (h *Handlers) countView(w http.ResponseWriter, loclog string, p *db.Post, ip string) bool {
+	if p.MaxViews != 0 {
+		return h.reserve(w, loclog, db.PostViews, p.ID, p.PubID, ip)
+	}
+	h.counters.PostView(p.ID)
+	return true
+}
+
+type PostResponse struct {
+	PubID        string `json:"pub_id"`
+	CreationDate string `json:"creation_date"`
+	Title        string `json:"title"`
+	Body         string `json:"body"`
+	Format       string `json:"format"`
+	Language     string `json:"language,omitempty"`
+	Views        int    `json:"views"`
+}
+
+func (h *Handlers) PullPost(w http.ResponseWriter, r *http.Request) {
+	loclog := "[handlers.PullPost]"
+	ip := clientip.FromRequest(r)
+	slog.Info(loclog, "info", "pull post request", "method", r.Method, "ip", ip)
+	// if not GET - drop connection
+	if r.Method != http.MethodGet {
+		slog.Warn(loclog, "warning", "pull post request method not GET", "method", r.Method, "ip", ip)
+		return
+	}
+
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		slog.Warn(loclog, "warning", "pull post request id not provided", "ip", ip)
+		return
+	}
+
+	p := h.lookupPost(w, loclog, id, ip)
+	if p == nil {
+		return
+	}
+	if !h.countView(w, loclog, p, ip) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(PostResponse{
+		PubID:        p.PubID,
+		CreationDate: p.CreationDate,
+		Title:        p.Content.Title,
+		Body:         p.Content.Body,
+		Format:       p.Content.Format,
+		Language:     p.Content.Language,
+		Views:        p.RefView + int(h.counters.Pending(db.PostViews, p.ID)),
+	})
+}
+
+type postPage struct {
+	PubID    string
+	Title    string
+	Format   string
+	Language string
+	Created  time.Time
+	Views    int
+	HTML     template.HTML
+	CSS      template.CSS
+}
+
+func (h *Handlers) PostPage(w http.ResponseWriter, r *http.Request) {
+	loclog := "[handlers.PostPage]"
+	ip := clientip.FromRequest(r)
+	slog.Info(loclog, "info", "post page request", "method", r.Method, "ip", ip)
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	p := h.lookupPost(w, loclog, r.PathValue("id"), ip)
+	if p == nil {
+		return
+	}
+	// HEAD comes from link unfurlers and uptime probes, not readers
+	view := r.Method == http.MethodGet
+	views := p.RefView + int(h.counters.Pending(db.PostViews, p.ID))
+	if view {
+		// the page shows this view, which is counted once the page is ready
+		views++
+	}
+
+	body, err := renderPost(p.Content)
+	if err != nil {
+		slog.Error(loclog, "error", "post page failed to render", "id", p.PubID, "ip", ip, "error", err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	var buf bytes.Buffer
+	err = postTmpl.Execute(&buf, postPage{
+		PubID:    p.PubID,
+		Title:    p.Content.Title,
+		Format:   p.Content.Format,
+		Language: p.Content.Language,
+		Created:  p.CreatedAt(),
+		Views:    views,
+		HTML:     body,
+		CSS:      highlightCSS,
+	})
+	if err != nil {
+		slog.Error(loclog, "error", "post page failed to execute template", "id", p.PubID, "ip", ip, "error", err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	// a page that failed to render doesn't use up a view of a limited post
+	if view && !h.countView(w, loclog, p, ip) {
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf.Bytes())
+}
+
+// renderPost turns post content into html that is safe to embed in the page
+func renderPost(c db.PostContent) (template.HTML, error) {
+	var buf bytes.Buffer
+	switch c.Format {
+	case db.PostMarkdown:
+		err := markdown.Convert([]byte(c.Body), &buf)
+		if err != nil {
+			return "", err
+		}
+		return template.HTML(sanitizer.SanitizeReader(&buf).String()), nil
+	case db.PostCode:
+		lexer := lexers.Get(c.Language)
+		if lexer == nil {
+			lexer = lexers.Analyse(c.Body)
+		}
+		if lexer == nil {
+			lexer = lexers.Fallback
+		}
+		it, err := chroma.Coalesce(lexer).Tokenise(nil, c.Body)
+		if err != nil {
+			return "", err
+		}
+		err = codeFmt.Format(&buf, highlight, it)
+		if err != nil {
+			return "", err
+		}
+		return template.HTML(buf.String()), nil
+	default:
+		buf.WriteString(`<pre class="plain">`)
+		template.HTMLEscape(&buf, []byte(c.Body))
+		buf.WriteString("</pre>")
+		return template.HTML(buf.String()), nil
+	}
+}
@@ -0,0 +1,511 @@
+package handlers
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"femboyz/auth"
+	"femboyz/blobstore"
+	"femboyz/clientip"
+	"femboyz/db"
+	"femboyz/uidgenerator"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tusVersion is the version of the tus protocol the uploads api follows
+const tusVersion = "1.0.0"
+
+// uploadPrefix is where the chunks of an upload are stored until it completes
+func uploadPrefix(pubID string) string {
+	return "uploads/" + pubID + "/"
+}
+
+// newChunkName names a chunk starting at offset, zero padded so names sort by offset.
+// Every attempt at an offset gets its own name, the one that advances the upload is recorded
+// in db.Upload.Chunks and the others only ever delete their own chunk.
+func newChunkName(offset int64) string {
+	return fmt.Sprintf("%020d-%s", offset, uidgenerator.Generate())
+}
+
+// UploadAPI returns the handler for /api/v1/uploads, it must be served behind auth.Require.
+// It follows the tus resumable upload protocol (core and termination):
+//
+//	POST   /api/v1/uploads       creates an upload of Upload-Length bytes, Upload-Metadata carries the
+//	                             base64 "filename", "filetype", "expires_in" and "max_downloads";
+//	                             the Location header is the upload's url
+//	HEAD   /api/v1/uploads/{id}  reports the Upload-Offset received so far
+//	PATCH  /api/v1/uploads/{id}  appends the body (application/offset+octet-stream) at Upload-Offset
+//	DELETE /api/v1/uploads/{id}  abandons the upload
+//
+// A chunk cut short by a dropped connection is kept up to where it stopped, so the client resumes from
+// the offset HEAD reports. The PATCH that completes the upload records the file and answers 201 with
+// a SendResponse. Uploads belong to the issuer that created them and are deleted by the reaper once
+// they received nothing for the upload ttl.
+func (h *Handlers) UploadAPI() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /api/v1/uploads", h.createUpload)
+	mux.HandleFunc("HEAD /api/v1/uploads/{id}", h.headUpload)
+	mux.HandleFunc("PATCH /api/v1/uploads/{id}", h.patchUpload)
+	mux.HandleFunc("DELETE /api/v1/uploads/{id}", h.deleteUpload)
+	return mux
+}
+
+func (h *Handlers) createUpload(w http.ResponseWriter, r *http.Request) {
+	loclog := "[handlers.createUpload]"
+	ip := clientip.FromRequest(r)
+	slog.Info(loclog, "info", "create upload request", "ip", ip)
+	w.Header().Set("Tus-Resumable", tusVersion)
+
+	id := auth.FromContext(r.Context())
+	if id == nil {
+		slog.Warn(loclog, "warning", "create upload request without identity", "ip", ip)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length <= 0 {
+		slog.Warn(loclog, "warning", "create upload request length not valid", "length", r.Header.Get("Upload-Length"), "ip", ip)
+		http.Error(w, "Upload-Length must be a positive number", http.StatusBadRequest)
+		return
+	}
+	meta, err := parseUploadMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		slog.Warn(loclog, "warning", "create upload request metadata not valid", "ip", ip, "error", err.Error())
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	pubID, err := newPubID(h.uploadExists)
+	if err != nil {
+		slog.Error(loclog, "error", "create upload request failed to allocate id", "ip", ip, "error", err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	u := &db.Upload{
+		PubID:  pubID,
+		Issuer: id.Issuer,
+		Length: length,
+		Meta:   *meta,
+	}
+	err = h.store.InsertUpload(u)
+	if err != nil {
+		slog.Error(loclog, "error", "create upload request failed to insert upload", "ip", ip, "error", err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	slog.Info(loclog, "info", "upload created", "upload_id", pubID, "length", length, "issuer", id.Issuer, "ip", ip)
+	w.Header().Set("Location", publicURL(r, "/api/v1/uploads/"+pubID))
+	w.Header().Set("Upload-Offset", "0")
+	w.WriteHeader(http.StatusCreated)
+}
+
+// parseUploadMetadata reads the tus Upload-Metadata header, comma separated "key base64(value)" pairs
+func parseUploadMetadata(header string) (*db.UploadMeta, error) {
+	values := map[string]string{}
+	for pair := range strings.SplitSeq(header, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		key, enc, _ := strings.Cut(pair, " ")
+		v, err := base64.StdEncoding.DecodeString(strings.TrimSpace(enc))
+		if err != nil {
+			return nil, fmt.Errorf("Upload-Metadata %s is not base64", key)
+		}
+		values[key] = string(v)
+	}
+	if values["filename"] == "" {
+		return nil, errors.New("Upload-Metadata has no filename")
+	}
+	lifetime, err := parseLifetime(values["expires_in"])
+	if err != nil {
+		return nil, errors.New("expires_in: " + err.Error())
+	}
+	maxDL, err := parseLimit(values["max_downloads"])
+	if err != nil {
+		return nil, errors.New("max_downloads: " + err.Error())
+	}
+	return &db.UploadMeta{
+		OriginalName: filepath.Base(values["filename"]),
+		FileType:     values["filetype"],
+		ExpiresIn:    int64(time.Duration(lifetime) / time.Second),
+		MaxDL:        maxDL,
+	}, nil
+}
+
+func (h *Handlers) uploadExists(id string) (bool, error) {
+	u, err := h.store.GetUploadByPubID(id)
+	return u != nil, err
+}
+
+// lookupUpload resolves the upload in the path for its issuer, writing the error response itself
+// when it returns nil. Other issuers' uploads are reported as not found.
+func (h *Handlers) lookupUpload(w http.ResponseWriter, r *http.Request, loclog, ip string) *db.Upload {
+	id := auth.FromContext(r.Context())
+	if id == nil {
+		slog.Warn(loclog, "warning", "upload request without identity", "ip", ip)
+		w.WriteHeader(http.StatusUnauthorized)
+		return nil
+	}
+	pubID := r.PathValue("id")
+	if !uidgenerator.Validate(pubID) {
+		slog.Warn(loclog, "warning", "upload request id not valid", "upload_id", pubID, "ip", ip)
+		w.WriteHeader(http.StatusNotFound)
+		return nil
+	}
+	u, err := h.store.GetUploadByPubID(pubID)
+	if err != nil {
+		slog.Error(loclog, "error", "upload request failed", "upload_id", pubID, "ip", ip, "error", err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return nil
+	}
+	if u == nil || u.Issuer != id.Issuer {
+		slog.Warn(loclog, "warning", "upload request upload not found", "upload_id", pubID, "ip", ip)
+		w.WriteHeader(http.StatusNotFound)
+		return nil
+	}
+	return u
+}
+
+// lockUpload keeps two requests from writing to the same upload at once, ok is false while another one is.
+// It is only taken for an upload that was looked up, and unlocking drops the lock once the upload is gone,
+// so requests for made up ids can't grow uploadLocks.
+func (h *Handlers) lockUpload(pubID string) (unlock func(), ok bool) {
+	v, _ := h.uploadLocks.LoadOrStore(pubID, &sync.Mutex{})
+	mu := v.(*sync.Mutex)
+	if !mu.TryLock() {
+		return nil, false
+	}
+	return func() {
+		mu.Unlock()
+		if u, err := h.store.GetUploadByPubID(pubID); err == nil && u == nil {
+			h.uploadLocks.CompareAndDelete(pubID, mu)
+		}
+	}, true
+}
+
+func (h *Handlers) headUpload(w http.ResponseWriter, r *http.Request) {
+	loclog := "[handlers.headUpload]"
+	ip := clientip.FromRequest(r)
+	w.Header().Set("Tus-Resumable", tusVersion)
+	u := h.lookupUpload(w, r, loclog, ip)
+	if u == nil {
+		return
+	}
+	w.Header().Set("Upload-Offset", strconv.FormatInt(u.Offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(u.Length, 10))
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+}
+
+func (h *Handlers) patchUpload(w http.ResponseWriter, r *http.Request) {
+	loclog := "[handlers.patchUpload]"
+	ip := clientip.FromRequest(r)
+	slog.Info(loclog, "info", "upload chunk request", "upload_id", r.PathValue("id"), "ip", ip)
+	w.Header().Set("Tus-Resumable", tusVersion)
+
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		slog.Warn(loclog, "warning", "upload chunk request content type not valid", "type", r.Header.Get("Content-Type"), "ip", ip)
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		slog.Warn(loclog, "warning", "upload chunk request offset not valid", "offset", r.Header.Get("Upload-Offset"), "ip", ip)
+		http.Error(w, "Upload-Offset must be a number", http.StatusBadRequest)
+		return
+	}
+
+	u := h.lookupUpload(w, r, loclog, ip)
+	if u == nil {
+		return
+	}
+	unlock, ok := h.lockUpload(u.PubID)
+	if !ok {
+		slog.Warn(loclog, "warning", "upload chunk request while another is in progress", "upload_id", u.PubID, "ip", ip)
+		w.WriteHeader(http.StatusLocked)
+		return
+	}
+	defer unlock()
+	// the upload may have moved on before the lock was taken
+	if u = h.lookupUpload(w, r, loclog, ip); u == nil {
+		return
+	}
+	if offset != u.Offset {
+		slog.Warn(loclog, "warning", "upload chunk request offset mismatch", "upload_id", u.PubID, "offset", offset, "expected", u.Offset, "ip", ip)
+		w.Header().Set("Upload-Offset", strconv.FormatInt(u.Offset, 10))
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+
+	// a dropped connection cancels the request context, what arrived until then is still stored
+	ctx := context.WithoutCancel(r.Context())
+	err = h.storeChunk(ctx, w, r, u)
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			slog.Warn(loclog, "warning", "upload chunk request goes past the upload length", "upload_id", u.PubID, "ip", ip)
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			return
+		}
+		slog.Error(loclog, "error", "upload chunk request failed to store chunk", "upload_id", u.PubID, "ip", ip, "error", err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Upload-Offset", strconv.FormatInt(u.Offset, 10))
+	if u.Offset < u.Length {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	// an upload that failed to finish is complete but still there, an empty PATCH retries it
+	f, err := h.finishUpload(ctx, u)
+	if err != nil {
+		slog.Error(loclog, "error", "upload chunk request failed to finish upload", "upload_id", u.PubID, "ip", ip, "error", err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusCreated, SendResponse{
+		PubID:     f.PubID,
+		URL:       publicURL(r, "/"+f.PubID),
+		ExpiresAt: f.ExpiresAt,
+	})
+}
+
+// storeChunk stores the request body as the chunk at the upload's offset and advances u past it.
+// A body that breaks off is stored up to where it stopped, one that goes past the upload length is not stored.
+func (h *Handlers) storeChunk(ctx context.Context, w http.ResponseWriter, r *http.Request, u *db.Upload) error {
+	loclog := "[handlers.storeChunk]"
+	body := &cutReader{r: http.MaxBytesReader(w, r.Body, u.Length-u.Offset)}
+	cw := &countingWriter{}
+	name := newChunkName(u.Offset)
+	key := uploadPrefix(u.PubID) + name
+	err := h.blobs.Put(ctx, key, io.TeeReader(body, cw), -1)
+	if err != nil {
+		h.blobs.Delete(ctx, key)
+		return err
+	}
+	var tooLarge *http.MaxBytesError
+	if errors.As(body.err, &tooLarge) || cw.n == 0 {
+		h.blobs.Delete(ctx, key)
+		return body.err
+	}
+	if body.err != nil {
+		slog.Warn(loclog, "warning", "upload chunk cut short, keeping what arrived", "upload_id", u.PubID, "received", cw.n, "error", body.err.Error())
+	}
+	chunks := append(slices.Clone(u.Chunks), name)
+	ok, err := h.store.AdvanceUpload(u.PubID, u.Offset, u.Offset+cw.n, chunks)
+	if err == nil && !ok {
+		err = errors.New("upload offset moved while the chunk was stored")
+	}
+	if err != nil {
+		h.blobs.Delete(ctx, key)
+		return err
+	}
+	u.Offset += cw.n
+	u.Chunks = chunks
+	return nil
+}
+
+// cutReader ends the stream at the first read error instead of failing it, keeping the error in err
+type cutReader struct {
+	r   io.Reader
+	err error
+}
+
+func (c *cutReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	if err != nil && err != io.EOF {
+		c.err = err
+		err = io.EOF
+	}
+	return n, err
+}
+
+// finishUpload stores the chunks of a complete upload as one blob, records it as a file
+// and removes the upload. An upload already recorded as a file is only removed, and its file returned.
+func (h *Handlers) finishUpload(ctx context.Context, u *db.Upload) (*db.File, error) {
+	loclog := "[handlers.finishUpload]"
+	if u.FilePubID != "" {
+		f, err := h.store.GetFileByPubID(u.FilePubID)
+		if err != nil {
+			return nil, err
+		}
+		if f == nil {
+			return nil, fmt.Errorf("upload was recorded as file %s, which is gone", u.FilePubID)
+		}
+		err = h.discardUpload(ctx, u.PubID)
+		if err != nil {
+			return nil, err
+		}
+		return f, nil
+	}
+
+	pubID, err := newPubID(h.fileExists)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, len(u.Chunks))
+	for i, name := range u.Chunks {
+		keys[i] = uploadPrefix(u.PubID) + name
+	}
+
+	chunks := &chunkReader{ctx: ctx, blobs: h.blobs, keys: keys}
+	defer chunks.Close()
+	meta, err := h.storeBlob(ctx, chunks, u.Meta.OriginalName, u.Meta.FileType)
+	if err != nil {
+		return nil, err
+	}
+	if meta.Size != u.Length {
+		h.releaseBlob(ctx, meta.Hash, meta.LocalFileName)
+		return nil, fmt.Errorf("upload chunks hold %d bytes, expected %d", meta.Size, u.Length)
+	}
+
+	f := &db.File{
+		PubID:     pubID,
+		Meta:      *meta,
+		Issuer:    u.Issuer,
+		ExpiresAt: Lifetime(time.Duration(u.Meta.ExpiresIn) * time.Second).expiresAt(time.Now()),
+		MaxDL:     u.Meta.MaxDL,
+	}
+	ok, err := h.store.CompleteUpload(u.PubID, f)
+	if err == nil && !ok {
+		err = errors.New("upload was completed or removed while its chunks were stored")
+	}
+	if err != nil {
+		h.releaseBlob(ctx, meta.Hash, meta.LocalFileName)
+		return nil, err
+	}
+	err = h.discardUpload(ctx, u.PubID)
+	if err != nil {
+		// the file is recorded and the upload names it, a retry or the reaper removes the leftovers
+		slog.Warn(loclog, "warning", "failed to remove completed upload", "upload_id", u.PubID, "error", err.Error())
+	}
+
+	slog.Info(loclog, "info", "file uploaded", "pub_id", pubID, "upload_id", u.PubID, "size", meta.Size, "type", meta.FileType, "issuer", u.Issuer)
+	return f, nil
+}
+
+// discardUpload deletes the upload's chunks, then the upload, so a failure leaves it for the reaper to retry.
+// Every chunk stored under the upload is deleted, including those of attempts that did not advance it.
+func (h *Handlers) discardUpload(ctx context.Context, pubID string) error {
+	var keys []string
+	err := h.blobs.List(ctx, uploadPrefix(pubID), func(i blobstore.Info) error {
+		keys = append(keys, i.Key)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		err = h.blobs.Delete(ctx, key)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = h.store.DeleteUploadByPubID(pubID)
+	return err
+}
+
+func (h *Handlers) deleteUpload(w http.ResponseWriter, r *http.Request) {
+	loclog := "[handlers.deleteUpload]"
+	ip := clientip.FromRequest(r)
+	slog.Info(loclog, "info", "delete upload request", "upload_id", r.PathValue("id"), "ip", ip)
+	w.Header().Set("Tus-Resumable", tusVersion)
+
+	u := h.lookupUpload(w, r, loclog, ip)
+	if u == nil {
+		return
+	}
+	unlock, ok := h.lockUpload(u.PubID)
+	if !ok {
+		slog.Warn(loclog, "warning", "delete upload request while a chunk is in progress", "upload_id", u.PubID, "ip", ip)
+		w.WriteHeader(http.StatusLocked)
+		return
+	}
+	defer unlock()
+	err := h.discardUpload(r.Context(), u.PubID)
+	if err != nil {
+		slog.Error(loclog, "error", "delete upload request failed", "upload_id", u.PubID, "ip", ip, "error", err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	slog.Info(loclog, "info", "upload deleted", "upload_id", u.PubID, "ip", ip)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// chunkReader reads the blobs at keys one after the other
+type chunkReader struct {
+	ctx   context.Context
+	blobs blobstore.BlobStore
+	keys  []string
+	cur   io.ReadCloser
+}
+
+func (c *chunkReader) Read(p []byte) (int, error) {
+	for {
+		if c.cur == nil {
+			if len(c.keys) == 0 {
+				return 0, io.EOF
+			}
+			rc, err := c.blobs.Get(c.ctx, c.keys[0])
+			if err != nil {
+				return 0, err
+			}
+			c.cur, c.keys = rc, c.keys[1:]
+		}
+		n, err := c.cur.Read(p)
+		if err == io.EOF {
+			c.cur.Close()
+			c.cur = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (c *chunkReader) Close() error {
+	if c.cur == nil {
+		return nil
+	}
+	return c.cur.Close()
+}
+
+// reapUploads deletes the uploads that received nothing for the upload ttl and returns how many
+func (h *Handlers) reapUploads(ctx context.Context, now time.Time) int {
+	loclog := "[handlers.reapUploads]"
+	uploads, err := h.store.GetStaleUploads(now.Add(-h.uploadTTL).Unix(), reapBatch)
+	if err != nil {
+		return 0
+	}
+	var removed int
+	for _, u := range uploads {
+		unlock, ok := h.lockUpload(u.PubID)
+		if !ok {
+			// a chunk is arriving right now
+			continue
+		}
+		err = h.discardUpload(ctx, u.PubID)
+		unlock()
+		if err != nil {
+			slog.Error(loclog, "error", "failed to remove stale upload", "upload_id", u.PubID, "error", err.Error())
+			continue
+		}
+		removed++
+	}
+	return removed
+}
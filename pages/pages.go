@@ -0,0 +1,8 @@
+package pages
+
+import "embed"
+
+// FS holds the html templates served by the handlers
+//
+//go:embed *.html
+var FS embed.FS
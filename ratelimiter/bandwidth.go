@@ -0,0 +1,261 @@
+package ratelimiter
+
+import (
+	"errors"
+	"femboyz/clientip"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// BandwidthConfig limits response bodies, rates are bytes per second and 0 means unlimited.
+type BandwidthConfig struct {
+	// Global is shared by every download
+	Global int64
+	// PerIP applies to each anonymous client, PerKey to each api key
+	PerIP  int64
+	PerKey int64
+	// MaxConcurrent is how many downloads one client may run at once
+	MaxConcurrent int
+	// Prefixes groups anonymous clients into the networks limited together
+	Prefixes Prefixes
+}
+
+// maxChunk is the most a throttled write sends at once, every bucket holds at least this much
+const maxChunk = 32 << 10
+
+type bandwidthClient struct {
+	limiter  *rate.Limiter
+	active   int
+	lastSeen time.Time
+}
+
+// Bandwidth throttles the bodies of the responses it wraps and caps concurrent downloads per client.
+// Clients are told apart like in RateLimiter, by api key or else by network.
+type Bandwidth struct {
+	config   BandwidthConfig
+	global   *rate.Limiter
+	identify IdentifyFunc
+	mu       sync.Mutex
+	clients  map[string]*bandwidthClient
+
+	stop, done chan struct{}
+}
+
+func NewBandwidth(config BandwidthConfig, identify IdentifyFunc) *Bandwidth {
+	loclog := "[ratelimiter.NewBandwidth]"
+	if identify == nil {
+		identify = func(*http.Request) Client { return Client{} }
+	}
+	b := &Bandwidth{
+		config:   config,
+		global:   byteLimiter(config.Global),
+		identify: identify,
+		clients:  make(map[string]*bandwidthClient),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+
+	go b.cleanup(time.Minute)
+
+	slog.Info(loclog, "info", "bandwidth limiter initialized", "global", config.Global, "per_ip", config.PerIP, "per_key", config.PerKey, "max_concurrent", config.MaxConcurrent)
+	return b
+}
+
+// byteLimiter returns a bucket refilled at bytesPerSec holding a second's worth, nil for unlimited
+func byteLimiter(bytesPerSec int64) *rate.Limiter {
+	if bytesPerSec <= 0 {
+		return nil
+	}
+	return rate.NewLimiter(rate.Limit(bytesPerSec), int(max(bytesPerSec, maxChunk)))
+}
+
+// setByteRate changes l to bytesPerSec in place, so the downloads waiting on it follow, or makes or drops it
+func setByteRate(l *rate.Limiter, bytesPerSec int64) *rate.Limiter {
+	if l == nil {
+		return byteLimiter(bytesPerSec)
+	}
+	if bytesPerSec <= 0 {
+		// downloads still holding l go on unthrottled
+		l.SetLimit(rate.Inf)
+		return nil
+	}
+	l.SetLimit(rate.Limit(bytesPerSec))
+	l.SetBurst(int(max(bytesPerSec, maxChunk)))
+	return l
+}
+
+// SetConfig applies config to new downloads and changes the rates of the running ones
+func (b *Bandwidth) SetConfig(config BandwidthConfig) {
+	loclog := "[ratelimiter.Bandwidth.SetConfig]"
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.config = config
+	b.global = setByteRate(b.global, config.Global)
+	for id, c := range b.clients {
+		bytesPerSec := config.PerIP
+		if strings.HasPrefix(id, "key:") {
+			bytesPerSec = config.PerKey
+		}
+		c.limiter = setByteRate(c.limiter, bytesPerSec)
+	}
+	slog.Info(loclog, "info", "bandwidth limits changed", "global", config.Global, "per_ip", config.PerIP, "per_key", config.PerKey, "max_concurrent", config.MaxConcurrent)
+}
+
+// acquire counts a download for the client, false when it already runs MaxConcurrent.
+// It returns the client's id and the limiters the download waits for.
+func (b *Bandwidth) acquire(c Client, ip string) (string, []*rate.Limiter, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	id, bytesPerSec := "ip:"+b.config.Prefixes.Key(ip), b.config.PerIP
+	if c.Key != "" {
+		id, bytesPerSec = "key:"+c.Key, b.config.PerKey
+	}
+	bc, exists := b.clients[id]
+	if !exists {
+		bc = &bandwidthClient{limiter: byteLimiter(bytesPerSec)}
+		b.clients[id] = bc
+	}
+	bc.lastSeen = time.Now()
+	if b.config.MaxConcurrent > 0 && bc.active >= b.config.MaxConcurrent {
+		return id, nil, false
+	}
+	bc.active++
+
+	var limiters []*rate.Limiter
+	for _, l := range []*rate.Limiter{b.global, bc.limiter} {
+		if l != nil {
+			limiters = append(limiters, l)
+		}
+	}
+	return id, limiters, true
+}
+
+func (b *Bandwidth) release(id string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if c, ok := b.clients[id]; ok {
+		c.active--
+		c.lastSeen = time.Now()
+	}
+}
+
+func (b *Bandwidth) cleanup(interval time.Duration) {
+	defer close(b.done)
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			b.mu.Lock()
+			for id, c := range b.clients {
+				if c.active == 0 && time.Since(c.lastSeen) > idleVisitor {
+					delete(b.clients, id)
+				}
+			}
+			b.mu.Unlock()
+		case <-b.stop:
+			return
+		}
+	}
+}
+
+// Stop stops dropping idle clients, downloads keep being throttled
+func (b *Bandwidth) Stop() {
+	close(b.stop)
+	<-b.done
+}
+
+// Clients is how many clients are downloading or were recently
+func (b *Bandwidth) Clients() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.clients)
+}
+
+// Middleware throttles the response body of GET requests and answers 429 to a client
+// starting more than MaxConcurrent downloads. Allow-listed clients (see Bans) are not limited.
+func (b *Bandwidth) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet || Allowed(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		id, limiters, ok := b.acquire(b.identify(r), clientip.FromRequest(r))
+		if !ok {
+			slog.Warn("[ratelimiter.Bandwidth]", "warning", "too many concurrent downloads", "identifier", id)
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "too many concurrent downloads", http.StatusTooManyRequests)
+			return
+		}
+		defer b.release(id)
+
+		if len(limiters) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(&throttledWriter{ResponseWriter: w, r: r, limiters: limiters}, r)
+	})
+}
+
+// throttledWriter waits for every limiter before passing body bytes on
+type throttledWriter struct {
+	http.ResponseWriter
+	r        *http.Request
+	limiters []*rate.Limiter
+}
+
+func (tw *throttledWriter) Write(p []byte) (int, error) {
+	var written int
+	for len(p) > 0 {
+		chunk := p[:min(len(p), maxChunk)]
+		for _, l := range tw.limiters {
+			// fails once the client is gone, the write would fail as well
+			if err := l.WaitN(tw.r.Context(), len(chunk)); err != nil {
+				return written, err
+			}
+		}
+		n, err := tw.ResponseWriter.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+func (tw *throttledWriter) Unwrap() http.ResponseWriter {
+	return tw.ResponseWriter
+}
+
+// ParseByteRate reads a byte count per second such as "1048576", "512K" or "10M" (powers of 1024).
+// An empty string is 0, unlimited.
+func ParseByteRate(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, nil
+	}
+	mult := int64(1)
+	switch strings.ToUpper(s[len(s)-1:]) {
+	case "K":
+		mult = 1 << 10
+	case "M":
+		mult = 1 << 20
+	case "G":
+		mult = 1 << 30
+	}
+	if mult > 1 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, errors.New("byte rate is not a positive number")
+	}
+	return n * mult, nil
+}
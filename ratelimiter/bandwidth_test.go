@@ -0,0 +1,100 @@
+package ratelimiter
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestBandwidthThrottle(t *testing.T) {
+	bw := NewBandwidth(BandwidthConfig{PerIP: 32 << 10}, nil)
+	body := bytes.Repeat([]byte("x"), 48<<10)
+	handler := bw.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(body)
+	}))
+
+	req := httptest.NewRequest("GET", "/api/v1/pull/f", nil)
+	req.RemoteAddr = "192.168.1.1:1234"
+	w := httptest.NewRecorder()
+	start := time.Now()
+	handler.ServeHTTP(w, req)
+
+	// the first 32K are the burst, the other 16K take half a second
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Errorf("Expected the body to be throttled, took %v", elapsed)
+	}
+	if w.Body.Len() != len(body) {
+		t.Errorf("Expected %d bytes, got %d", len(body), w.Body.Len())
+	}
+}
+
+func TestBandwidthConcurrent(t *testing.T) {
+	bw := NewBandwidth(BandwidthConfig{MaxConcurrent: 1}, nil)
+	started := make(chan struct{})
+	finish := make(chan struct{})
+	handler := bw.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-finish
+	}))
+	do := func(ip string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/api/v1/pull/f", nil)
+		req.RemoteAddr = ip + ":1234"
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	done := make(chan struct{})
+	go func() {
+		do("192.168.1.1")
+		close(done)
+	}()
+	<-started
+	if w := do("192.168.1.1"); w.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected a second download from the same ip to be refused, got %d", w.Code)
+	}
+	go do("192.168.1.2")
+	<-started
+	finish <- struct{}{}
+	finish <- struct{}{}
+	<-done
+
+	go do("192.168.1.1")
+	<-started
+	finish <- struct{}{}
+}
+
+func TestParseByteRate(t *testing.T) {
+	for s, want := range map[string]int64{"": 0, "1000": 1000, "512K": 512 << 10, "10m": 10 << 20, "1G": 1 << 30} {
+		n, err := ParseByteRate(s)
+		if err != nil || n != want {
+			t.Errorf("Expected %q to be %d, got %d, %v", s, want, n, err)
+		}
+	}
+	for _, s := range []string{"K", "fast", "-1", "1.5M"} {
+		if _, err := ParseByteRate(s); err == nil {
+			t.Errorf("Expected %q to be rejected", s)
+		}
+	}
+}
+
+func TestBandwidthSetConfig(t *testing.T) {
+	bw := NewBandwidth(BandwidthConfig{MaxConcurrent: 1}, nil)
+	if _, _, ok := bw.acquire(Client{}, "192.168.1.1"); !ok {
+		t.Fatalf("Expected the first download to start")
+	}
+	if _, _, ok := bw.acquire(Client{}, "192.168.1.1"); ok {
+		t.Fatalf("Expected a second download to be refused")
+	}
+
+	bw.SetConfig(BandwidthConfig{PerIP: 1 << 10, MaxConcurrent: 2})
+	_, limiters, ok := bw.acquire(Client{}, "192.168.1.1")
+	if !ok {
+		t.Fatalf("Expected the raised limit to let a second download start")
+	}
+	if len(limiters) != 1 || limiters[0].Limit() != 1<<10 {
+		t.Errorf("Expected the running client to be throttled at the new rate, got %v", limiters)
+	}
+}
@@ -0,0 +1,527 @@
+package ratelimiter
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"femboyz/clientip"
+	"femboyz/db"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EscalationConfig tells when a misbehaving client gets banned and for how long.
+type EscalationConfig struct {
+	// MaxRefused is how many 429 answers within Window get a client banned, 0 never bans for them
+	MaxRefused int
+	// MaxNotFound is how many 404 answers within Window get a client banned, 0 never bans for them.
+	// Many misses usually mean someone is guessing ids.
+	MaxNotFound int
+	Window      time.Duration
+	// BaseBan is the first ban of a client, every further one lasts twice the last, up to MaxBan
+	BaseBan time.Duration
+	MaxBan  time.Duration
+	// Prefixes groups clients into the networks that offend and get banned together,
+	// as the rate limiter does, so a host can't escape a ban by moving within its /64
+	Prefixes Prefixes
+}
+
+func DefaultEscalation() EscalationConfig {
+	return EscalationConfig{
+		MaxRefused:  20,
+		MaxNotFound: 30,
+		Window:      10 * time.Minute,
+		BaseBan:     15 * time.Minute,
+		MaxBan:      24 * time.Hour,
+	}
+}
+
+// strikeMemory is how long after a ban ran out it still counts towards the next one
+const strikeMemory = 7 * 24 * time.Hour
+
+// maxOffenders is how many clients Bans counts offences for, evicting the least recently offending when full
+const maxOffenders = DefaultMaxVisitors
+
+type offences struct {
+	subject           string
+	refused, notFound int
+	since             time.Time
+}
+
+// Bans turns clients away by address or network, as listed in the database, and bans the networks
+// (see EscalationConfig.Prefixes) that keep getting refused or keep missing. Allow-listed clients skip
+// every limit instead. The entries in effect are cached in memory and reloaded every minute until Stop,
+// so bans made by other instances sharing the database take up to a minute to apply here.
+type Bans struct {
+	store db.BanStore
+
+	stop, done chan struct{}
+
+	// mu guards config as well, see SetConfig
+	mu     sync.RWMutex
+	config EscalationConfig
+	list   map[string]db.Ban
+	// prefixLens holds the lengths of the networks in list, by whether they are IPv6
+	prefixLens map[bool][]int
+	// offences holds an *offences element of offenders per subject, the most recently offending first
+	offences     map[string]*list.Element
+	offenders    *list.List
+	maxOffenders int
+}
+
+func NewBans(store db.BanStore, config EscalationConfig) (*Bans, error) {
+	loclog := "[ratelimiter.NewBans]"
+	b := &Bans{
+		store:        store,
+		config:       config,
+		offences:     make(map[string]*list.Element),
+		offenders:    list.New(),
+		maxOffenders: maxOffenders,
+		stop:         make(chan struct{}),
+		done:         make(chan struct{}),
+	}
+	if err := b.load(); err != nil {
+		return nil, err
+	}
+
+	go b.refresh(time.Minute)
+
+	slog.Info(loclog, "info", "ban list initialized", "entries", len(b.list), "max_refused", config.MaxRefused, "max_not_found", config.MaxNotFound, "window", config.Window, "base_ban", config.BaseBan, "max_ban", config.MaxBan, "prefixes", config.Prefixes)
+	return b, nil
+}
+
+// load caches the entries in effect, the expired ones are only kept in the database for their strikes
+func (b *Bans) load() error {
+	bans, err := b.store.ListActiveBans(time.Now().Unix())
+	if err != nil {
+		return err
+	}
+	list := make(map[string]db.Ban, len(bans))
+	prefixLens := make(map[bool][]int)
+	for _, ban := range bans {
+		list[ban.Subject] = *ban
+		addPrefixLen(prefixLens, ban.Subject)
+	}
+	b.mu.Lock()
+	b.list = list
+	b.prefixLens = prefixLens
+	b.mu.Unlock()
+	return nil
+}
+
+func (b *Bans) refresh(interval time.Duration) {
+	loclog := "[ratelimiter.Bans.refresh]"
+	defer close(b.done)
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+		case <-b.stop:
+			return
+		}
+
+		n, err := b.store.DeleteBansExpiredBefore(time.Now().Add(-strikeMemory).Unix())
+		if err != nil {
+			slog.Error(loclog, "error", "failed to forget old bans", "error", err.Error())
+		} else if n > 0 {
+			slog.Info(loclog, "info", "old bans forgotten", "count", n)
+		}
+		if err := b.load(); err != nil {
+			slog.Error(loclog, "error", "failed to reload ban list, keeping the old one", "error", err.Error())
+		}
+
+		b.mu.Lock()
+		for e := b.offenders.Front(); e != nil; {
+			next := e.Next()
+			if o := e.Value.(*offences); time.Since(o.since) > b.config.Window {
+				b.forgive(o.subject)
+			}
+			e = next
+		}
+		b.mu.Unlock()
+	}
+}
+
+// Stop stops reloading the list, the cached one keeps applying
+func (b *Bans) Stop() {
+	close(b.stop)
+	<-b.done
+}
+
+// addPrefixLen adds the length of subject to prefixLens if it is a network
+func addPrefixLen(prefixLens map[bool][]int, subject string) {
+	p, err := netip.ParsePrefix(subject)
+	if err != nil {
+		return
+	}
+	is6 := p.Addr().Is6()
+	if !slices.Contains(prefixLens[is6], p.Bits()) {
+		prefixLens[is6] = append(prefixLens[is6], p.Bits())
+	}
+}
+
+// lookup returns the entry still applying to the address ip, or else to a network holding it,
+// and the network ip offends as (see EscalationConfig.Prefixes)
+func (b *Bans) lookup(ip string, now time.Time) (ban db.Ban, ok bool, network string) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	network = b.config.Prefixes.Key(ip)
+	subjects := []string{ip}
+	if a, err := netip.ParseAddr(ip); err == nil {
+		for _, bits := range b.prefixLens[a.Is6()] {
+			subjects = append(subjects, netip.PrefixFrom(a, bits).Masked().String())
+		}
+	}
+	for _, subject := range subjects {
+		ban, ok = b.list[subject]
+		if ok && ban.Active(now.Unix()) {
+			return ban, true, network
+		}
+	}
+	return db.Ban{}, false, network
+}
+
+// forgive drops the offences counted against subject, b.mu must be held
+func (b *Bans) forgive(subject string) {
+	if e, ok := b.offences[subject]; ok {
+		b.offenders.Remove(e)
+		delete(b.offences, subject)
+	}
+}
+
+type allowedKey struct{}
+
+// Allowed reports whether the request comes from an allow-listed client, which no limit applies to
+func Allowed(r *http.Request) bool {
+	allowed, _ := r.Context().Value(allowedKey{}).(bool)
+	return allowed
+}
+
+// Middleware answers 403 to banned clients and marks the requests of allow-listed ones (see Allowed).
+// It must run before the limiters, so it sees their 429 answers.
+func (b *Bans) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		now := time.Now()
+		ban, ok, network := b.lookup(clientip.FromRequest(r), now)
+		if ok {
+			if ban.Allow {
+				next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), allowedKey{}, true)))
+				return
+			}
+			if ban.ExpiresAt != 0 {
+				w.Header().Set("Retry-After", strconv.FormatInt(max(ban.ExpiresAt-now.Unix(), 1), 10))
+			}
+			http.Error(w, "banned", http.StatusForbidden)
+			return
+		}
+
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(sw, r)
+		switch sw.status {
+		case http.StatusTooManyRequests, http.StatusNotFound:
+			b.offend(network, sw.status)
+		}
+	})
+}
+
+// statusWriter remembers the status of the response it passes on
+type statusWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.status, w.wroteHeader = status, true
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(p []byte) (int, error) {
+	w.wroteHeader = true
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// offend counts a 429 or 404 answer against subject, banning it once it had too many within Window
+func (b *Bans) offend(subject string, status int) {
+	b.mu.Lock()
+	var o *offences
+	if e, ok := b.offences[subject]; ok {
+		o = e.Value.(*offences)
+		b.offenders.MoveToFront(e)
+		if time.Since(o.since) > b.config.Window {
+			*o = offences{subject: subject, since: time.Now()}
+		}
+	} else {
+		for b.offenders.Len() >= b.maxOffenders {
+			b.forgive(b.offenders.Back().Value.(*offences).subject)
+		}
+		o = &offences{subject: subject, since: time.Now()}
+		b.offences[subject] = b.offenders.PushFront(o)
+	}
+	reason := ""
+	if status == http.StatusTooManyRequests {
+		o.refused++
+		if b.config.MaxRefused > 0 && o.refused >= b.config.MaxRefused {
+			reason = "too many requests"
+		}
+	} else {
+		o.notFound++
+		if b.config.MaxNotFound > 0 && o.notFound >= b.config.MaxNotFound {
+			reason = "too many misses"
+		}
+	}
+	if reason != "" {
+		b.forgive(subject)
+	}
+	b.mu.Unlock()
+
+	if reason != "" {
+		b.escalate(subject, reason)
+	}
+}
+
+// banDuration is BaseBan doubled once per earlier strike, capped at MaxBan
+func (c EscalationConfig) banDuration(strikes int64) time.Duration {
+	d := c.BaseBan
+	for i := int64(0); i < strikes && d < c.MaxBan; i++ {
+		d *= 2
+	}
+	return min(d, c.MaxBan)
+}
+
+// SetConfig escalates by config from now on, bans already made keep their length
+func (b *Bans) SetConfig(config EscalationConfig) {
+	loclog := "[ratelimiter.Bans.SetConfig]"
+	b.mu.Lock()
+	b.config = config
+	b.mu.Unlock()
+	slog.Info(loclog, "info", "escalation changed", "max_refused", config.MaxRefused, "max_not_found", config.MaxNotFound, "window", config.Window, "base_ban", config.BaseBan, "max_ban", config.MaxBan, "prefixes", config.Prefixes)
+}
+
+// escalate bans subject for longer than the last time, unless it is allow-listed
+func (b *Bans) escalate(subject, reason string) {
+	loclog := "[ratelimiter.Bans.escalate]"
+	prev, err := b.store.GetBan(subject)
+	if err != nil {
+		slog.Error(loclog, "error", "failed to get previous ban", "subject", subject, "error", err.Error())
+		return
+	}
+	var strikes int64
+	if prev != nil {
+		if prev.Allow {
+			return
+		}
+		strikes = prev.Strikes
+	}
+	b.mu.RLock()
+	d := b.config.banDuration(strikes)
+	b.mu.RUnlock()
+	ban := &db.Ban{
+		Subject:   subject,
+		Reason:    reason,
+		Strikes:   strikes + 1,
+		ExpiresAt: time.Now().Add(d).Unix(),
+	}
+	if err := b.put(ban); err != nil {
+		slog.Error(loclog, "error", "failed to store ban", "subject", subject, "error", err.Error())
+		return
+	}
+	slog.Warn(loclog, "warning", "client banned", "subject", subject, "reason", reason, "strikes", ban.Strikes, "duration", d)
+}
+
+// put stores ban and applies it right away
+func (b *Bans) put(ban *db.Ban) error {
+	if err := b.store.PutBan(ban); err != nil {
+		return err
+	}
+	b.mu.Lock()
+	b.list[ban.Subject] = *ban
+	addPrefixLen(b.prefixLens, ban.Subject)
+	b.mu.Unlock()
+	return nil
+}
+
+type BanEntry struct {
+	Subject      string `json:"subject"`
+	Allow        bool   `json:"allow"`
+	Reason       string `json:"reason"`
+	Strikes      int64  `json:"strikes"`
+	ExpiresAt    int64  `json:"expires_at,omitempty"`
+	CreationDate string `json:"creation_date,omitempty"`
+	Active       bool   `json:"active"`
+}
+
+// BanRequest bans or, with allow, allow-lists a client for duration (a go duration, empty for never)
+type BanRequest struct {
+	Allow    bool   `json:"allow"`
+	Duration string `json:"duration"`
+	Reason   string `json:"reason"`
+}
+
+func toBanEntry(ban *db.Ban, now time.Time) BanEntry {
+	return BanEntry{
+		Subject:      ban.Subject,
+		Allow:        ban.Allow,
+		Reason:       ban.Reason,
+		Strikes:      ban.Strikes,
+		ExpiresAt:    ban.ExpiresAt,
+		CreationDate: ban.CreationDate,
+		Active:       ban.Active(now.Unix()),
+	}
+}
+
+// AdminAPI returns the handler for /api/v1/admin/bans, it must be served behind auth.RequireAdmin.
+func (b *Bans) AdminAPI() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/v1/admin/bans", b.adminListBans)
+	// a subject is an address or a network, "2001:db8::/64", whose slash is part of the path
+	mux.HandleFunc("GET /api/v1/admin/bans/{subject...}", b.adminGetBan)
+	mux.HandleFunc("POST /api/v1/admin/bans/{subject...}", b.adminPutBan)
+	mux.HandleFunc("DELETE /api/v1/admin/bans/{subject...}", b.adminDeleteBan)
+	return mux
+}
+
+// parseSubject reads an address or a network in the form Prefixes.Key gives them
+func parseSubject(s string) (string, error) {
+	if !strings.Contains(s, "/") {
+		a, err := netip.ParseAddr(s)
+		if err != nil {
+			return "", err
+		}
+		return a.Unmap().String(), nil
+	}
+	p, err := netip.ParsePrefix(s)
+	if err != nil {
+		return "", err
+	}
+	p = p.Masked()
+	if p.IsSingleIP() {
+		return p.Addr().String(), nil
+	}
+	return p.String(), nil
+}
+
+// pathSubject is the subject in the path, as stored if it parses
+func pathSubject(r *http.Request) string {
+	subject := r.PathValue("subject")
+	if s, err := parseSubject(subject); err == nil {
+		return s
+	}
+	return subject
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func (b *Bans) adminListBans(w http.ResponseWriter, r *http.Request) {
+	loclog := "[ratelimiter.Bans.adminListBans]"
+	bans, err := b.store.ListBans()
+	if err != nil {
+		slog.Error(loclog, "error", "failed to list bans", "error", err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	now := time.Now()
+	entries := make([]BanEntry, 0, len(bans))
+	for _, ban := range bans {
+		entries = append(entries, toBanEntry(ban, now))
+	}
+	writeJSON(w, http.StatusOK, entries)
+}
+
+func (b *Bans) adminGetBan(w http.ResponseWriter, r *http.Request) {
+	loclog := "[ratelimiter.Bans.adminGetBan]"
+	subject := pathSubject(r)
+	ban, err := b.store.GetBan(subject)
+	if err != nil {
+		slog.Error(loclog, "error", "failed to get ban", "subject", subject, "error", err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if ban == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, toBanEntry(ban, time.Now()))
+}
+
+func (b *Bans) adminPutBan(w http.ResponseWriter, r *http.Request) {
+	loclog := "[ratelimiter.Bans.adminPutBan]"
+	subject, err := parseSubject(r.PathValue("subject"))
+	if err != nil {
+		http.Error(w, "subject must be an ip address or network", http.StatusBadRequest)
+		return
+	}
+
+	var req BanRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<10)).Decode(&req); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+	now := time.Now()
+	ban := &db.Ban{Subject: subject, Allow: req.Allow, Reason: req.Reason}
+	if req.Duration != "" {
+		d, err := time.ParseDuration(req.Duration)
+		if err != nil || d <= 0 {
+			http.Error(w, "invalid duration", http.StatusBadRequest)
+			return
+		}
+		ban.ExpiresAt = now.Add(d).Unix()
+	}
+
+	prev, err := b.store.GetBan(subject)
+	if err != nil {
+		slog.Error(loclog, "error", "failed to get previous ban", "subject", subject, "error", err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if prev != nil {
+		ban.Strikes = prev.Strikes
+		ban.CreationDate = prev.CreationDate
+	}
+	if err := b.put(ban); err != nil {
+		slog.Error(loclog, "error", "failed to store ban", "subject", subject, "error", err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	slog.Info(loclog, "info", "ban set by admin", "subject", subject, "allow", ban.Allow, "expires_at", ban.ExpiresAt)
+	writeJSON(w, http.StatusOK, toBanEntry(ban, now))
+}
+
+// adminDeleteBan lifts a ban or allow entry, the subject's strikes are forgotten with it
+func (b *Bans) adminDeleteBan(w http.ResponseWriter, r *http.Request) {
+	loclog := "[ratelimiter.Bans.adminDeleteBan]"
+	subject := pathSubject(r)
+	ok, err := b.store.DeleteBan(subject)
+	if err != nil {
+		slog.Error(loclog, "error", "failed to delete ban", "subject", subject, "error", err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	b.mu.Lock()
+	delete(b.list, subject)
+	b.forgive(subject)
+	b.mu.Unlock()
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	slog.Info(loclog, "info", "ban lifted by admin", "subject", subject)
+	w.WriteHeader(http.StatusNoContent)
+}
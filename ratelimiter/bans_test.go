@@ -0,0 +1,226 @@
+package ratelimiter
+
+import (
+	"femboyz/db"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestBans(t *testing.T, config EscalationConfig) (*Bans, *db.Memory) {
+	store := db.NewMemory()
+	b, err := NewBans(store, config)
+	if err != nil {
+		t.Fatalf("Failed to create ban list: %v", err)
+	}
+	t.Cleanup(b.Stop)
+	return b, store
+}
+
+func TestBansEscalate(t *testing.T) {
+	b, store := newTestBans(t, EscalationConfig{MaxNotFound: 3, Window: time.Minute, BaseBan: time.Minute, MaxBan: 3 * time.Minute})
+	handler := b.Middleware(http.NotFoundHandler())
+	do := func(ip string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/guess", nil)
+		req.RemoteAddr = ip + ":1234"
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	for i := 0; i < 3; i++ {
+		if w := do("192.168.1.1"); w.Code != http.StatusNotFound {
+			t.Fatalf("Expected miss %d to get through, got %d", i+1, w.Code)
+		}
+	}
+	w := do("192.168.1.1")
+	if w.Code != http.StatusForbidden || w.Header().Get("Retry-After") == "" {
+		t.Errorf("Expected the ip to be banned with a Retry-After, got %d %v", w.Code, w.Header())
+	}
+	if w := do("192.168.1.2"); w.Code != http.StatusNotFound {
+		t.Errorf("Expected another ip not to be banned, got %d", w.Code)
+	}
+
+	ban, err := store.GetBan("192.168.1.1")
+	if err != nil || ban == nil {
+		t.Fatalf("Failed to get ban: %v", err)
+	}
+	if ban.Strikes != 1 || ban.Reason != "too many misses" {
+		t.Errorf("Expected a first strike for misses, got %+v", ban)
+	}
+
+	// every further ban lasts twice the last, up to MaxBan
+	for strikes, want := range []time.Duration{time.Minute, 2 * time.Minute, 3 * time.Minute, 3 * time.Minute} {
+		if d := b.config.banDuration(int64(strikes)); d != want {
+			t.Errorf("Expected a ban of %v after %d strikes, got %v", want, strikes, d)
+		}
+	}
+	b.escalate("192.168.1.1", "too many misses")
+	ban, _ = store.GetBan("192.168.1.1")
+	if ban.Strikes != 2 || ban.ExpiresAt < time.Now().Add(2*time.Minute-time.Second).Unix() {
+		t.Errorf("Expected a doubled second ban, got %+v", ban)
+	}
+}
+
+func TestBansNetwork(t *testing.T) {
+	b, store := newTestBans(t, EscalationConfig{MaxNotFound: 3, Window: time.Minute, BaseBan: time.Minute, MaxBan: time.Hour, Prefixes: Prefixes{V6: 64}})
+	handler := b.Middleware(http.NotFoundHandler())
+	do := func(ip string) int {
+		req := httptest.NewRequest("GET", "/guess", nil)
+		req.RemoteAddr = "[" + ip + "]:1234"
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	// a host moving through its /64 offends as one client
+	for _, ip := range []string{"2001:db8::1", "2001:db8::2", "2001:db8::3"} {
+		if code := do(ip); code != http.StatusNotFound {
+			t.Fatalf("Expected the miss from %s to get through, got %d", ip, code)
+		}
+	}
+	if code := do("2001:db8::4"); code != http.StatusForbidden {
+		t.Errorf("Expected the network to be banned, got %d", code)
+	}
+	if code := do("2001:db8:1::1"); code != http.StatusNotFound {
+		t.Errorf("Expected another network not to be banned, got %d", code)
+	}
+	if ban, _ := store.GetBan("2001:db8::/64"); ban == nil || ban.Strikes != 1 {
+		t.Errorf("Expected the network to be banned in the store, got %+v", ban)
+	}
+
+	// offences are kept for a bounded number of clients
+	b.maxOffenders = 2
+	for _, subject := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"} {
+		b.offend(subject, http.StatusNotFound)
+	}
+	if _, ok := b.offences["10.0.0.1"]; ok || len(b.offences) != 2 || b.offenders.Len() != 2 {
+		t.Errorf("Expected the least recent offender to be evicted, got %v", b.offences)
+	}
+}
+
+func TestBansRefused(t *testing.T) {
+	b, _ := newTestBans(t, EscalationConfig{MaxRefused: 2, Window: time.Minute, BaseBan: time.Minute, MaxBan: time.Hour})
+	handler := b.Middleware(NewRateLimiter(0, 1).Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+	codes := []int{}
+	for i := 0; i < 4; i++ {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = "192.168.1.1:1234"
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		codes = append(codes, w.Code)
+	}
+	want := []int{http.StatusOK, http.StatusTooManyRequests, http.StatusTooManyRequests, http.StatusForbidden}
+	for i := range want {
+		if codes[i] != want[i] {
+			t.Errorf("Expected %v, got %v", want, codes)
+			break
+		}
+	}
+}
+
+func TestBansAllowList(t *testing.T) {
+	store := db.NewMemory()
+	store.PutBan(&db.Ban{Subject: "192.168.1.1", Allow: true})
+	store.PutBan(&db.Ban{Subject: "192.168.1.2", Reason: "manual"})
+	store.PutBan(&db.Ban{Subject: "192.168.1.3", ExpiresAt: time.Now().Add(-time.Minute).Unix()})
+	b, err := NewBans(store, EscalationConfig{MaxRefused: 1, Window: time.Minute, BaseBan: time.Minute, MaxBan: time.Hour})
+	if err != nil {
+		t.Fatalf("Failed to create ban list: %v", err)
+	}
+	handler := b.Middleware(NewRateLimiter(0, 1).Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+	do := func(ip string) int {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = ip + ":1234"
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	for i := 0; i < 5; i++ {
+		if code := do("192.168.1.1"); code != http.StatusOK {
+			t.Fatalf("Expected an allow-listed ip not to be limited, got %d", code)
+		}
+	}
+	if code := do("192.168.1.2"); code != http.StatusForbidden {
+		t.Errorf("Expected a permanently banned ip to be refused, got %d", code)
+	}
+	if code := do("192.168.1.3"); code != http.StatusOK {
+		t.Errorf("Expected an expired ban not to apply, got %d", code)
+	}
+
+	b.escalate("192.168.1.1", "too many requests")
+	if ban, _ := store.GetBan("192.168.1.1"); !ban.Allow {
+		t.Errorf("Expected an allow-listed ip never to be banned, got %+v", ban)
+	}
+}
+
+func TestBansAdminAPI(t *testing.T) {
+	b, store := newTestBans(t, DefaultEscalation())
+	api := b.AdminAPI()
+	handler := b.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, req)
+		return w
+	}
+	blocked := func(ip string) bool {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = ip + ":1234"
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Code == http.StatusForbidden
+	}
+
+	if w := do("POST", "/api/v1/admin/bans/not-an-ip", `{}`); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected an invalid subject to be refused, got %d", w.Code)
+	}
+	if w := do("POST", "/api/v1/admin/bans/10.0.0.1", `{"duration":"soon"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected an invalid duration to be refused, got %d", w.Code)
+	}
+	w := do("POST", "/api/v1/admin/bans/10.0.0.1", `{"duration":"1h","reason":"spam"}`)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"active":true`) {
+		t.Fatalf("Failed to ban: %d %s", w.Code, w.Body.String())
+	}
+	if !blocked("10.0.0.1") {
+		t.Errorf("Expected the ban to apply right away")
+	}
+
+	w = do("GET", "/api/v1/admin/bans", "")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"subject":"10.0.0.1"`) {
+		t.Errorf("Expected the ban to be listed, got %d %s", w.Code, w.Body.String())
+	}
+	if w := do("GET", "/api/v1/admin/bans/10.0.0.1", ""); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"reason":"spam"`) {
+		t.Errorf("Expected the ban details, got %d %s", w.Code, w.Body.String())
+	}
+
+	if w := do("DELETE", "/api/v1/admin/bans/10.0.0.1", ""); w.Code != http.StatusNoContent {
+		t.Errorf("Expected the ban to be lifted, got %d", w.Code)
+	}
+	if blocked("10.0.0.1") {
+		t.Errorf("Expected the lifted ban not to apply")
+	}
+	if ban, _ := store.GetBan("10.0.0.1"); ban != nil {
+		t.Errorf("Expected the ban to be gone from the store, got %+v", ban)
+	}
+	if w := do("DELETE", "/api/v1/admin/bans/10.0.0.1", ""); w.Code != http.StatusNotFound {
+		t.Errorf("Expected lifting twice to be 404, got %d", w.Code)
+	}
+
+	// networks of any length can be banned
+	if w := do("POST", "/api/v1/admin/bans/10.1.0.9/24", `{}`); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"subject":"10.1.0.0/24"`) {
+		t.Fatalf("Failed to ban a network: %d %s", w.Code, w.Body.String())
+	}
+	if !blocked("10.1.0.7") || blocked("10.1.1.7") {
+		t.Errorf("Expected the network ban to apply to its addresses only")
+	}
+	if w := do("DELETE", "/api/v1/admin/bans/10.1.0.0/24", ""); w.Code != http.StatusNoContent {
+		t.Errorf("Expected the network ban to be lifted, got %d", w.Code)
+	}
+	if blocked("10.1.0.7") {
+		t.Errorf("Expected the lifted network ban not to apply")
+	}
+}
@@ -0,0 +1,140 @@
+package ratelimiter
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// Policy is a token bucket of Burst requests refilled at Rate per second.
+// A Rate of rate.Inf lets every request through.
+type Policy struct {
+	// Name tells the buckets of different policies apart, the same client gets one bucket per policy
+	Name  string
+	Rate  rate.Limit
+	Burst int
+}
+
+func (p Policy) unlimited() bool {
+	return p.Rate == rate.Inf
+}
+
+// Route applies a policy to the requests matching an http.ServeMux pattern, e.g. "POST /api/v1/send"
+type Route struct {
+	Pattern string
+	Policy  Policy
+}
+
+// Rules decide which policy a request is limited by, the first that applies wins:
+// Issuers for keys of that issuer, Admin for admin keys, the first matching route
+// (the most specific pattern, as in http.ServeMux), Key for other authenticated requests and Default.
+type Rules struct {
+	Default Policy
+	Key     *Policy
+	Admin   *Policy
+	Issuers map[string]Policy
+	Routes  []Route
+	// Prefixes groups anonymous clients into the networks limited together
+	Prefixes Prefixes
+}
+
+// routeMux matches requests against the route patterns, the handler of a pattern is its index in routes
+func (rules Rules) routeMux() (mux *http.ServeMux, err error) {
+	mux = http.NewServeMux()
+	defer func() {
+		// ServeMux panics on invalid and conflicting patterns
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+	for i, route := range rules.Routes {
+		mux.Handle(route.Pattern, routeIndex(i))
+	}
+	return mux, nil
+}
+
+type routeIndex int
+
+func (routeIndex) ServeHTTP(http.ResponseWriter, *http.Request) {}
+
+// ParseRules reads policies from spec, entries separated by ";", each "selector=limit".
+// A selector is a route pattern ("POST /api/v1/send", "/api/v1/pull/"), "key" for authenticated
+// requests, "admin" for admin keys or "issuer:<name>" for the keys of one issuer.
+// A limit is "unlimited" or "<n>/<unit>" with an optional ":<burst>", the burst defaults to n.
+// The unit is s, m, h or a go duration, so "5/m", "100/h:20" and "3/10s" are all limits.
+func ParseRules(spec string, def Policy) (Rules, error) {
+	rules := Rules{Default: def, Issuers: map[string]Policy{}}
+	for entry := range strings.SplitSeq(spec, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		selector, limit, ok := strings.Cut(entry, "=")
+		if !ok {
+			return Rules{}, fmt.Errorf("rate policy %q has no limit", entry)
+		}
+		selector = strings.TrimSpace(selector)
+		p, err := parsePolicy(selector, strings.TrimSpace(limit))
+		if err != nil {
+			return Rules{}, fmt.Errorf("rate policy %q: %w", entry, err)
+		}
+		if issuer, ok := strings.CutPrefix(selector, "issuer:"); ok {
+			rules.Issuers[issuer] = p
+			continue
+		}
+		switch selector {
+		case "key":
+			rules.Key = &p
+		case "admin":
+			rules.Admin = &p
+		default:
+			rules.Routes = append(rules.Routes, Route{Pattern: selector, Policy: p})
+		}
+	}
+	_, err := rules.routeMux()
+	if err != nil {
+		return Rules{}, err
+	}
+	return rules, nil
+}
+
+var units = map[string]time.Duration{
+	"s": time.Second, "sec": time.Second, "second": time.Second,
+	"m": time.Minute, "min": time.Minute, "minute": time.Minute,
+	"h": time.Hour, "hour": time.Hour,
+}
+
+func parsePolicy(name, limit string) (Policy, error) {
+	if limit == "unlimited" {
+		return Policy{Name: name, Rate: rate.Inf}, nil
+	}
+	limit, burstStr, hasBurst := strings.Cut(limit, ":")
+	nStr, unit, ok := strings.Cut(limit, "/")
+	if !ok {
+		return Policy{}, errors.New("limit is neither unlimited nor <n>/<unit>")
+	}
+	n, err := strconv.Atoi(nStr)
+	if err != nil || n <= 0 {
+		return Policy{}, errors.New("limit count is not a positive number")
+	}
+	per, ok := units[unit]
+	if !ok {
+		per, err = time.ParseDuration(unit)
+		if err != nil || per <= 0 {
+			return Policy{}, fmt.Errorf("unknown limit unit %q", unit)
+		}
+	}
+	burst := n
+	if hasBurst {
+		burst, err = strconv.Atoi(burstStr)
+		if err != nil || burst <= 0 {
+			return Policy{}, errors.New("burst is not a positive number")
+		}
+	}
+	return Policy{Name: name, Rate: rate.Limit(float64(n) / per.Seconds()), Burst: burst}, nil
+}
@@ -0,0 +1,45 @@
+package ratelimiter
+
+import (
+	"cmp"
+	"fmt"
+	"net/netip"
+)
+
+// Prefixes are the lengths of the networks whose addresses share one bucket, per address family.
+// Limiting each IPv6 address on its own hardly limits anyone, a single host usually holds a whole /64.
+// Zero lengths stand for the ones of DefaultPrefixes.
+type Prefixes struct {
+	V4 int
+	V6 int
+}
+
+// DefaultPrefixes limits each IPv4 address and each IPv6 /64
+var DefaultPrefixes = Prefixes{V4: 32, V6: 64}
+
+func (p Prefixes) validate() error {
+	if p.V4 < 0 || p.V4 > 32 {
+		return fmt.Errorf("invalid IPv4 prefix length %d", p.V4)
+	}
+	if p.V6 < 0 || p.V6 > 128 {
+		return fmt.Errorf("invalid IPv6 prefix length %d", p.V6)
+	}
+	return nil
+}
+
+// Key returns the network ip belongs to, ip itself when it is not an address
+func (p Prefixes) Key(ip string) string {
+	a, err := netip.ParseAddr(ip)
+	if err != nil {
+		return ip
+	}
+	a = a.WithZone("")
+	bits := cmp.Or(p.V4, DefaultPrefixes.V4)
+	if a.Is6() {
+		bits = cmp.Or(p.V6, DefaultPrefixes.V6)
+	}
+	if bits >= a.BitLen() {
+		return a.String()
+	}
+	return netip.PrefixFrom(a, bits).Masked().String()
+}
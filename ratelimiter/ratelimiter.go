@@ -1,10 +1,12 @@
 package ratelimiter
 
 import (
+	"femboyz/clientip"
+	"io"
 	"log/slog"
-	"net"
 	"net/http"
-	"sync"
+	"strconv"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/time/rate"
@@ -13,69 +15,150 @@ import (
 type Visitor struct {
 	Limiter  *rate.Limiter
 	LastSeen time.Time
+	key      string
 }
 
+// Client is who a request comes from as far as limits go
+type Client struct {
+	// Key identifies the api key of an authenticated request, empty for anonymous requests
+	Key    string
+	Issuer string
+	Admin  bool
+}
+
+// IdentifyFunc tells which api key, if any, a request is made with
+type IdentifyFunc func(r *http.Request) Client
+
 type RateLimiter struct {
-	visitors map[string]*Visitor
-	mu       sync.Mutex
-	rate     rate.Limit
-	burst    int
+	store    Store
+	rules    atomic.Pointer[ruleSet]
+	identify IdentifyFunc
 }
 
-func NewRateLimiter(r rate.Limit, b int) *RateLimiter {
-	loclog := "[ratelimiter.NewRateLimiter]"
-	rl := &RateLimiter{
-		visitors: make(map[string]*Visitor),
-		rate:     r,
-		burst:    b,
-	}
+// ruleSet is Rules with their routes ready to match, swapped as one by SetRules
+type ruleSet struct {
+	Rules
+	routes *http.ServeMux
+}
 
-	go rl.cleanup()
+func newRuleSet(rules Rules) (*ruleSet, error) {
+	if err := rules.Prefixes.validate(); err != nil {
+		return nil, err
+	}
+	routes, err := rules.routeMux()
+	if err != nil {
+		return nil, err
+	}
+	return &ruleSet{Rules: rules, routes: routes}, nil
+}
 
-	slog.Info(loclog, "info", "rate limiter initialized", "rate", r, "burst", b)
+// NewRateLimiter limits every request by one policy per ip, kept in memory.
+func NewRateLimiter(r rate.Limit, b int) *RateLimiter {
+	rl, _ := New(Rules{Default: Policy{Name: "default", Rate: r, Burst: b}}, nil, nil)
 	return rl
 }
 
-func (rl *RateLimiter) getVisitor(ip string) *rate.Limiter {
-	rl.mu.Lock()
-	defer rl.mu.Unlock()
-
-	v, exists := rl.visitors[ip]
-	if !exists {
-		limiter := rate.NewLimiter(rl.rate, rl.burst)
-		rl.visitors[ip] = &Visitor{
-			Limiter:  limiter,
-			LastSeen: time.Now(),
-		}
-		return limiter
+// New limits requests by the policy rules picks for them, with the buckets kept in store (in memory if nil).
+// Authenticated requests, as told by identify, get buckets per api key, all others per network (see Prefixes).
+// identify may be nil when no rule depends on keys.
+func New(rules Rules, store Store, identify IdentifyFunc) (*RateLimiter, error) {
+	loclog := "[ratelimiter.New]"
+	rs, err := newRuleSet(rules)
+	if err != nil {
+		return nil, err
+	}
+	if identify == nil {
+		identify = func(*http.Request) Client { return Client{} }
 	}
+	if store == nil {
+		store = NewMemory(0)
+	}
+	rl := &RateLimiter{
+		store:    store,
+		identify: identify,
+	}
+	rl.rules.Store(rs)
 
-	v.LastSeen = time.Now()
-	return v.Limiter
+	slog.Info(loclog, "info", "rate limiter initialized", "rate", rules.Default.Rate, "burst", rules.Default.Burst, "routes", len(rules.Routes))
+	return rl, nil
 }
 
-func (rl *RateLimiter) cleanup() {
-	for {
-		time.Sleep(time.Minute)
+// SetRules limits the requests from now on by rules. Buckets keep the tokens they have left
+// and are refilled at their policy's new rate from the next request using them.
+func (rl *RateLimiter) SetRules(rules Rules) error {
+	loclog := "[ratelimiter.SetRules]"
+	rs, err := newRuleSet(rules)
+	if err != nil {
+		return err
+	}
+	rl.rules.Store(rs)
+	slog.Info(loclog, "info", "rate limit rules changed", "rate", rules.Default.Rate, "burst", rules.Default.Burst, "routes", len(rules.Routes))
+	return nil
+}
 
-		rl.mu.Lock()
-		for ip, v := range rl.visitors {
-			if time.Since(v.LastSeen) > 3*time.Minute {
-				delete(rl.visitors, ip)
-				slog.Info("[ratelimiter.cleanup]", "info", "visitor removed", "identifier", ip)
-			}
+// Close stops the cleanup of a Memory store, or closes the connections of a Redis one
+func (rl *RateLimiter) Close() error {
+	switch s := rl.store.(type) {
+	case *Memory:
+		s.Stop()
+	case io.Closer:
+		return s.Close()
+	}
+	return nil
+}
+
+// policy picks the policy for a request, see Rules
+func (rs *ruleSet) policy(r *http.Request, c Client) Policy {
+	if c.Key != "" {
+		if p, ok := rs.Issuers[c.Issuer]; ok {
+			return p
+		}
+		if c.Admin && rs.Admin != nil {
+			return *rs.Admin
 		}
-		rl.mu.Unlock()
 	}
+	if h, pattern := rs.routes.Handler(r); pattern != "" {
+		if i, ok := h.(routeIndex); ok {
+			return rs.Routes[i].Policy
+		}
+	}
+	if c.Key != "" && rs.Key != nil {
+		return *rs.Key
+	}
+	return rs.Default
 }
 
+// Middleware answers 429 once a client used up the bucket of the request's policy.
+// Limited responses carry RateLimit-Limit, RateLimit-Remaining and RateLimit-Reset headers
+// and a Retry-After header when refused. Allow-listed clients (see Bans) are not limited.
 func (rl *RateLimiter) Middleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		ip := getRequestIP(r)
+		if Allowed(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		rs := rl.rules.Load()
+		c := rl.identify(r)
+		p := rs.policy(r, c)
+		if p.unlimited() {
+			next.ServeHTTP(w, r)
+			return
+		}
+		id := "ip:" + rs.Prefixes.Key(clientip.FromRequest(r))
+		if c.Key != "" {
+			id = "key:" + c.Key
+		}
 
-		limiter := rl.getVisitor(ip)
-		if !limiter.Allow() {
-			slog.Warn("[ratelimiter]", "info", "rate limit exceeded", "identifier", ip)
+		res, err := rl.store.Allow(r.Context(), p.Name+" "+id, p)
+		if err != nil {
+			// an unreachable store must not take the whole server down with it
+			slog.Error("[ratelimiter]", "error", "failed to count request, letting it through", "identifier", id, "error", err.Error())
+			next.ServeHTTP(w, r)
+			return
+		}
+		setHeaders(w.Header(), p, res)
+		if !res.Allowed {
+			slog.Warn("[ratelimiter]", "info", "rate limit exceeded", "identifier", id, "policy", p.Name)
 			http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
 			return
 		}
@@ -84,11 +167,17 @@ func (rl *RateLimiter) Middleware(next http.Handler) http.Handler {
 	})
 }
 
-func getRequestIP(r *http.Request) string {
-	ip := r.Header.Get("X-Forwarded-For")
-	if ip != "" {
-		return ip
+// setHeaders describes the bucket after the request
+func setHeaders(h http.Header, p Policy, res Result) {
+	h.Set("RateLimit-Limit", strconv.Itoa(p.Burst))
+	h.Set("RateLimit-Remaining", strconv.Itoa(res.Remaining))
+	h.Set("RateLimit-Reset", strconv.Itoa(seconds(res.Reset)))
+	if !res.Allowed {
+		h.Set("Retry-After", strconv.Itoa(max(seconds(res.RetryAfter), 1)))
 	}
-	ip, _, _ = net.SplitHostPort(r.RemoteAddr)
-	return ip
+}
+
+// seconds rounds d up to whole seconds
+func seconds(d time.Duration) int {
+	return int((d + time.Second - 1) / time.Second)
 }
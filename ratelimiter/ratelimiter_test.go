@@ -46,21 +46,189 @@ func TestRateLimiter(t *testing.T) {
 
 func TestRateLimiterCleanup(t *testing.T) {
 	limiter := NewRateLimiter(rate.Limit(1), 1)
+	store := limiter.store.(*Memory)
+	defer store.Stop()
 
-	// Manually inject a visitor with old LastSeen
-	limiter.mu.Lock()
-	limiter.visitors["1.2.3.4"] = &Visitor{
-		Limiter:  rate.NewLimiter(1, 1),
-		LastSeen: time.Now().Add(-5 * time.Minute),
+	p := Policy{Name: "default", Rate: 1, Burst: 1}
+	store.getVisitor("idle", p)
+	store.getVisitor("active", p)
+	store.mu.Lock()
+	store.visitors["idle"].Value.(*Visitor).LastSeen = time.Now().Add(-5 * time.Minute)
+	store.mu.Unlock()
+
+	if n := store.sweep(time.Now()); n != 1 {
+		t.Errorf("Expected one idle visitor to be removed, got %d", n)
+	}
+	if stats := store.Stats(); stats.Visitors != 1 || stats.Expired != 1 {
+		t.Errorf("Expected the active visitor to remain, got %+v", stats)
+	}
+	if _, ok := store.visitors["active"]; !ok {
+		t.Errorf("Expected the active visitor to remain")
+	}
+}
+
+func TestParseRules(t *testing.T) {
+	rules, err := ParseRules("POST /api/v1/send=5/m; /health=unlimited; admin=unlimited; issuer:ci=100/h:20; key=3/10s", Policy{Name: "default"})
+	if err != nil {
+		t.Fatalf("Failed to parse rules: %v", err)
+	}
+	if len(rules.Routes) != 2 || rules.Routes[0].Pattern != "POST /api/v1/send" {
+		t.Fatalf("Expected two routes, got %+v", rules.Routes)
+	}
+	if p := rules.Routes[0].Policy; p.Burst != 5 || p.Rate != rate.Limit(5.0/60) {
+		t.Errorf("Expected 5/m with burst 5, got %+v", p)
+	}
+	if !rules.Routes[1].Policy.unlimited() || rules.Admin == nil || !rules.Admin.unlimited() {
+		t.Errorf("Expected unlimited health and admin policies, got %+v %+v", rules.Routes[1].Policy, rules.Admin)
+	}
+	if p := rules.Issuers["ci"]; p.Burst != 20 || p.Rate != rate.Limit(100.0/3600) {
+		t.Errorf("Expected 100/h with burst 20 for ci, got %+v", p)
+	}
+	if rules.Key == nil || rules.Key.Rate != rate.Limit(0.3) {
+		t.Errorf("Expected 3/10s for keys, got %+v", rules.Key)
+	}
+
+	for _, spec := range []string{"/health", "/health=5", "/health=0/m", "/health=5/fortnight", "/health=5/m:x", "/{id=5/m", "/a=1/s;/a=2/s"} {
+		if _, err := ParseRules(spec, Policy{}); err == nil {
+			t.Errorf("Expected %q to be rejected", spec)
+		}
+	}
+}
+
+func TestPolicies(t *testing.T) {
+	rules, err := ParseRules("POST /api/v1/send=1/m; admin=unlimited", Policy{Name: "default", Rate: 1, Burst: 1})
+	if err != nil {
+		t.Fatalf("Failed to parse rules: %v", err)
+	}
+	limiter, err := New(rules, nil, func(r *http.Request) Client {
+		switch r.Header.Get("Authorization") {
+		case "Bearer ci":
+			return Client{Key: "1", Issuer: "ci"}
+		case "Bearer admin":
+			return Client{Key: "2", Issuer: "root", Admin: true}
+		}
+		return Client{}
+	})
+	if err != nil {
+		t.Fatalf("Failed to create rate limiter: %v", err)
+	}
+	middleware := limiter.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	do := func(method, target, key string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, nil)
+		req.RemoteAddr = "192.168.1.1:1234"
+		if key != "" {
+			req.Header.Set("Authorization", "Bearer "+key)
+		}
+		w := httptest.NewRecorder()
+		middleware.ServeHTTP(w, req)
+		return w
+	}
+
+	// a browser uses up the default bucket of its ip
+	if w := do("GET", "/page", ""); w.Code != http.StatusOK || w.Header().Get("RateLimit-Remaining") != "0" {
+		t.Errorf("Expected the first page to pass with nothing remaining, got %d %q", w.Code, w.Header().Get("RateLimit-Remaining"))
+	}
+	w := do("GET", "/page", "")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "1" {
+		t.Errorf("Expected 429 with Retry-After 1, got %d %q", w.Code, w.Header().Get("Retry-After"))
+	}
+
+	// a key on the same ip has its own buckets, uploads have their own policy
+	if w := do("GET", "/page", "ci"); w.Code != http.StatusOK {
+		t.Errorf("Expected a key to have its own bucket, got %d", w.Code)
+	}
+	if w := do("POST", "/api/v1/send", "ci"); w.Code != http.StatusOK || w.Header().Get("RateLimit-Reset") != "60" {
+		t.Errorf("Expected the upload to pass with a 60s reset, got %d %q", w.Code, w.Header().Get("RateLimit-Reset"))
+	}
+	w = do("POST", "/api/v1/send", "ci")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "60" {
+		t.Errorf("Expected the second upload to wait a minute, got %d %q", w.Code, w.Header().Get("Retry-After"))
 	}
-	limiter.mu.Unlock()
 
-	// Wait for cleanup (cleanup runs every minute)
-	// We can't easily test the background goroutine without making the interval configurable.
-	// For now we'll skip waiting and just trust the logic, or we could modify NewRateLimiter to take an interval option?
-	// Or we can just call cleanup manually in a separate test if we exposed it, but it's private.
-	// Given the constraints and simplicity, I'll rely on code correctness for cleanup or just basic test.
+	for range 5 {
+		if w := do("POST", "/api/v1/send", "admin"); w.Code != http.StatusOK || w.Header().Get("RateLimit-Limit") != "" {
+			t.Fatalf("Expected admin keys to be unlimited, got %d", w.Code)
+		}
+	}
+}
+
+func TestPrefixes(t *testing.T) {
+	for _, c := range []struct {
+		p        Prefixes
+		ip, want string
+	}{
+		{Prefixes{}, "192.168.1.1", "192.168.1.1"},
+		{Prefixes{}, "2001:db8:1:2:3:4:5:6", "2001:db8:1:2::/64"},
+		{Prefixes{V4: 24, V6: 56}, "192.168.1.1", "192.168.1.0/24"},
+		{Prefixes{V4: 24, V6: 56}, "2001:db8:1:2ff::1", "2001:db8:1:200::/56"},
+		{Prefixes{V6: 128}, "fe80::1%eth0", "fe80::1"},
+		{Prefixes{}, "not an ip", "not an ip"},
+	} {
+		if got := c.p.Key(c.ip); got != c.want {
+			t.Errorf("Expected %s to be limited as %s with %+v, got %s", c.ip, c.want, c.p, got)
+		}
+	}
 
-	// Let's not test the background goroutine timing here to avoid slow tests.
-	// We can test the logic if we extract it, but for now the integration is simple.
+	if err := (Prefixes{V4: 33}).validate(); err == nil {
+		t.Errorf("Expected an IPv4 prefix of 33 to be invalid")
+	}
+}
+
+func TestRateLimiterIPv6Prefix(t *testing.T) {
+	limiter := NewRateLimiter(0, 1)
+	handler := limiter.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	do := func(ip string) int {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = "[" + ip + "]:1234"
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	if code := do("2001:db8::1"); code != http.StatusOK {
+		t.Fatalf("Expected the first request to pass, got %d", code)
+	}
+	if code := do("2001:db8::2"); code != http.StatusTooManyRequests {
+		t.Errorf("Expected another address of the same /64 to share the bucket, got %d", code)
+	}
+	if code := do("2001:db8:0:1::1"); code != http.StatusOK {
+		t.Errorf("Expected another /64 to have its own bucket, got %d", code)
+	}
+}
+
+func TestRateLimiterSetRules(t *testing.T) {
+	limiter := NewRateLimiter(0, 1)
+	handler := limiter.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	do := func(ip string) int {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = ip + ":1234"
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	do("192.168.1.1")
+	if code := do("192.168.1.1"); code != http.StatusTooManyRequests {
+		t.Fatalf("Expected the second request to be limited, got %d", code)
+	}
+	if err := limiter.SetRules(Rules{Default: Policy{Name: "default", Rate: 100, Burst: 2}}); err != nil {
+		t.Fatalf("Failed to set rules: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if code := do("192.168.1.2"); code != http.StatusOK {
+			t.Errorf("Expected a new client to get the new burst, got %d on request %d", code, i+1)
+		}
+	}
+	// the empty bucket keeps its tokens and is refilled at the new rate from its next request
+	do("192.168.1.1")
+	time.Sleep(20 * time.Millisecond)
+	if code := do("192.168.1.1"); code != http.StatusOK {
+		t.Errorf("Expected the new rate to refill the bucket, got %d", code)
+	}
+
+	if err := limiter.SetRules(Rules{Prefixes: Prefixes{V4: 33}}); err == nil {
+		t.Errorf("Expected invalid rules to be refused")
+	}
 }
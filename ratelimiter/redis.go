@@ -0,0 +1,72 @@
+package ratelimiter
+
+import (
+	"context"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// redisPrefix namespaces the bucket keys in a redis shared with other applications
+const redisPrefix = "femboyz:ratelimit:"
+
+// gcraScript is the generic cell rate algorithm over the bucket's theoretical arrival time (tat),
+// in microseconds of the redis server's clock so instances with skewed clocks agree.
+// KEYS[1] is the bucket, ARGV[1] the interval between requests, ARGV[2] the burst.
+// Returns allowed (0 or 1), remaining, retry after and reset in microseconds.
+var gcraScript = redis.NewScript(`
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000000 + tonumber(t[2])
+local interval = tonumber(ARGV[1])
+local tolerance = interval * tonumber(ARGV[2])
+local tat = tonumber(redis.call('GET', KEYS[1]) or now)
+if tat < now then
+	tat = now
+end
+local new_tat = tat + interval
+local allow_at = new_tat - tolerance
+if now < allow_at then
+	return {0, 0, allow_at - now, tat - now}
+end
+redis.call('SET', KEYS[1], string.format('%.0f', new_tat), 'PX', math.ceil((new_tat - now) / 1000))
+return {1, math.floor((tolerance - (new_tat - now)) / interval), 0, new_tat - now}
+`)
+
+// Redis is a Store shared by every instance talking to the same redis (or redis protocol) server
+type Redis struct {
+	client redis.UniversalClient
+}
+
+func NewRedis(client redis.UniversalClient) *Redis {
+	return &Redis{client: client}
+}
+
+// NewRedisURL connects to the server at a redis:// or rediss:// url
+func NewRedisURL(url string) (*Redis, error) {
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, err
+	}
+	return NewRedis(redis.NewClient(opts)), nil
+}
+
+func (s *Redis) Allow(ctx context.Context, key string, p Policy) (Result, error) {
+	interval := never
+	if p.Rate > 0 {
+		interval = time.Duration(float64(time.Second) / float64(p.Rate))
+	}
+	v, err := gcraScript.Run(ctx, s.client, []string{redisPrefix + key}, interval.Microseconds(), p.Burst).Int64Slice()
+	if err != nil {
+		return Result{}, err
+	}
+	return Result{
+		Allowed:    v[0] == 1,
+		Remaining:  int(v[1]),
+		RetryAfter: time.Duration(v[2]) * time.Microsecond,
+		Reset:      time.Duration(v[3]) * time.Microsecond,
+	}, nil
+}
+
+func (s *Redis) Close() error {
+	return s.client.Close()
+}
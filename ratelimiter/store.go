@@ -0,0 +1,193 @@
+package ratelimiter
+
+import (
+	"container/list"
+	"context"
+	"log/slog"
+	"math"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// Result is the state of a bucket after a request was counted against it
+type Result struct {
+	Allowed bool
+	// Remaining is how many more requests the bucket allows right now
+	Remaining int
+	// RetryAfter is how long until the next request is allowed, 0 while some remain
+	RetryAfter time.Duration
+	// Reset is how long until the bucket is full again
+	Reset time.Duration
+}
+
+// Store keeps the buckets of every client. Instances sharing a store share their limits.
+type Store interface {
+	// Allow counts one request against the bucket at key, created with policy p if needed
+	Allow(ctx context.Context, key string, p Policy) (Result, error)
+}
+
+// DefaultMaxVisitors is how many buckets a Memory store made with NewMemory(0) holds
+const DefaultMaxVisitors = 100_000
+
+// idleVisitor is how long a bucket is kept after its client was last seen, it is full again by then
+// for any sensible policy
+const idleVisitor = 3 * time.Minute
+
+// Memory is the Store of a single process, its buckets are lost on restart.
+// It holds a bounded number of buckets, evicting the least recently seen client when full.
+type Memory struct {
+	mu       sync.Mutex
+	visitors map[string]*list.Element
+	// lru holds the *Visitor of every bucket, the most recently seen first
+	lru     *list.List
+	max     int
+	evicted uint64
+	expired uint64
+
+	stop, done chan struct{}
+}
+
+// MemoryStats describes the bucket table of a Memory store
+type MemoryStats struct {
+	Visitors int `json:"visitors"`
+	Max      int `json:"max"`
+	// Evicted counts the buckets dropped to make room, Expired the ones dropped for being idle
+	Evicted uint64 `json:"evicted"`
+	Expired uint64 `json:"expired"`
+}
+
+// NewMemory keeps up to max buckets, DefaultMaxVisitors if 0. An evicted client starts over with
+// a full bucket, so max should be well above the number of clients seen within a few minutes.
+// Idle buckets are dropped every minute until Stop is called.
+func NewMemory(max int) *Memory {
+	if max <= 0 {
+		max = DefaultMaxVisitors
+	}
+	m := &Memory{
+		visitors: make(map[string]*list.Element),
+		lru:      list.New(),
+		max:      max,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go m.cleanup(time.Minute)
+	return m
+}
+
+func (m *Memory) getVisitor(key string, p Policy) *rate.Limiter {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	if e, exists := m.visitors[key]; exists {
+		v := e.Value.(*Visitor)
+		v.LastSeen = now
+		m.lru.MoveToFront(e)
+		// the policy changes when the rules are reloaded
+		if v.Limiter.Limit() != p.Rate {
+			v.Limiter.SetLimitAt(now, p.Rate)
+		}
+		if v.Limiter.Burst() != p.Burst {
+			v.Limiter.SetBurstAt(now, p.Burst)
+		}
+		return v.Limiter
+	}
+
+	for m.lru.Len() >= m.max {
+		oldest := m.lru.Back()
+		m.lru.Remove(oldest)
+		delete(m.visitors, oldest.Value.(*Visitor).key)
+		m.evicted++
+	}
+	v := &Visitor{
+		Limiter:  rate.NewLimiter(p.Rate, p.Burst),
+		LastSeen: now,
+		key:      key,
+	}
+	m.visitors[key] = m.lru.PushFront(v)
+	return v.Limiter
+}
+
+func (m *Memory) cleanup(interval time.Duration) {
+	defer close(m.done)
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			if n := m.sweep(time.Now()); n > 0 {
+				slog.Info("[ratelimiter.cleanup]", "info", "idle visitors removed", "count", n, "visitors", m.Stats().Visitors)
+			}
+		case <-m.stop:
+			return
+		}
+	}
+}
+
+// sweep drops the buckets idle at now and returns how many
+func (m *Memory) sweep(now time.Time) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n := 0
+	// the least recently seen are at the back, stop at the first one still in use
+	for e := m.lru.Back(); e != nil; e = m.lru.Back() {
+		v := e.Value.(*Visitor)
+		if now.Sub(v.LastSeen) <= idleVisitor {
+			break
+		}
+		m.lru.Remove(e)
+		delete(m.visitors, v.key)
+		n++
+	}
+	m.expired += uint64(n)
+	return n
+}
+
+// Stop stops dropping idle buckets, the store keeps working
+func (m *Memory) Stop() {
+	close(m.stop)
+	<-m.done
+}
+
+func (m *Memory) Stats() MemoryStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return MemoryStats{
+		Visitors: m.lru.Len(),
+		Max:      m.max,
+		Evicted:  m.evicted,
+		Expired:  m.expired,
+	}
+}
+
+func (m *Memory) Allow(ctx context.Context, key string, p Policy) (Result, error) {
+	limiter := m.getVisitor(key, p)
+	now := time.Now()
+	allowed := limiter.AllowN(now, 1)
+	tokens := limiter.TokensAt(now)
+	res := Result{
+		Allowed:   allowed,
+		Remaining: max(int(tokens), 0),
+		Reset:     refill(float64(p.Burst)-tokens, p.Rate),
+	}
+	if !allowed {
+		res.RetryAfter = refill(1-tokens, p.Rate)
+	}
+	return res, nil
+}
+
+// never stands in for buckets that are not refilled, a day is as good as never for a client
+const never = 24 * time.Hour
+
+// refill is how long it takes to refill n tokens at r
+func refill(n float64, r rate.Limit) time.Duration {
+	if n <= 0 {
+		return 0
+	}
+	if r <= 0 {
+		return never
+	}
+	return time.Duration(math.Ceil(n / float64(r) * float64(time.Second)))
+}
@@ -0,0 +1,110 @@
+package ratelimiter
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+func newTestRedis(t *testing.T) (*Redis, *miniredis.Miniredis) {
+	t.Helper()
+	m := miniredis.RunT(t)
+	s := NewRedis(redis.NewClient(&redis.Options{Addr: m.Addr()}))
+	t.Cleanup(func() { s.Close() })
+	return s, m
+}
+
+// testStore checks a store against a bucket of 2 refilled once a minute
+func testStore(t *testing.T, s Store) {
+	p := Policy{Name: "test", Rate: 1.0 / 60, Burst: 2}
+	want := []Result{
+		{Allowed: true, Remaining: 1, Reset: time.Minute},
+		{Allowed: true, Remaining: 0, Reset: 2 * time.Minute},
+		{Allowed: false, Remaining: 0, RetryAfter: time.Minute, Reset: 2 * time.Minute},
+	}
+	for i, w := range want {
+		res, err := s.Allow(t.Context(), "client", p)
+		if err != nil {
+			t.Fatalf("Failed to count request: %v", err)
+		}
+		// the clock moves on between requests, compare whole seconds
+		if res.Allowed != w.Allowed || res.Remaining != w.Remaining ||
+			seconds(res.RetryAfter) != seconds(w.RetryAfter) || seconds(res.Reset) != seconds(w.Reset) {
+			t.Errorf("Request %d: expected %+v, got %+v", i+1, w, res)
+		}
+	}
+
+	res, err := s.Allow(t.Context(), "other client", p)
+	if err != nil || !res.Allowed {
+		t.Errorf("Expected another client to have its own bucket, got %+v, %v", res, err)
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	testStore(t, NewMemory(0))
+}
+
+func TestMemoryEvicts(t *testing.T) {
+	m := NewMemory(2)
+	defer m.Stop()
+	p := Policy{Name: "test", Rate: 1.0 / 60, Burst: 1}
+	for _, key := range []string{"a", "b", "a", "c"} {
+		m.Allow(t.Context(), key, p)
+	}
+
+	// b was the least recently seen when c came
+	if stats := m.Stats(); stats.Visitors != 2 || stats.Evicted != 1 {
+		t.Errorf("Expected 2 visitors after 1 eviction, got %+v", stats)
+	}
+	if res, _ := m.Allow(t.Context(), "a", p); res.Allowed {
+		t.Errorf("Expected a to keep its bucket")
+	}
+	if res, _ := m.Allow(t.Context(), "b", p); !res.Allowed {
+		t.Errorf("Expected b to start over after being evicted")
+	}
+}
+
+func TestRedisStore(t *testing.T) {
+	s, _ := newTestRedis(t)
+	testStore(t, s)
+}
+
+func TestRedisShared(t *testing.T) {
+	s, m := newTestRedis(t)
+	rules := Rules{Default: Policy{Name: "default", Rate: 1, Burst: 1}}
+	handler := func() http.Handler {
+		rl, err := New(rules, s, nil)
+		if err != nil {
+			t.Fatalf("Failed to create rate limiter: %v", err)
+		}
+		return rl.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		}))
+	}
+	do := func(h http.Handler) int {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = "192.168.1.1:1234"
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	// two instances behind a proxy share the bucket
+	first, second := handler(), handler()
+	if code := do(first); code != http.StatusOK {
+		t.Fatalf("Expected the first request to pass, got %d", code)
+	}
+	if code := do(second); code != http.StatusTooManyRequests {
+		t.Errorf("Expected the other instance to refuse, got %d", code)
+	}
+
+	// an unreachable store lets requests through
+	m.Close()
+	if code := do(first); code != http.StatusOK {
+		t.Errorf("Expected requests to pass without redis, got %d", code)
+	}
+}
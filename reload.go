@@ -0,0 +1,162 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"femboyz/config"
+	"femboyz/env"
+	"femboyz/handlers"
+	"femboyz/ratelimiter"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+)
+
+// reloader applies a new configuration to the running server, on SIGHUP or from the admin api.
+// Settings that are not live (see config.Diff) are reported and take effect on restart.
+type reloader struct {
+	mu      sync.Mutex
+	loader  *config.Loader
+	cfg     *config.Config
+	h       *handlers.Handlers
+	limiter *ratelimiter.RateLimiter
+	bans    *ratelimiter.Bans
+	bw      *ratelimiter.Bandwidth
+	// cors and cert are nil in dev mode, which serves plain http without cors
+	cors *corsHandler
+	cert *certificate
+}
+
+// reloadResult is what the admin api answers a reload with
+type reloadResult struct {
+	Changed []config.Change `json:"changed"`
+}
+
+// reload reads the configuration again and applies it. Nothing is applied when any setting,
+// the rate limit rules or the tls certificate are invalid.
+func (rl *reloader) reload() (reloadResult, error) {
+	loclog := "[server.reload]"
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	if err := env.ReloadEnv(); err != nil {
+		return reloadResult{}, fmt.Errorf("reading .env: %w", err)
+	}
+	cfg, err := rl.loader.Load()
+	if err != nil {
+		return reloadResult{}, err
+	}
+	rules, err := rateRules(cfg)
+	if err != nil {
+		return reloadResult{}, err
+	}
+	bc, err := bandwidthConfig(cfg)
+	if err != nil {
+		return reloadResult{}, err
+	}
+	var cert *tls.Certificate
+	if rl.cert != nil {
+		// the files are read even when their paths are the same, they may have been renewed
+		cert, err = loadCertificate(cfg)
+		if err != nil {
+			return reloadResult{}, err
+		}
+	}
+	if err := rl.limiter.SetRules(rules); err != nil {
+		return reloadResult{}, err
+	}
+
+	rl.bw.SetConfig(bc)
+	rl.bans.SetConfig(escalationConfig(cfg))
+	rl.h.SetHealthToken(cfg.HealthCheckToken)
+	if rl.cors != nil {
+		rl.cors.set(cfg)
+	}
+	if rl.cert != nil {
+		rl.cert.cert.Store(cert)
+	}
+
+	result := reloadResult{Changed: config.Diff(rl.cfg, cfg)}
+	rl.cfg = cfg
+	for _, c := range result.Changed {
+		if c.Live {
+			slog.Info(loclog, "info", "setting changed", "key", c.Key, "old", c.Old, "new", c.New)
+		} else {
+			slog.Warn(loclog, "warning", "setting changed, restart to apply it", "key", c.Key, "old", c.Old, "new", c.New)
+		}
+	}
+	slog.Info(loclog, "info", "configuration reloaded", "changed", len(result.Changed))
+	return result, nil
+}
+
+// watch reloads on every SIGHUP
+func (rl *reloader) watch() {
+	loclog := "[server.reloader.watch]"
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			slog.Info(loclog, "info", "SIGHUP received, reloading configuration")
+			if _, err := rl.reload(); err != nil {
+				slog.Error(loclog, "error", "reload failed, keeping the configuration in effect", "error", err.Error())
+			}
+		}
+	}()
+}
+
+// ServeHTTP reloads on POST /api/v1/admin/reload and answers what changed,
+// or 400 with every invalid setting
+func (rl *reloader) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	loclog := "[server.reloader.ServeHTTP]"
+	result, err := rl.reload()
+	if err != nil {
+		slog.Error(loclog, "error", "reload failed, keeping the configuration in effect", "error", err.Error())
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// corsHandler applies the cors settings, which reload can change while serving
+type corsHandler struct {
+	next    http.Handler
+	handler atomic.Pointer[http.Handler]
+}
+
+func newCORSHandler(cfg *config.Config, next http.Handler) *corsHandler {
+	c := &corsHandler{next: next}
+	c.set(cfg)
+	return c
+}
+
+func (c *corsHandler) set(cfg *config.Config) {
+	handler := newCORS(cfg).Handler(c.next)
+	c.handler.Store(&handler)
+}
+
+func (c *corsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	(*c.handler.Load()).ServeHTTP(w, r)
+}
+
+// certificate is the tls certificate served, which reload can change while serving
+type certificate struct {
+	cert atomic.Pointer[tls.Certificate]
+}
+
+func loadCertificate(cfg *config.Config) (*tls.Certificate, error) {
+	cert, err := tls.LoadX509KeyPair(cfg.TLSCertPath, cfg.TLSKeyPath)
+	if err != nil {
+		return nil, fmt.Errorf("loading tls certificate: %w", err)
+	}
+	return &cert, nil
+}
+
+func (c *certificate) get(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return c.cert.Load(), nil
+}
@@ -1,107 +1,411 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"expvar"
+	"femboyz/auth"
+	"femboyz/blobstore"
+	"femboyz/clientip"
+	"femboyz/config"
+	"femboyz/counters"
 	"femboyz/db"
 	"femboyz/env"
 	"femboyz/handlers"
 	"femboyz/ratelimiter"
+	"flag"
+	"fmt"
 	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
-	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/lmittmann/tint"
 	"github.com/rs/cors"
-	"golang.org/x/time/rate"
 )
 
-var devMode bool
-
 func init() {
 	logger := slog.New(tint.NewHandler(os.Stderr, &tint.Options{
 		Level:      slog.LevelDebug,
 		TimeFormat: "Jan 02 15:04",
 	}))
 	slog.SetDefault(logger)
+}
 
-	env.LoadEnv()
-	devMode = env.DevMode.Get() == "true"
-	db.InitDB()
-	handlers.Init()
-
-	// test fetching files
-	// temporary putting an entry in the database manually
-	db.InsertFile(&db.File{
-		PubID: "12345ABCDF",
-		Meta: db.FileMeta{
-			OriginalName:  "YTMusicUltimate_v1.4.1_YTM6.03.1.ipa",
-			Size:          1024,
-			FileType:      "application/octet-stream",
-			Hash:          "test",
-			LocalFileName: "SAFHWLEFKSDNMWBEMM",
-		},
-		Issuer: "test",
+// start sets up the handlers over store and starts the background workers
+func start(cfg *config.Config, store db.Store) (*handlers.Handlers, *counters.Counters) {
+	bs, err := blobstore.New(cfg.BlobBackend, cfg.BlobPath, blobstore.S3Options{
+		Endpoint:  cfg.S3Endpoint,
+		Bucket:    cfg.S3Bucket,
+		Region:    cfg.S3Region,
+		AccessKey: cfg.S3AccessKey,
+		SecretKey: cfg.S3SecretKey,
+		UseSSL:    cfg.S3UseSSL,
 	})
-
+	if err != nil {
+		slog.Error("[server.start]", "FATAL", "failed to set up blob store", "error", err.Error())
+		os.Exit(1)
+	}
+	c := counters.New(store)
+	c.Start(cfg.CounterFlushInterval)
+	h := handlers.New(store, bs, c)
+	h.SetHealthToken(cfg.HealthCheckToken)
+	h.StartReaper(cfg.ReaperInterval, cfg.UploadTTL)
+	return h, c
 }
 
 func main() {
+	newKey := flag.String("new-key", "", "create an api key for the given issuer, print it and exit")
+	admin := flag.Bool("admin", false, "with -new-key, create an admin key")
+	revokeKey := flag.String("revoke-key", "", "revoke the api keys with the given prefix and exit")
+	listKeys := flag.Bool("list-keys", false, "list api keys and exit")
+	migrateDryRun := flag.Bool("migrate-dry-run", false, "print the pending schema migrations without applying them and exit")
+	printConfig := flag.Bool("print-config", false, "print the configuration in effect, and where each value came from, and exit")
+	loader := newLoader(flag.CommandLine)
+	flag.Parse()
+
+	env.LoadEnv()
+	cfg := config.MustLoad(loader)
+	if *printConfig {
+		cfg.Print(os.Stdout)
+		return
+	}
+	if *migrateDryRun {
+		dryRunMigrations(cfg)
+		return
+	}
+	store := db.InitDB(cfg.DBDSN, cfg.DBPath)
+	if *newKey != "" || *revokeKey != "" || *listKeys {
+		manageKeys(store, *newKey, *admin, *revokeKey, *listKeys)
+		return
+	}
+	h, c := start(cfg, store)
+
 	mux := http.NewServeMux()
 
-	mux.HandleFunc("/health", handlers.HealthCheck)
-	mux.HandleFunc("/admin", handlers.Admin)
-	mux.HandleFunc("/{id}", handlers.FilePage)
-	mux.HandleFunc("/p/{id}", handlers.PostPage)
-	mux.HandleFunc("/api/v1/send", handlers.Send)
-	mux.HandleFunc("/api/v1/pull/f", handlers.PullFile)
-	mux.HandleFunc("/api/v1/pull/p", handlers.PullPost)
-
-	rl, _ := strconv.ParseFloat(env.RateLimit.Get(), 64)
-	rb, _ := strconv.Atoi(env.RateBurst.Get())
-	limiter := ratelimiter.NewRateLimiter(rate.Limit(rl), rb)
+	mux.HandleFunc("/health", h.HealthCheck)
+	mux.HandleFunc("/admin", h.Admin)
+	mux.HandleFunc("/{id}", h.FilePage)
+	mux.HandleFunc("/p/{id}", h.PostPage)
+	mux.Handle("/api/v1/send", auth.Require(store, transfer(cfg.TransferTimeout, http.HandlerFunc(h.Send))))
+	uploads := auth.Require(store, transfer(cfg.TransferTimeout, h.UploadAPI()))
+	mux.Handle("/api/v1/uploads", uploads)
+	mux.Handle("/api/v1/uploads/", uploads)
+	bw := newBandwidth(cfg, store)
+	mux.Handle("/api/v1/pull/f", bw.Middleware(transfer(cfg.TransferTimeout, http.HandlerFunc(h.PullFile))))
+	mux.HandleFunc("/api/v1/pull/p", h.PullPost)
+	mux.Handle("/api/v1/admin/", auth.RequireAdmin(store, h.AdminAPI()))
+	bans := newBans(cfg, store)
+	banAPI := auth.RequireAdmin(store, bans.AdminAPI())
+	mux.Handle("/api/v1/admin/bans", banAPI)
+	mux.Handle("/api/v1/admin/bans/", banAPI)
+	mux.Handle("GET /api/v1/admin/metrics", auth.RequireAdmin(store, expvar.Handler()))
+
+	limiter := newRateLimiter(cfg, store)
 	handler := limiter.Middleware(mux)
+	// banned clients are turned away before their key is looked up
+	handler = auth.Identify(store, handler)
+	handler = bans.Middleware(handler)
+	trusted, err := trustedProxies(cfg)
+	if err != nil {
+		slog.Error("[server.main]", "FATAL", "invalid trusted proxies", "error", err.Error())
+		os.Exit(1)
+	}
+	handler = clientip.New(trusted, cfg.TrustedProxyHeader).Middleware(handler)
 
-	if devMode {
-		serve(handler)
-	} else {
-		serveTLS(handler)
+	live := &reloader{loader: loader, cfg: cfg, h: h, limiter: limiter, bans: bans, bw: bw}
+	mux.Handle("POST /api/v1/admin/reload", auth.RequireAdmin(store, live))
+
+	if !cfg.Dev {
+		live.cors = newCORSHandler(cfg, handler)
+		live.cert = &certificate{}
+		cert, err := loadCertificate(cfg)
+		if err != nil {
+			slog.Error("[server.main]", "FATAL", "failed to load tls certificate", "error", err.Error())
+			os.Exit(1)
+		}
+		live.cert.cert.Store(cert)
+		handler = live.cors
+	}
+	flight := &inFlight{}
+	srv := newServer(cfg, flight.Middleware(handler), live.cert)
+	live.watch()
+
+	code := 0
+	served := make(chan error, 1)
+	go func() { served <- serve(srv) }()
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case err := <-served:
+		slog.Error("[server.main]", "error", "serving failed", "addr", srv.Addr, "error", err.Error())
+		// the connections accepted before are still served
+		shutdown(srv, flight, cfg.ShutdownTimeout, handlerGrace)
+		code = 1
+	case sig := <-stop:
+		// a second signal kills the process right away
+		signal.Stop(stop)
+		slog.Info("[server.main]", "info", "shutting down", "signal", sig.String(), "timeout", cfg.ShutdownTimeout)
+		shutdown(srv, flight, cfg.ShutdownTimeout, handlerGrace)
 	}
 
+	// the handlers are done with everything below, and the reaper and counters write to the database,
+	// so it is closed last
+	h.StopReaper()
+	c.Stop()
+	bans.Stop()
+	bw.Stop()
+	if err := limiter.Close(); err != nil {
+		slog.Error("[server.main]", "error", "failed to close rate limit store", "error", err.Error())
+	}
+	if err := store.Close(); err != nil {
+		slog.Error("[server.main]", "error", "failed to close database", "error", err.Error())
+		code = 1
+	}
+	slog.Info("[server.main]", "info", "stopped")
+	os.Exit(code)
 }
 
-func serve(h http.Handler) {
-	loclog := "[server.serve]"
-	host := env.DevHost.Get()
-	port := env.DevPort.Get()
-	slog.Info(loclog, "info", "serving on", "host", host, "port", port)
-	err := http.ListenAndServe(host+":"+port, h)
+// transfer lets uploads and downloads run past the server's read and write timeouts, up to timeout
+func transfer(timeout time.Duration, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		loclog := "[server.transfer]"
+		rc := http.NewResponseController(w)
+		deadline := time.Now().Add(timeout)
+		if err := rc.SetReadDeadline(deadline); err != nil {
+			slog.Warn(loclog, "warning", "failed to extend read deadline", "path", r.URL.Path, "error", err.Error())
+		}
+		if err := rc.SetWriteDeadline(deadline); err != nil {
+			slog.Warn(loclog, "warning", "failed to extend write deadline", "path", r.URL.Path, "error", err.Error())
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// newRateLimiter limits by the rate limit rules of cfg. The buckets are kept in redis when
+// redis_url is set, so instances sharing it share the limits, otherwise in memory.
+func newRateLimiter(cfg *config.Config, keys db.KeyStore) *ratelimiter.RateLimiter {
+	loclog := "[server.newRateLimiter]"
+	rules, err := rateRules(cfg)
+	if err != nil {
+		slog.Error(loclog, "FATAL", "invalid rate policies", "error", err.Error())
+		os.Exit(1)
+	}
+	var store ratelimiter.Store
+	if cfg.RedisURL != "" {
+		slog.Info(loclog, "info", "keeping rate limits in redis")
+		store, err = ratelimiter.NewRedisURL(cfg.RedisURL)
+		if err != nil {
+			slog.Error(loclog, "FATAL", "invalid redis url", "error", err.Error())
+			os.Exit(1)
+		}
+	} else {
+		memory := ratelimiter.NewMemory(cfg.RateMaxVisitors)
+		expvar.Publish("ratelimiter", expvar.Func(func() any { return memory.Stats() }))
+		store = memory
+	}
+	limiter, err := ratelimiter.New(rules, store, identify(keys))
 	if err != nil {
-		slog.Error(loclog, "error", "serving on", "host", host, "port", port, "error", err.Error())
+		slog.Error(loclog, "FATAL", "failed to set up rate limiter", "error", err.Error())
 		os.Exit(1)
 	}
+	return limiter
 }
 
-func serveTLS(h http.Handler) {
-	loclog := "[server.serveTLS]"
-	allowedOrigins := strings.Split(env.AllowedOrigins.Get(), ",")
-	allowedMethods := strings.Split(env.AllowedMethods.Get(), ",")
-	handler := cors.New(cors.Options{
-		AllowedOrigins:   allowedOrigins,
-		AllowedMethods:   allowedMethods,
-		AllowedHeaders:   []string{"*"},
-		AllowCredentials: true,
-	}).Handler(h)
+// newBans keeps the ban list in the database and escalates by the ban settings of cfg
+func newBans(cfg *config.Config, store db.BanStore) *ratelimiter.Bans {
+	loclog := "[server.newBans]"
+	bans, err := ratelimiter.NewBans(store, escalationConfig(cfg))
+	if err != nil {
+		slog.Error(loclog, "FATAL", "failed to load ban list", "error", err.Error())
+		os.Exit(1)
+	}
+	return bans
+}
 
-	host := env.Host.Get()
-	port := env.Port.Get()
-	tlsc := env.TLSCertPath.Get()
-	tlsk := env.TLSKeyPath.Get()
+// newBandwidth throttles downloads by the bandwidth settings of cfg
+func newBandwidth(cfg *config.Config, keys db.KeyStore) *ratelimiter.Bandwidth {
+	loclog := "[server.newBandwidth]"
+	bc, err := bandwidthConfig(cfg)
+	if err != nil {
+		slog.Error(loclog, "FATAL", "invalid bandwidth limits", "error", err.Error())
+		os.Exit(1)
+	}
+	bw := ratelimiter.NewBandwidth(bc, identify(keys))
+	expvar.Publish("bandwidth_clients", expvar.Func(func() any { return bw.Clients() }))
+	return bw
+}
 
-	slog.Info(loclog, "info", "serving on", "host", host, "port", port)
-	err := http.ListenAndServeTLS(host+":"+port, tlsc, tlsk, handler)
+// identify tells the limiters which api key a request is made with, auth.Identify has resolved it
+func identify(keys db.KeyStore) ratelimiter.IdentifyFunc {
+	return func(r *http.Request) ratelimiter.Client {
+		id, err := auth.Resolve(keys, r)
+		if err != nil || id == nil {
+			return ratelimiter.Client{}
+		}
+		return ratelimiter.Client{Key: strconv.FormatInt(id.KeyID, 10), Issuer: id.Issuer, Admin: id.Admin}
+	}
+}
+
+// dryRunMigrations prints the migrations the next start would apply
+func dryRunMigrations(cfg *config.Config) {
+	loclog := "[server.dryRunMigrations]"
+	pending, err := db.DryRunMigrations(cfg.DBDSN, cfg.DBPath)
 	if err != nil {
-		slog.Error(loclog, "error", "serving on", "host", host, "port", port, "error", err.Error())
+		slog.Error(loclog, "error", "migrations would fail", "error", err.Error())
 		os.Exit(1)
 	}
+	if len(pending) == 0 {
+		fmt.Printf("schema is up to date (version %d)\n", db.LatestVersion())
+		return
+	}
+	fmt.Printf("%d migration(s) pending:\n", len(pending))
+	for _, m := range pending {
+		fmt.Println(m)
+	}
+}
+
+// manageKeys runs the api key command line actions
+func manageKeys(keys db.KeyStore, newKey string, admin bool, revokeKey string, listKeys bool) {
+	loclog := "[server.manageKeys]"
+	if newKey != "" {
+		key, k, err := auth.NewKey(keys, newKey, admin)
+		if err != nil {
+			slog.Error(loclog, "error", "failed to create api key", "issuer", newKey, "error", err.Error())
+			os.Exit(1)
+		}
+		fmt.Fprintf(os.Stderr, "api key for %q (prefix %s), it is not shown again:\n", k.Issuer, k.Prefix)
+		fmt.Println(key)
+	}
+	if revokeKey != "" {
+		n, err := keys.RevokeAPIKeys(revokeKey)
+		if err != nil {
+			slog.Error(loclog, "error", "failed to revoke api keys", "prefix", revokeKey, "error", err.Error())
+			os.Exit(1)
+		}
+		fmt.Printf("%d key(s) revoked\n", n)
+	}
+	if listKeys {
+		keys, err := keys.ListAPIKeys()
+		if err != nil {
+			slog.Error(loclog, "error", "failed to list api keys", "error", err.Error())
+			os.Exit(1)
+		}
+		for _, k := range keys {
+			state := "active"
+			if k.Revoked {
+				state = "revoked"
+			}
+			if k.Admin {
+				state += ",admin"
+			}
+			fmt.Printf("%s\t%s\t%s\t%s\n", k.Prefix, k.Issuer, k.CreatedAt().UTC().Format(time.DateTime), state)
+		}
+	}
+}
+
+func newCORS(cfg *config.Config) *cors.Cors {
+	return cors.New(cors.Options{
+		AllowedOrigins: cfg.AllowedOrigins,
+		AllowedMethods: cfg.AllowedMethods,
+		AllowedHeaders: []string{"*"},
+		// resumable upload and rate limited clients read these
+		ExposedHeaders: []string{"Location", "Tus-Resumable", "Upload-Offset", "Upload-Length",
+			"RateLimit-Limit", "RateLimit-Remaining", "RateLimit-Reset", "Retry-After"},
+		AllowCredentials: true,
+	})
+}
+
+// newServer serves h on host:port, or dev_host:dev_port in dev mode. Unless cert is nil it serves tls
+// with the certificate in cert, which is read on every handshake so reload can change it.
+func newServer(cfg *config.Config, h http.Handler, cert *certificate) *http.Server {
+	addr := cfg.Host + ":" + cfg.Port
+	if cfg.Dev {
+		addr = cfg.DevHost + ":" + cfg.DevPort
+	}
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           h,
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+		ReadTimeout:       cfg.ReadTimeout,
+		WriteTimeout:      cfg.WriteTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+	}
+	if cert != nil {
+		srv.TLSConfig = &tls.Config{GetCertificate: cert.get}
+	}
+	return srv
+}
+
+// serve serves until srv fails or is shut down, which is no error
+func serve(srv *http.Server) error {
+	loclog := "[server.serve]"
+	slog.Info(loclog, "info", "serving on", "addr", srv.Addr, "tls", srv.TLSConfig != nil)
+	var err error
+	if srv.TLSConfig != nil {
+		err = srv.ListenAndServeTLS("", "")
+	} else {
+		err = srv.ListenAndServe()
+	}
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+// handlerGrace bounds the wait for the handlers still running once the server is closed, see shutdown
+const handlerGrace = 10 * time.Second
+
+// inFlight tracks the running handlers, so they can be waited for after the server is closed
+type inFlight struct {
+	wg sync.WaitGroup
+}
+
+func (f *inFlight) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f.wg.Add(1)
+		defer f.wg.Done()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// wait waits up to timeout for the running handlers to return and reports whether they did
+func (f *inFlight) wait(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		f.wg.Wait()
+		close(done)
+	}()
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case <-done:
+		return true
+	case <-t.C:
+		return false
+	}
+}
+
+// shutdown stops accepting connections and waits up to timeout for the running requests,
+// downloads and uploads included, to finish. The ones still running then are cut off, and as Close
+// does not wait for their handlers, which still use the counters and the database, flight is waited
+// for up to grace before it returns.
+func shutdown(srv *http.Server, flight *inFlight, timeout, grace time.Duration) {
+	loclog := "[server.shutdown]"
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		slog.Warn(loclog, "warning", "requests still running at the deadline, closing them", "error", err.Error())
+		srv.Close()
+	}
+	if !flight.wait(grace) {
+		slog.Warn(loclog, "warning", "handlers still running, stopping anyway", "waited", grace)
+		return
+	}
+	slog.Info(loclog, "info", "all requests finished")
 }
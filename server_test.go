@@ -0,0 +1,107 @@
+package main
+
+import (
+	"femboyz/counters"
+	"femboyz/db"
+	"flag"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestLoaderChecks loads settings that config leaves to the packages they are for
+func TestLoaderChecks(t *testing.T) {
+	t.Setenv("DEV", "true")
+	load := func(args ...string) error {
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		l := newLoader(fs)
+		if err := fs.Parse(args); err != nil {
+			t.Fatalf("Failed to parse flags: %v", err)
+		}
+		_, err := l.Load()
+		return err
+	}
+
+	err := load("-rate-policies", "POST /api/v1/send=lots", "-trusted-proxies", "private,nowhere", "-bandwidth-per-ip", "fast")
+	if err == nil {
+		t.Fatalf("Expected invalid settings to fail")
+	}
+	for _, want := range []string{"-rate-policies (flag)", "-trusted-proxies (flag)", "-bandwidth-per-ip (flag)"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("Expected the error to name %s, got %v", want, err)
+		}
+	}
+
+	err = load("-rate-policies", "POST /api/v1/send=1/s:5", "-trusted-proxies", "private,10.1.2.3", "-bandwidth-per-ip", "512K")
+	if err != nil {
+		t.Errorf("Expected valid settings to load, got %v", err)
+	}
+}
+
+// TestShutdownWaitsForHandlers cuts off a request whose handler keeps running, shutdown returns
+// once it is done so the counts it makes are flushed by the counters stopped after it.
+func TestShutdownWaitsForHandlers(t *testing.T) {
+	store := db.NewMemory()
+	f := &db.File{PubID: "test_pub_id", Meta: db.FileMeta{OriginalName: "test.txt"}, Issuer: "tester"}
+	if err := store.InsertFile(f); err != nil {
+		t.Fatalf("Failed to insert file: %v", err)
+	}
+	c := counters.New(store)
+	c.Start(time.Hour)
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	flight := &inFlight{}
+	srv := &http.Server{Handler: flight.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		// busy with something that doesn't watch the request context
+		<-release
+		c.FileDownload(f.ID)
+	}))}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	go srv.Serve(ln)
+	go http.Get("http://" + ln.Addr().String())
+	<-started
+
+	time.AfterFunc(100*time.Millisecond, func() { close(release) })
+	shutdown(srv, flight, 10*time.Millisecond, 5*time.Second)
+	c.Stop()
+
+	retrieved, err := store.GetFileByPubID(f.PubID)
+	if err != nil {
+		t.Fatalf("Failed to get file: %v", err)
+	}
+	if retrieved.RefDL != 1 {
+		t.Errorf("Expected the download counted by the handler to be flushed, got %d", retrieved.RefDL)
+	}
+}
+
+func TestShutdownGrace(t *testing.T) {
+	flight := &inFlight{}
+	release := make(chan struct{})
+	defer close(release)
+	started := make(chan struct{})
+	srv := &http.Server{Handler: flight.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	}))}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	go srv.Serve(ln)
+	go http.Get("http://" + ln.Addr().String())
+	<-started
+
+	// a handler that never returns holds shutdown up for grace only
+	begin := time.Now()
+	shutdown(srv, flight, 10*time.Millisecond, 50*time.Millisecond)
+	if waited := time.Since(begin); waited > time.Second {
+		t.Errorf("Expected shutdown to give up after the grace, waited %v", waited)
+	}
+}
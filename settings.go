@@ -0,0 +1,82 @@
+package main
+
+import (
+	"femboyz/clientip"
+	"femboyz/config"
+	"femboyz/ratelimiter"
+	"flag"
+	"net/netip"
+	"strings"
+
+	"golang.org/x/time/rate"
+)
+
+// newLoader is config.NewLoader with checks for the settings that config keeps as they were given
+// and the packages they are for read.
+func newLoader(fs *flag.FlagSet) *config.Loader {
+	l := config.NewLoader(fs)
+	l.Check("trusted_proxies", func(c *config.Config) error {
+		_, err := trustedProxies(c)
+		return err
+	})
+	l.Check("rate_policies", func(c *config.Config) error {
+		_, err := rateRules(c)
+		return err
+	})
+	l.Check("bandwidth_limit", byteRate(func(c *config.Config) string { return c.BandwidthLimit }))
+	l.Check("bandwidth_per_ip", byteRate(func(c *config.Config) string { return c.BandwidthPerIP }))
+	l.Check("bandwidth_per_key", byteRate(func(c *config.Config) string { return c.BandwidthPerKey }))
+	return l
+}
+
+func byteRate(get func(c *config.Config) string) func(c *config.Config) error {
+	return func(c *config.Config) error {
+		_, err := ratelimiter.ParseByteRate(get(c))
+		return err
+	}
+}
+
+func trustedProxies(c *config.Config) ([]netip.Prefix, error) {
+	return clientip.ParseTrusted(strings.Join(c.TrustedProxies, ","))
+}
+
+// rateRules are the rate limit rules, rate_policies over rate_limit/rate_burst
+func rateRules(c *config.Config) (ratelimiter.Rules, error) {
+	def := ratelimiter.Policy{Name: "default", Rate: rate.Limit(c.RateLimit), Burst: c.RateBurst}
+	rules, err := ratelimiter.ParseRules(c.RatePolicies, def)
+	if err != nil {
+		return ratelimiter.Rules{}, err
+	}
+	rules.Prefixes = prefixes(c)
+	return rules, nil
+}
+
+func prefixes(c *config.Config) ratelimiter.Prefixes {
+	return ratelimiter.Prefixes{V4: c.RateIPv4Prefix, V6: c.RateIPv6Prefix}
+}
+
+func bandwidthConfig(c *config.Config) (ratelimiter.BandwidthConfig, error) {
+	bc := ratelimiter.BandwidthConfig{MaxConcurrent: c.MaxConcurrentDownloads, Prefixes: prefixes(c)}
+	var err error
+	for _, r := range []struct {
+		rate  *int64
+		value string
+	}{{&bc.Global, c.BandwidthLimit}, {&bc.PerIP, c.BandwidthPerIP}, {&bc.PerKey, c.BandwidthPerKey}} {
+		*r.rate, err = ratelimiter.ParseByteRate(r.value)
+		if err != nil {
+			return ratelimiter.BandwidthConfig{}, err
+		}
+	}
+	return bc, nil
+}
+
+func escalationConfig(c *config.Config) ratelimiter.EscalationConfig {
+	return ratelimiter.EscalationConfig{
+		MaxRefused:  c.BanMaxRefused,
+		MaxNotFound: c.BanMaxNotFound,
+		Window:      c.BanWindow,
+		BaseBan:     c.BanDuration,
+		MaxBan:      c.BanMaxDuration,
+		Prefixes:    prefixes(c),
+	}
+}